@@ -17,20 +17,27 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/config"
 	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/local"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
 	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/om"
 	_ "github.com/kubeservice-stack/local-cloud-csi-driver/pkg/options"
 	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 func init() {
@@ -41,8 +48,8 @@ const (
 	// LogfilePrefix prefix of log file
 	LogfilePrefix = "/var/log/ecloud/"
 
-	// MBSIZE MB size
-	MBSIZE = 1024 * 1024
+	// DefaultShutdownTimeout is how long the in-flight csi calls are waited for at shutdown
+	DefaultShutdownTimeout = 60 * time.Second
 
 	// TypePluginSuffix is the suffix of all storage plugins.
 	TypePluginSuffix = "plugin.csi.ecloud.cmss.com"
@@ -53,31 +60,52 @@ const (
 	// ProvisionerServicePort default port is 11270.
 	ProvisionerServicePort = "11270"
 
+	// ExtenderServicePort default port is 11280.
+	ExtenderServicePort = "11280"
+
 	// TypePluginLocal LVM type plugin
 	TypePluginLocal = "local.csi.ecloud.cmss.com"
 
+	// ExtenderAgent represents the scheduler extender type.
 	ExtenderAgent = "agent"
 )
 
 var (
 	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "node id")
-	driver   = flag.String("driver", TypePluginLocal, "CSI Driver")
+	driver   = flag.String("driver", TypePluginLocal, "CSI Drivers, comma separated name[:endpoint=...;topologyKey=...;<parameter>=...]")
+	// configFile settings override the flags and the environment variables
+	configFile = flag.String("config", "", "versioned yaml configuration file, reloaded when it changes")
+
+	// logFile is the host log file, nil when logging to stdout only
+	logFile *utils.RotatingFile
 )
 
 // CSI Plugin
 func main() {
 	flag.Parse()
-	serviceType := os.Getenv(utils.ServiceType)
-
-	if len(serviceType) == 0 || serviceType == "" {
-		serviceType = utils.PluginService
+	cfg := config.FromEnv()
+	cfg.Driver, cfg.Endpoint, cfg.NodeID = *driver, *endpoint, *nodeID
+
+	var watcher *config.Watcher
+	if *configFile != "" {
+		var err error
+		if watcher, err = config.NewWatcher(*configFile, cfg, validateConfig, applyConfig); err != nil {
+			log.Fatalf("Load config %s with error: %s", *configFile, err.Error())
+		}
+		cfg = watcher.Config()
+	} else if err := cfg.Validate(); err != nil {
+		// When serviceType is neither plugin, provisioner nor agent, the program will exits.
+		log.Fatalf("Invalid settings: %s", err.Error())
 	}
 
-	// When serviceType is neither plugin nor provisioner, the program will exits.
-	if serviceType != utils.PluginService && serviceType != utils.ProvisionerService {
-		log.Fatalf("Service type is unknown:%s", serviceType)
+	// the packages read the service settings from the environment
+	serviceType := cfg.ServiceType
+	_ = os.Setenv(utils.ServiceType, serviceType)
+	if cfg.ServicePort != "" {
+		_ = os.Setenv("SERVICE_PORT", cfg.ServicePort)
 	}
+	utils.KubeletRootDir = cfg.KubeletRootDir
 
 	var logAttribute string
 	switch serviceType {
@@ -85,40 +113,63 @@ func main() {
 		logAttribute = strings.Replace(TypePluginSuffix, utils.PluginService, utils.ProvisionerService, -1)
 	case utils.PluginService:
 		logAttribute = TypePluginSuffix
+	case ExtenderAgent:
+		logAttribute = strings.Replace(TypePluginSuffix, "plugin", ExtenderAgent, -1)
 	default:
 	}
 
-	setLogAttribute(logAttribute)
+	setLogAttribute(logAttribute, cfg.Log)
+	applyConfig(cfg)
+
+	driverOptions, err := lvm.ParseDriverOptions(cfg.Driver, cfg.Endpoint)
+	if err != nil {
+		log.Fatalf("Invalid driver %q: %s", cfg.Driver, err.Error())
+	}
+
+	configStop := make(chan struct{})
+	if watcher != nil {
+		go watcher.Run(configStop)
+	}
 
-	log.Infof("Multi CSI Driver Name: %s, nodeID: %s, endPoints: %s", *driver, *nodeID, *endpoint)
+	// the scheduler extender serves http only, no csi driver
+	if serviceType == ExtenderAgent {
+		runExtender(driverOptions)
+		return
+	}
 
-	multiDriverNames := *driver
-	endPointName := *endpoint
-	driverNames := strings.Split(multiDriverNames, ",")
+	log.Infof("Multi CSI Driver Name: %s, nodeID: %s, endPoints: %s", cfg.Driver, cfg.NodeID, cfg.Endpoint)
 	var wg sync.WaitGroup
 
 	// Storage devops
-	go om.StorageOM()
-
-	for _, driverName := range driverNames {
+	omStop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		om.StorageOM(omStop)
+	}()
+
+	drivers := []*lvm.LVM{}
+	for _, opts := range driverOptions {
 		wg.Add(1)
 
-		if err := createPersistentStorage(path.Join(utils.KubeletRootDir, "/csi-plugins", driverName, "controller")); err != nil {
+		if err := createPersistentStorage(path.Join(utils.KubeletRootDir, "/csi-plugins", opts.Name, "controller")); err != nil {
 			log.Errorf("failed to create persistent storage for controller: %v", err)
 			os.Exit(1)
 		}
-		if err := createPersistentStorage(path.Join(utils.KubeletRootDir, "/csi-plugins", driverName, "node")); err != nil {
+		if err := createPersistentStorage(path.Join(utils.KubeletRootDir, "/csi-plugins", opts.Name, "node")); err != nil {
 			log.Errorf("failed to create persistent storage for node: %v", err)
 			os.Exit(1)
 		}
-		go func(endPoint string) {
+		log.Infof("CSI Driver %s, endpoint: %s, topology key: %s, parameters: %v", opts.Name, opts.Endpoint, opts.TopologyKey, opts.Parameters)
+		driver := lvm.NewDriver(cfg.NodeID, opts)
+		drivers = append(drivers, driver)
+		go func() {
 			defer wg.Done()
-			driver := lvm.NewDriver(*nodeID, endPoint)
 			driver.Run()
-		}(endPointName)
+		}()
 
 	}
-	servicePort := os.Getenv("SERVICE_PORT")
+	servicePort := cfg.ServicePort
 
 	if len(servicePort) == 0 || servicePort == "" {
 		switch serviceType {
@@ -133,54 +184,113 @@ func main() {
 	log.Info("CSI is running status.")
 	server := &http.Server{Addr: ":" + servicePort}
 
-	http.HandleFunc("/healthz", healthHandler)
-	log.Infof("Metric listening on address: /healthz")
+	http.HandleFunc("/healthz", lvm.HealthHandler(false))
+	http.HandleFunc("/readyz", lvm.HealthHandler(true))
+	http.Handle("/metrics", metrics.Handler())
+	log.Infof("Metric listening on address: /metrics")
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Service port listen and serve err:%s", err.Error())
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Service port listen and serve err:%s", err.Error())
+		}
+	}()
+
+	sig := waitForSignal()
+	timeout := shutdownTimeout()
+	log.Infof("Received signal %s, shutting down in at most %s", sig, timeout)
+
+	// stop taking new csi calls and let the running lvm and mkfs commands finish
+	var stopWg sync.WaitGroup
+	for _, driver := range drivers {
+		stopWg.Add(1)
+		go func(driver *lvm.LVM) {
+			defer stopWg.Done()
+			driver.Stop(timeout)
+		}(driver)
+	}
+	stopWg.Wait()
+	close(omStop)
+	close(configStop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Shutdown http server with error: %s", err.Error())
 	}
 	wg.Wait()
+	log.Info("CSI is stopped.")
 	os.Exit(0)
 }
+
+// waitForSignal blocks until SIGTERM or SIGINT is received
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return <-signals
+}
+
+// shutdownTimeout returns how long the in-flight csi calls are waited for
+// at shutdown, set by SHUTDOWN_TIMEOUT and 60s by default.
+func shutdownTimeout() time.Duration {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Warnf("Invalid SHUTDOWN_TIMEOUT %q, use %s", v, DefaultShutdownTimeout)
+	}
+	return DefaultShutdownTimeout
+}
+
+// runExtender serves the scheduler extender filter and prioritize verbs
+func runExtender(drivers []*lvm.DriverOptions) {
+	servicePort := os.Getenv("SERVICE_PORT")
+	if servicePort == "" {
+		servicePort = ExtenderServicePort
+	}
+
+	lvm.NewExtender(drivers).Register(http.DefaultServeMux)
+	http.HandleFunc("/healthz", lvm.HealthHandler(false))
+	http.HandleFunc("/readyz", lvm.HealthHandler(true))
+	log.Infof("Scheduler extender listening on port: %s", servicePort)
+
+	server := &http.Server{Addr: ":" + servicePort}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Service port listen and serve err:%s", err.Error())
+		}
+	}()
+
+	sig := waitForSignal()
+	log.Infof("Received signal %s, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Shutdown http server with error: %s", err.Error())
+	}
+}
+
 func createPersistentStorage(persistentStoragePath string) error {
 	log.Infof("Create Stroage Path: %s", persistentStoragePath)
 	return os.MkdirAll(persistentStoragePath, os.FileMode(0755))
 }
 
-// rotate log file by 2M bytes
-// default print log to stdout and file both.
-func setLogAttribute(driver string) {
-	logType := os.Getenv("LOG_TYPE")
-	logType = strings.ToLower(logType)
-	if logType != "stdout" && logType != "host" {
-		logType = "both"
-	}
-	if logType == "stdout" {
+// setLogAttribute sets the log output of the log type: stdout, host or both.
+// The host file is rotated by size and age, the format and the rotation
+// limits are set by applyConfig.
+func setLogAttribute(driver string, logConfig config.LogConfig) {
+	if logConfig.Type == "stdout" {
 		return
 	}
 
 	_ = os.MkdirAll(LogfilePrefix, os.FileMode(0755))
-	logFile := LogfilePrefix + driver + ".log"
-	f, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
+	f := &utils.RotatingFile{Path: LogfilePrefix + driver + ".log"}
+	setLogLimits(f, logConfig)
+	if err := f.Open(); err != nil {
 		os.Exit(1)
 	}
+	logFile = f
 
-	// rotate the log file if too large
-	if fi, err := f.Stat(); err == nil && fi.Size() > 2*MBSIZE {
-		f.Close()
-		timeStr := time.Now().Format("-2006-01-02-15:04:05")
-		timedLogfile := LogfilePrefix + driver + timeStr + ".log"
-		err = os.Rename(logFile, timedLogfile)
-		if err != nil {
-			os.Exit(1)
-		}
-		f, err = os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			os.Exit(1)
-		}
-	}
-	if logType == "both" {
+	if logConfig.Type == "both" {
 		mw := io.MultiWriter(os.Stdout, f)
 		log.SetOutput(mw)
 	} else {
@@ -188,8 +298,37 @@ func setLogAttribute(driver string) {
 	}
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	message := "Liveness probe is OK, time:" + time.Now().String()
-	_, _ = w.Write([]byte(message))
+// setLogLimits sets the rotation limits of the host log file, the config is validated
+func setLogLimits(f *utils.RotatingFile, logConfig config.LogConfig) {
+	maxSize := resource.MustParse(logConfig.MaxSize)
+	maxAge, _ := time.ParseDuration(logConfig.MaxAge)
+	f.SetLimits(maxSize.Value(), maxAge, logConfig.MaxFiles, logConfig.Compress)
+}
+
+// validateConfig checks the settings of the configuration file validated by the driver
+func validateConfig(cfg *config.Config) error {
+	if _, err := lvm.ParseDriverOptions(cfg.Driver, cfg.Endpoint); err != nil {
+		return fmt.Errorf("driver %q: %v", cfg.Driver, err)
+	}
+	if err := lvm.ValidateDefaultParameters(cfg.VolumeParameters()); err != nil {
+		return fmt.Errorf("volume: %v", err)
+	}
+	return nil
+}
+
+// applyConfig applies the settings which may change at runtime: the log
+// format and rotation, the volume defaults and the om settings.
+func applyConfig(cfg *config.Config) {
+	if cfg.Log.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+	if logFile != nil {
+		setLogLimits(logFile, cfg.Log)
+	}
+	if err := lvm.SetDefaultParameters(cfg.VolumeParameters()); err != nil {
+		log.Errorf("applyConfig: set volume defaults with error: %s", err.Error())
+	}
+	om.SetGlobalConfig(cfg.OMConfig())
 }
@@ -0,0 +1,322 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/om"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Version is the supported version of the configuration file
+	Version = "v1"
+	// ExtenderAgent is the service type of the scheduler extender
+	ExtenderAgent = "agent"
+	// maxMessageFileLines bounds the lines of the message file checked by om
+	maxMessageFileLines = 500
+)
+
+// Config is the configuration of the plugin, the fields not set in the
+// file keep the values of the flags and the environment variables.
+type Config struct {
+	Version string `json:"version"`
+	// Driver, Endpoint and NodeID are the --driver, --endpoint and --nodeid flags
+	Driver   string `json:"driver,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	NodeID   string `json:"nodeID,omitempty"`
+	// ServiceType is SERVICE_TYPE: local, provisioner or agent
+	ServiceType string `json:"serviceType,omitempty"`
+	// ServicePort is SERVICE_PORT, the default port of the service type when empty
+	ServicePort string `json:"servicePort,omitempty"`
+	// KubeletRootDir is KUBELET_ROOT_DIR
+	KubeletRootDir string       `json:"kubeletRootDir,omitempty"`
+	Log            LogConfig    `json:"log"`
+	Volume         VolumeConfig `json:"volume"`
+	OM             OMConfig     `json:"om"`
+}
+
+// LogConfig is the LOG_* configuration
+type LogConfig struct {
+	// Type is stdout, host or both
+	Type string `json:"type,omitempty"`
+	// Format is text or json
+	Format   string `json:"format,omitempty"`
+	MaxSize  string `json:"maxSize,omitempty"`
+	MaxAge   string `json:"maxAge,omitempty"`
+	MaxFiles int    `json:"maxFiles"`
+	Compress bool   `json:"compress"`
+}
+
+// VolumeConfig are the defaults of the volumes whose storage class or
+// driver does not set them.
+type VolumeConfig struct {
+	VGName     string   `json:"vgName,omitempty"`
+	VGSelector string   `json:"vgSelector,omitempty"`
+	VGPolicy   string   `json:"vgPolicy,omitempty"`
+	IOLimits   IOLimits `json:"ioLimits"`
+}
+
+// IOLimits are the default io limits of the volumes, the bps take a k, m or g suffix
+type IOLimits struct {
+	ReadIOPS  int    `json:"readIOPS,omitempty"`
+	WriteIOPS int    `json:"writeIOPS,omitempty"`
+	ReadBPS   string `json:"readBPS,omitempty"`
+	WriteBPS  string `json:"writeBPS,omitempty"`
+}
+
+// OMConfig is the ISSUE_* and MESSAGE_FILE_LINES configuration of om
+type OMConfig struct {
+	IssueMessageFile     bool `json:"issueMessageFile"`
+	IssueBlockReference  bool `json:"issueBlockReference"`
+	IssueOrphanedPod     bool `json:"issueOrphanedPod"`
+	IssueEphemeralVolume bool `json:"issueEphemeralVolume"`
+	MessageFileLines     int  `json:"messageFileLines"`
+}
+
+// reloadable are the field prefixes applied without restarting the plugin
+var reloadable = []string{"log.format", "log.maxSize", "log.maxAge", "log.maxFiles", "log.compress", "volume.", "om."}
+
+// FromEnv returns the configuration of the environment variables, the
+// flags are set by the caller.
+func FromEnv() *Config {
+	cfg := &Config{
+		Version:        Version,
+		ServiceType:    os.Getenv(utils.ServiceType),
+		ServicePort:    os.Getenv("SERVICE_PORT"),
+		KubeletRootDir: utils.KubeletRootDir,
+		Log: LogConfig{
+			Type:     strings.ToLower(os.Getenv("LOG_TYPE")),
+			Format:   strings.ToLower(os.Getenv("LOG_FORMAT")),
+			MaxSize:  os.Getenv("LOG_MAX_SIZE"),
+			MaxAge:   os.Getenv("LOG_MAX_AGE"),
+			MaxFiles: 5,
+		},
+		OM: OMConfig{
+			IssueMessageFile:     os.Getenv(om.IssueMessageFile) == "true",
+			IssueBlockReference:  os.Getenv(om.IssueBlockReference) == "true",
+			IssueOrphanedPod:     os.Getenv(om.IssueOrphanedPod) == "true",
+			IssueEphemeralVolume: os.Getenv(om.IssueEphemeralVolume) == "true",
+			MessageFileLines:     20,
+		},
+	}
+	if cfg.ServiceType == "" {
+		cfg.ServiceType = utils.PluginService
+	}
+	if cfg.Log.Type != "stdout" && cfg.Log.Type != "host" {
+		cfg.Log.Type = "both"
+	}
+	if cfg.Log.Format != "json" {
+		cfg.Log.Format = "text"
+	}
+	if cfg.Log.MaxSize == "" {
+		cfg.Log.MaxSize = "2Mi"
+	}
+	if cfg.Log.MaxAge == "" {
+		cfg.Log.MaxAge = "24h"
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOG_MAX_FILES")); err == nil {
+		cfg.Log.MaxFiles = n
+	}
+	cfg.Log.Compress, _ = strconv.ParseBool(os.Getenv("LOG_COMPRESS"))
+	if n, err := strconv.Atoi(os.Getenv(om.MessageFileLines)); err == nil {
+		cfg.OM.MessageFileLines = n
+	}
+	return cfg
+}
+
+// Load reads the yaml file over a copy of base and validates the result
+func Load(path string, base *Config) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, base)
+}
+
+// Parse reads the yaml data over a copy of base, unknown fields are
+// rejected. The parsed configuration is returned with the validation error.
+func Parse(data []byte, base *Config) (*Config, error) {
+	cfg := base.DeepCopy()
+	cfg.Version = ""
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %v", err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// DeepCopy returns a copy of the configuration
+func (c *Config) DeepCopy() *Config {
+	copied := *c
+	return &copied
+}
+
+// Validate checks the values of the configuration
+func (c *Config) Validate() error {
+	errs := []string{}
+	if c.Version != Version {
+		errs = append(errs, fmt.Sprintf("version %q is not supported, expect %s", c.Version, Version))
+	}
+	switch c.ServiceType {
+	case utils.PluginService, utils.ProvisionerService, ExtenderAgent:
+	default:
+		errs = append(errs, fmt.Sprintf("serviceType %q is unknown", c.ServiceType))
+	}
+	if c.ServicePort != "" {
+		if port, err := strconv.Atoi(c.ServicePort); err != nil || port <= 0 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("servicePort %q is not a port", c.ServicePort))
+		}
+	}
+	if !strings.HasPrefix(c.KubeletRootDir, "/") {
+		errs = append(errs, fmt.Sprintf("kubeletRootDir %q is not an absolute path", c.KubeletRootDir))
+	}
+	switch c.Log.Type {
+	case "stdout", "host", "both":
+	default:
+		errs = append(errs, fmt.Sprintf("log.type %q is unknown, supported: stdout, host, both", c.Log.Type))
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Sprintf("log.format %q is unknown, supported: text, json", c.Log.Format))
+	}
+	if q, err := resource.ParseQuantity(c.Log.MaxSize); err != nil || q.Sign() < 0 {
+		errs = append(errs, fmt.Sprintf("log.maxSize %q is not a size", c.Log.MaxSize))
+	}
+	if d, err := time.ParseDuration(c.Log.MaxAge); err != nil || d < 0 {
+		errs = append(errs, fmt.Sprintf("log.maxAge %q is not a duration", c.Log.MaxAge))
+	}
+	if c.Log.MaxFiles < 0 {
+		errs = append(errs, fmt.Sprintf("log.maxFiles %d is negative", c.Log.MaxFiles))
+	}
+	limits := c.Volume.IOLimits
+	if limits.ReadIOPS < 0 || limits.WriteIOPS < 0 {
+		errs = append(errs, "volume.ioLimits iops are negative")
+	}
+	for name, bps := range map[string]string{"readBPS": limits.ReadBPS, "writeBPS": limits.WriteBPS} {
+		if !validBPS(bps) {
+			errs = append(errs, fmt.Sprintf("volume.ioLimits.%s %q is not a number with an optional k, m or g suffix", name, bps))
+		}
+	}
+	if c.OM.MessageFileLines <= 0 || c.OM.MessageFileLines > maxMessageFileLines {
+		errs = append(errs, fmt.Sprintf("om.messageFileLines %d is out of 1-%d", c.OM.MessageFileLines, maxMessageFileLines))
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validBPS checks a bps limit in the format of the readBPS volume attribute
+func validBPS(bps string) bool {
+	if bps == "" {
+		return true
+	}
+	bps = strings.TrimRight(strings.ToLower(bps), "kmg")
+	n, err := strconv.Atoi(bps)
+	return err == nil && n >= 0
+}
+
+// VolumeParameters returns the default volume parameters of the configuration
+func (c *Config) VolumeParameters() map[string]string {
+	parameters := map[string]string{}
+	set := func(key, value string) {
+		if value != "" && value != "0" {
+			parameters[key] = value
+		}
+	}
+	set("vgName", c.Volume.VGName)
+	set("vgSelector", c.Volume.VGSelector)
+	set("vgPolicy", c.Volume.VGPolicy)
+	set("readIOPS", strconv.Itoa(c.Volume.IOLimits.ReadIOPS))
+	set("writeIOPS", strconv.Itoa(c.Volume.IOLimits.WriteIOPS))
+	set("readBPS", c.Volume.IOLimits.ReadBPS)
+	set("writeBPS", c.Volume.IOLimits.WriteBPS)
+	return parameters
+}
+
+// OMConfig returns the om settings of the configuration
+func (c *Config) OMConfig() om.GlobalConfig {
+	return om.GlobalConfig{
+		IssueMessageFile:     c.OM.IssueMessageFile,
+		MessageFileTailLines: c.OM.MessageFileLines,
+		IssueBlockReference:  c.OM.IssueBlockReference,
+		IssueOrphanedPod:     c.OM.IssueOrphanedPod,
+		IssueEphemeralVolume: c.OM.IssueEphemeralVolume,
+	}
+}
+
+// Diff returns the changed fields from old to c as `field: "old" -> "new"`, sorted
+func (c *Config) Diff(old *Config) []string {
+	before, after := flatten(old), flatten(c)
+	changes := []string{}
+	for key, value := range after {
+		if before[key] != value {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", key, before[key], value))
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", key, value, ""))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// IsReloadable returns whether the change of a Diff applies without restart
+func IsReloadable(change string) bool {
+	for _, prefix := range reloadable {
+		if strings.HasPrefix(change, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten returns the json fields of the configuration by their dotted path
+func flatten(c *Config) map[string]string {
+	fields := map[string]string{}
+	if c == nil {
+		return fields
+	}
+	data, _ := json.Marshal(c)
+	var obj map[string]interface{}
+	_ = json.Unmarshal(data, &obj)
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		if m, ok := value.(map[string]interface{}); ok {
+			for key, v := range m {
+				walk(prefix+key+".", v)
+			}
+			return
+		}
+		fields[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(value)
+	}
+	walk("", obj)
+	return fields
+}
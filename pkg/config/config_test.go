@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromEnv(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv("SERVICE_TYPE", "")
+	t.Setenv("LOG_TYPE", "HOST")
+	t.Setenv("LOG_MAX_FILES", "3")
+	t.Setenv("ISSUE_BLOCK_REFERENCE", "true")
+	t.Setenv("MESSAGE_FILE_LINES", "50")
+	cfg := FromEnv()
+	assert.Nil(cfg.Validate())
+	assert.Equal("local", cfg.ServiceType)
+	assert.Equal(LogConfig{Type: "host", Format: "text", MaxSize: "2Mi", MaxAge: "24h", MaxFiles: 3}, cfg.Log)
+	assert.True(cfg.OM.IssueBlockReference)
+	assert.False(cfg.OM.IssueOrphanedPod)
+	assert.Equal(50, cfg.OM.MessageFileLines)
+}
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	base := FromEnv()
+	base.Driver, base.Endpoint = "local.csi.ecloud.cmss.com", "unix://tmp/csi.sock"
+
+	cfg, err := Parse([]byte(`
+version: v1
+servicePort: "11300"
+log:
+  format: json
+  maxFiles: 10
+volume:
+  vgName: vg1
+  ioLimits:
+    readIOPS: 1000
+    writeBPS: 10m
+om:
+  issueEphemeralVolume: true
+`), base)
+	assert.Nil(err)
+	assert.Equal("11300", cfg.ServicePort)
+	assert.Equal("json", cfg.Log.Format)
+	assert.Equal(10, cfg.Log.MaxFiles)
+	// the fields not in the file keep the base values
+	assert.Equal(base.Driver, cfg.Driver)
+	assert.Equal(base.Log.MaxSize, cfg.Log.MaxSize)
+	assert.Equal("", base.Volume.VGName)
+	assert.Equal(map[string]string{"vgName": "vg1", "readIOPS": "1000", "writeBPS": "10m"}, cfg.VolumeParameters())
+	assert.True(cfg.OMConfig().IssueEphemeralVolume)
+	assert.Equal(base.OM.MessageFileLines, cfg.OMConfig().MessageFileTailLines)
+
+	for _, data := range []string{
+		"log: {format: json}",
+		"version: v2",
+		"version: v1\nunknown: true",
+		"version: v1\nserviceType: controller",
+		"version: v1\nservicePort: http",
+		"version: v1\nkubeletRootDir: var/lib/kubelet",
+		"version: v1\nlog: {type: file}",
+		"version: v1\nlog: {maxSize: big}",
+		"version: v1\nlog: {maxAge: 1d}",
+		"version: v1\nlog: {maxFiles: -1}",
+		"version: v1\nvolume: {ioLimits: {readBPS: 10x}}",
+		"version: v1\nvolume: {ioLimits: {writeIOPS: -1}}",
+		"version: v1\nom: {messageFileLines: 1000}",
+	} {
+		_, err = Parse([]byte(data), base)
+		assert.NotNil(err, data)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	old := FromEnv()
+	cfg := old.DeepCopy()
+	assert.Empty(cfg.Diff(old))
+
+	cfg.ServiceType = "provisioner"
+	cfg.Log.Format = "json"
+	cfg.Volume.IOLimits.ReadIOPS = 100
+	diff := cfg.Diff(old)
+	assert.Equal([]string{
+		`log.format: "text" -> "json"`,
+		`serviceType: "local" -> "provisioner"`,
+		`volume.ioLimits.readIOPS: "" -> "100"`,
+	}, diff)
+	assert.True(IsReloadable(diff[0]))
+	assert.False(IsReloadable(diff[1]))
+	assert.True(IsReloadable(diff[2]))
+	assert.False(IsReloadable(`log.type: "both" -> "host"`))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReloadInterval is how often the configuration file is checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// Watcher reloads the configuration file when it changes, a configmap
+// volume replaces the file content in place.
+type Watcher struct {
+	Path     string
+	Interval time.Duration
+	// Validate checks the settings validated outside of this package
+	Validate func(*Config) error
+	// Apply applies the reloadable settings of a valid configuration
+	Apply func(*Config)
+
+	mutex   sync.Mutex
+	base    *Config
+	current *Config
+	data    []byte
+}
+
+// NewWatcher loads the configuration file over base, it fails if the file is invalid
+func NewWatcher(path string, base *Config, validate func(*Config) error, apply func(*Config)) (*Watcher, error) {
+	w := &Watcher{Path: path, Interval: DefaultReloadInterval, Validate: validate, Apply: apply, base: base}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := w.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	w.current, w.data = cfg, data
+	return w, nil
+}
+
+// Config returns the configuration in use
+func (w *Watcher) Config() *Config {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.current.DeepCopy()
+}
+
+// Run checks the file every interval until stop is closed
+func (w *Watcher) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(w.Interval):
+			w.Reload()
+		}
+	}
+}
+
+// Reload applies the file if it changed and is valid, it returns whether it was applied
+func (w *Watcher) Reload() bool {
+	data, err := os.ReadFile(w.Path)
+	if err != nil {
+		log.Errorf("config: read %s with error: %s, keep the current config", w.Path, err.Error())
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if bytes.Equal(data, w.data) {
+		return false
+	}
+	w.data = data
+	cfg, err := w.parse(data)
+	if err != nil {
+		diff := []string{}
+		if cfg != nil {
+			diff = cfg.Diff(w.current)
+		}
+		log.Errorf("config: reject the reload of %s: %s, diff: [%s]", w.Path, err.Error(), strings.Join(diff, ", "))
+		return false
+	}
+	diff := cfg.Diff(w.current)
+	if len(diff) == 0 {
+		return false
+	}
+	for _, change := range diff {
+		if IsReloadable(change) {
+			log.Infof("config: reload %s", change)
+		} else {
+			log.Warnf("config: %s takes effect after restart", change)
+		}
+	}
+	w.current = cfg
+	if w.Apply != nil {
+		w.Apply(cfg)
+	}
+	return true
+}
+
+func (w *Watcher) parse(data []byte) (*Config, error) {
+	cfg, err := Parse(data, w.base)
+	if err == nil && w.Validate != nil {
+		err = w.Validate(cfg)
+	}
+	return cfg, err
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcher(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(os.WriteFile(path, []byte("version: v1\nvolume: {vgName: vg1}\n"), 0644))
+
+	applied := []*Config{}
+	validate := func(cfg *Config) error {
+		if cfg.Volume.VGName == "forbidden" {
+			return errors.New("vg forbidden")
+		}
+		return nil
+	}
+	w, err := NewWatcher(path, FromEnv(), validate, func(cfg *Config) { applied = append(applied, cfg) })
+	assert.Nil(err)
+	assert.Equal("vg1", w.Config().Volume.VGName)
+
+	// unchanged file
+	assert.False(w.Reload())
+
+	assert.Nil(os.WriteFile(path, []byte("version: v1\nvolume: {vgName: vg2}\nlog: {type: host}\n"), 0644))
+	assert.True(w.Reload())
+	assert.Len(applied, 1)
+	assert.Equal("vg2", w.Config().Volume.VGName)
+	assert.Equal("host", w.Config().Log.Type)
+
+	// invalid files are rejected and the current config is kept
+	for _, data := range []string{"version: v1\nvolume: {vgName: forbidden}\n", "version: v1\nlog: {format: xml}\n", "version: [v1"} {
+		assert.Nil(os.WriteFile(path, []byte(data), 0644))
+		assert.False(w.Reload(), data)
+	}
+	assert.Len(applied, 1)
+	assert.Equal("vg2", w.Config().Volume.VGName)
+
+	assert.Nil(os.WriteFile(path, []byte("version: v1\nvolume: {vgName: forbidden}\n"), 0644))
+	_, err = NewWatcher(path, FromEnv(), validate, nil)
+	assert.NotNil(err)
+}
@@ -0,0 +1,546 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/util/resizefs"
+	utilexec "k8s.io/utils/exec"
+	k8smount "k8s.io/utils/mount"
+)
+
+const (
+	// BackupIntervalAnnotation is the pvc annotation of the backup interval, e.g. 24h
+	BackupIntervalAnnotation = "local.csi.ecloud.cmss.com/backup-interval"
+	// LastBackupAnnotation is the pvc annotation of the id of the latest backup
+	LastBackupAnnotation = "local.csi.ecloud.cmss.com/last-backup"
+	// LastBackupTimeAnnotation is the pvc annotation of the time of the latest backup
+	LastBackupTimeAnnotation = "local.csi.ecloud.cmss.com/last-backup-time"
+	// RestoreFromAnnotation is the pvc annotation of the backup id a new volume is populated from
+	RestoreFromAnnotation = "local.csi.ecloud.cmss.com/restore-from"
+
+	// BackupSucceededReason event reason
+	BackupSucceededReason = "VolumeBackupSucceeded"
+	// BackupFailedReason event reason
+	BackupFailedReason = "VolumeBackupFailed"
+	// RestoreSucceededReason event reason
+	RestoreSucceededReason = "VolumeRestoreSucceeded"
+	// RestoreFailedReason event reason
+	RestoreFailedReason = "VolumeRestoreFailed"
+
+	// backupChunkSize is the size of the chunks the volume is split in
+	backupChunkSize = 4 * 1024 * 1024
+	// backupCompression is the compression of the chunks
+	backupCompression = "gzip"
+	// backupStateKind is the node state kind of the running backups
+	backupStateKind = "backup"
+	// restoreStateKind is the node state kind of the running restores
+	restoreStateKind = "restore"
+	// backupSnapshotSuffix is the name suffix of the snapshot read by the backup
+	backupSnapshotSuffix = "_bsnap"
+	// backupCheckInterval is the interval to look for the volumes due to back up
+	backupCheckInterval = 10 * time.Minute
+	// restoreProgressChunks is the number of chunks written between two progress records
+	restoreProgressChunks = 16
+)
+
+// backupManifest lists the chunks of a backup, an empty chunk is all zeros
+type backupManifest struct {
+	ID          string    `json:"id"`
+	VolumeID    string    `json:"volumeID"`
+	Namespace   string    `json:"namespace"`
+	Claim       string    `json:"claim"`
+	Parent      string    `json:"parent,omitempty"`
+	Size        int64     `json:"size"`
+	ChunkSize   int64     `json:"chunkSize"`
+	Compression string    `json:"compression"`
+	Chunks      []string  `json:"chunks"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// backupState is a backup running on the node
+type backupState struct {
+	VolumeID string `json:"volumeID"`
+	VGName   string `json:"vgName"`
+}
+
+// restoreState is a restore of the node, Chunk is the next chunk to write
+type restoreState struct {
+	VolumeID string `json:"volumeID"`
+	BackupID string `json:"backupID"`
+	Chunk    int    `json:"chunk"`
+	Done     bool   `json:"done,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	// restoringVolumes the volumes being restored in background
+	restoringVolumes = map[string]bool{}
+	// restoringVolumesMutex Mutex for restoringVolumes map
+	restoringVolumesMutex sync.Mutex
+)
+
+func manifestKey(backupID string) string {
+	return "backups/" + backupID + ".json"
+}
+
+func chunkKey(hash string) string {
+	return "chunks/" + hash[:2] + "/" + hash
+}
+
+// newBackupID returns the id of a backup of the volume
+func newBackupID(volumeID string, now time.Time) string {
+	return fmt.Sprintf("%s-%s", volumeID, now.UTC().Format("20060102150405"))
+}
+
+// backupDue checks whether the claim requests a backup at the time
+func backupDue(pvc *v1.PersistentVolumeClaim, now time.Time) (bool, error) {
+	value := pvc.Annotations[BackupIntervalAnnotation]
+	if value == "" {
+		return false, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return false, fmt.Errorf("invalid %s %q", BackupIntervalAnnotation, value)
+	}
+	last, err := time.Parse(time.RFC3339, pvc.Annotations[LastBackupTimeAnnotation])
+	if err != nil {
+		return true, nil
+	}
+	return !now.Before(last.Add(interval)), nil
+}
+
+func isZeroChunk(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func compressChunk(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressChunk(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// loadManifest downloads the manifest of the backup
+func loadManifest(ctx context.Context, store objectStore, backupID string) (*backupManifest, error) {
+	data, err := store.GetObject(ctx, manifestKey(backupID))
+	if err != nil {
+		return nil, fmt.Errorf("get manifest of backup %s: %v", backupID, err)
+	}
+	manifest := &backupManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest of backup %s: %v", backupID, err)
+	}
+	if manifest.ChunkSize <= 0 || int64(len(manifest.Chunks)) != (manifest.Size+manifest.ChunkSize-1)/manifest.ChunkSize {
+		return nil, fmt.Errorf("invalid manifest of backup %s", backupID)
+	}
+	return manifest, nil
+}
+
+// backupDevice uploads the chunks of the device missing in the parent
+// backup and the manifest, it returns the number of chunks uploaded.
+func backupDevice(ctx context.Context, store objectStore, device io.Reader, manifest *backupManifest, parent *backupManifest) (int, error) {
+	known := map[string]bool{}
+	if parent != nil {
+		for _, hash := range parent.Chunks {
+			known[hash] = true
+		}
+	}
+	manifest.ChunkSize = backupChunkSize
+	manifest.Compression = backupCompression
+	manifest.Chunks = []string{}
+	uploaded := 0
+	buf := make([]byte, backupChunkSize)
+	for offset := int64(0); offset < manifest.Size; offset += backupChunkSize {
+		n := manifest.Size - offset
+		if n > backupChunkSize {
+			n = backupChunkSize
+		}
+		if _, err := io.ReadFull(device, buf[:n]); err != nil {
+			return uploaded, fmt.Errorf("read at offset %d: %v", offset, err)
+		}
+		chunk := buf[:n]
+		if isZeroChunk(chunk) {
+			manifest.Chunks = append(manifest.Chunks, "")
+			continue
+		}
+		hash := sha256Hex(chunk)
+		manifest.Chunks = append(manifest.Chunks, hash)
+		if known[hash] {
+			continue
+		}
+		data, err := compressChunk(chunk)
+		if err != nil {
+			return uploaded, err
+		}
+		if err := store.PutObject(ctx, chunkKey(hash), data); err != nil {
+			return uploaded, err
+		}
+		known[hash] = true
+		uploaded++
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return uploaded, err
+	}
+	return uploaded, store.PutObject(ctx, manifestKey(manifest.ID), data)
+}
+
+// checkRestoreSource checks that the backup was taken of a claim of the
+// namespace of the claim restored from it.
+func checkRestoreSource(manifest *backupManifest, pvc *v1.PersistentVolumeClaim) error {
+	if manifest.Namespace == "" || manifest.Namespace != pvc.Namespace {
+		return fmt.Errorf("backup %s of claim %s/%s can not be restored in namespace %s", manifest.ID, manifest.Namespace, manifest.Claim, pvc.Namespace)
+	}
+	return nil
+}
+
+// restoreDevice writes the chunks of the backup to the device from the
+// chunk start, progress is called with the next chunk every few chunks.
+func restoreDevice(ctx context.Context, store objectStore, manifest *backupManifest, device io.WriterAt, start int, progress func(next int) error) error {
+	zeros := make([]byte, manifest.ChunkSize)
+	for i := start; i < len(manifest.Chunks); i++ {
+		hash := manifest.Chunks[i]
+		offset := int64(i) * manifest.ChunkSize
+		n := manifest.Size - offset
+		if n > manifest.ChunkSize {
+			n = manifest.ChunkSize
+		}
+		chunk := zeros[:n]
+		if hash != "" {
+			data, err := store.GetObject(ctx, chunkKey(hash))
+			if err != nil {
+				return fmt.Errorf("get chunk %s: %v", hash, err)
+			}
+			if chunk, err = decompressChunk(data); err != nil {
+				return fmt.Errorf("decompress chunk %s: %v", hash, err)
+			}
+			if int64(len(chunk)) != n || sha256Hex(chunk) != hash {
+				return fmt.Errorf("chunk %s is corrupted", hash)
+			}
+		}
+		if _, err := device.WriteAt(chunk, offset); err != nil {
+			return fmt.Errorf("write at offset %d: %v", offset, err)
+		}
+		if progress != nil && (i+1)%restoreProgressChunks == 0 {
+			if err := progress(i + 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backupVolumes backs up the volumes of the node whose claim sets a backup interval
+func (ns *nodeServer) backupVolumes() {
+	store, err := newS3Client()
+	if err != nil {
+		log.Errorf("backupVolumes: %s, backups are disabled", err.Error())
+		return
+	}
+	if store == nil {
+		return
+	}
+	ns.cleanupBackups()
+	for {
+		ns.startBackups(store)
+		time.Sleep(backupCheckInterval)
+	}
+}
+
+// cleanupBackups removes the snapshots of the backups interrupted by a restart
+func (ns *nodeServer) cleanupBackups() {
+	names, err := listNodeStates(backupStateKind)
+	if err != nil {
+		log.Errorf("cleanupBackups: list backup states with error: %s", err.Error())
+		return
+	}
+	for _, name := range names {
+		state := &backupState{}
+		if err := loadNodeState(backupStateKind, name, state); err == nil {
+			if err := removeSnapshot(state.VGName, state.VolumeID+backupSnapshotSuffix); err != nil {
+				log.Errorf("cleanupBackups: remove snapshot of %s with error: %s", state.VolumeID, err.Error())
+				continue
+			}
+		}
+		_ = removeNodeState(backupStateKind, name)
+	}
+}
+
+func (ns *nodeServer) startBackups(store objectStore) {
+	pvcs, err := ns.client.CoreV1().PersistentVolumeClaims("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("backupVolumes: list pvcs with error: %s", err.Error())
+		return
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if pvc.Spec.VolumeName == "" {
+			continue
+		}
+		due, err := backupDue(pvc, time.Now())
+		if err != nil {
+			log.Errorf("backupVolumes: pvc %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+			continue
+		}
+		if !due {
+			continue
+		}
+		pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.Errorf("backupVolumes: get pv %s with error: %s", pvc.Spec.VolumeName, err.Error())
+			}
+			continue
+		}
+		if pv.Spec.CSI == nil || !isLocalDriver(pv.Spec.CSI.Driver) || pvNodeName(pv) != ns.nodeID {
+			continue
+		}
+		pvType := pv.Spec.CSI.VolumeAttributes[PvTypeTag]
+		if pvType == DeviceType || pvType == QuotaPathType || isVolumeMigrating(pv.Name) {
+			continue
+		}
+		if err := ns.backupVolume(store, pvc, pv); err != nil {
+			message := fmt.Sprintf("backup of volume %s failed: %s", pv.Name, err.Error())
+			log.Errorf("backupVolumes: %s", message)
+			ns.claimEvent(pvc, v1.EventTypeWarning, BackupFailedReason, message)
+		}
+	}
+}
+
+// backupVolume uploads a snapshot of the volume, incremental to the latest backup
+func (ns *nodeServer) backupVolume(store objectStore, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) error {
+	ctx := context.Background()
+	vgName, _ := splitThinPool(recordedVG(pv))
+	lvs, err := listLogicalVolumes(fmt.Sprintf("%s/%s", vgName, pv.Name))
+	if err != nil || len(lvs) == 0 {
+		// the volume is created when it is first mounted
+		return nil
+	}
+	lv := lvs[0]
+
+	state := &backupState{VolumeID: pv.Name, VGName: vgName}
+	if err := saveNodeState(backupStateKind, pv.Name, state); err != nil {
+		return err
+	}
+	defer func() {
+		if err := removeSnapshot(vgName, pv.Name+backupSnapshotSuffix); err != nil {
+			log.Errorf("backupVolume: remove snapshot of %s with error: %s", pv.Name, err.Error())
+			return
+		}
+		_ = removeNodeState(backupStateKind, pv.Name)
+	}()
+	snapshot := pv.Name + backupSnapshotSuffix
+	if err := createSnapshot(lv, snapshot); err != nil {
+		return err
+	}
+
+	var parent *backupManifest
+	if parentID := pvc.Annotations[LastBackupAnnotation]; parentID != "" {
+		if parent, err = loadManifest(ctx, store, parentID); err != nil {
+			log.Warnf("backupVolume: %s, run a full backup of %s", err.Error(), pv.Name)
+			parent = nil
+		}
+	}
+	now := time.Now()
+	manifest := &backupManifest{ID: newBackupID(pv.Name, now), VolumeID: pv.Name, Namespace: pvc.Namespace, Claim: pvc.Name, Size: lv.Size, CreatedAt: now.UTC()}
+	if parent != nil {
+		manifest.Parent = parent.ID
+	}
+	f, err := os.Open(fmt.Sprintf("/dev/%s/%s", vgName, snapshot))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	uploaded, err := backupDevice(ctx, store, f, manifest, parent)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]string{
+		LastBackupAnnotation:     manifest.ID,
+		LastBackupTimeAnnotation: now.UTC().Format(time.RFC3339),
+	}}})
+	if err != nil {
+		return err
+	}
+	if _, err := ns.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("volume %s backed up as %s, %d of %d chunks uploaded", pv.Name, manifest.ID, uploaded, len(manifest.Chunks))
+	log.Infof("backupVolume: %s", message)
+	ns.claimEvent(pvc, v1.EventTypeNormal, BackupSucceededReason, message)
+	return nil
+}
+
+// isVolumeRestoring checks whether a restore of the volume is incomplete
+func isVolumeRestoring(volumeID string) bool {
+	return loadNodeState(restoreStateKind, volumeID, &restoreState{}) == nil
+}
+
+// restoreVolume populates the new volume from the backup its claim
+// requests in background, the volume is not published until the restore
+// completes. It returns whether the volume was restored.
+func (ns *nodeServer) restoreVolume(volumeID, devicePath string) (bool, error) {
+	state := &restoreState{VolumeID: volumeID}
+	if err := loadNodeState(restoreStateKind, volumeID, state); err != nil {
+		pvc := ns.getVolumeClaim(volumeID)
+		if pvc == nil || pvc.Annotations[RestoreFromAnnotation] == "" {
+			return false, nil
+		}
+		state.BackupID = pvc.Annotations[RestoreFromAnnotation]
+		if err := saveNodeState(restoreStateKind, volumeID, state); err != nil {
+			return false, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if state.Done {
+		return true, nil
+	}
+	ns.startRestore(state, devicePath)
+	message := fmt.Sprintf("volume %s is being restored from backup %s at chunk %d", volumeID, state.BackupID, state.Chunk)
+	if state.Error != "" {
+		message = fmt.Sprintf("%s, the last attempt failed: %s", message, state.Error)
+	}
+	return false, status.Error(codes.Unavailable, message)
+}
+
+// finishRestore forgets the restore once the restored volume is published
+func finishRestore(volumeID string) error {
+	return removeNodeState(restoreStateKind, volumeID)
+}
+
+// startRestore runs the restore unless it is running, it resumes from the
+// recorded chunk and the next publish retries it after a failure.
+func (ns *nodeServer) startRestore(state *restoreState, devicePath string) {
+	restoringVolumesMutex.Lock()
+	defer restoringVolumesMutex.Unlock()
+	if restoringVolumes[state.VolumeID] {
+		return
+	}
+	restoringVolumes[state.VolumeID] = true
+
+	go func() {
+		defer func() {
+			restoringVolumesMutex.Lock()
+			delete(restoringVolumes, state.VolumeID)
+			restoringVolumesMutex.Unlock()
+		}()
+		pvc := ns.getVolumeClaim(state.VolumeID)
+		if err := ns.restoreBackup(context.Background(), pvc, state, devicePath); err != nil {
+			message := fmt.Sprintf("restore volume %s from backup %s failed: %s", state.VolumeID, state.BackupID, err.Error())
+			log.Errorf("restoreVolume: %s", message)
+			ns.claimEvent(pvc, v1.EventTypeWarning, RestoreFailedReason, message)
+			state.Error = err.Error()
+		} else {
+			message := fmt.Sprintf("volume %s restored from backup %s", state.VolumeID, state.BackupID)
+			log.Infof("restoreVolume: %s", message)
+			ns.claimEvent(pvc, v1.EventTypeNormal, RestoreSucceededReason, message)
+			state.Done, state.Error = true, ""
+		}
+		if err := saveNodeState(restoreStateKind, state.VolumeID, state); err != nil {
+			log.Errorf("restoreVolume: save restore state of %s with error: %s", state.VolumeID, err.Error())
+		}
+	}()
+}
+
+func (ns *nodeServer) restoreBackup(ctx context.Context, pvc *v1.PersistentVolumeClaim, state *restoreState, devicePath string) error {
+	if pvc == nil {
+		return fmt.Errorf("claim of volume %s not found", state.VolumeID)
+	}
+	store, err := newS3Client()
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return fmt.Errorf("%s is not set", BackupS3Endpoint)
+	}
+	manifest, err := loadManifest(ctx, store, state.BackupID)
+	if err != nil {
+		return err
+	}
+	if err := checkRestoreSource(manifest, pvc); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if manifest.Size > size {
+		return fmt.Errorf("backup of %d bytes does not fit the volume of %d bytes", manifest.Size, size)
+	}
+	// the progress is recorded once the chunks before it are on disk
+	progress := func(next int) error {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		state.Chunk = next
+		return saveNodeState(restoreStateKind, state.VolumeID, state)
+	}
+	if err := restoreDevice(ctx, store, manifest, f, state.Chunk, progress); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// growFilesystem expands the mounted filesystem to the size of the device
+func (ns *nodeServer) growFilesystem(ctx context.Context, devicePath, targetPath string) error {
+	resizer := resizefs.NewResizeFs(&k8smount.SafeFormatAndMount{Interface: ns.k8smounter, Exec: contextExec{Interface: utilexec.New(), ctx: ctx}})
+	if _, err := resizer.Resize(devicePath, targetPath); err != nil {
+		return fmt.Errorf("resize filesystem of %s: %v", devicePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	assert := assert.New(t)
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+
+	// three random chunks, a zero chunk and a partial chunk
+	size := int64(4*backupChunkSize + 1000)
+	volume := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(volume[:3*backupChunkSize])
+	copy(volume[4*backupChunkSize:], bytes.Repeat([]byte("tail"), 250))
+
+	full := &backupManifest{ID: "lvm-1-1", VolumeID: "lvm-1", Size: size}
+	uploaded, err := backupDevice(ctx, store, bytes.NewReader(volume), full, nil)
+	assert.Nil(err)
+	assert.Equal(4, uploaded)
+	assert.Equal(5, len(full.Chunks))
+	assert.Equal("", full.Chunks[3])
+	assert.Equal(5, fake.puts)
+
+	// only the changed chunk is uploaded again
+	volume[10] ^= 0xff
+	incremental := &backupManifest{ID: "lvm-1-2", VolumeID: "lvm-1", Size: size, Parent: full.ID}
+	parent, err := loadManifest(ctx, store, full.ID)
+	assert.Nil(err)
+	uploaded, err = backupDevice(ctx, store, bytes.NewReader(volume), incremental, parent)
+	assert.Nil(err)
+	assert.Equal(1, uploaded)
+	assert.Equal(full.Chunks[1:], incremental.Chunks[1:])
+
+	// restore into a bigger device with stale data
+	device := filepath.Join(t.TempDir(), "device")
+	assert.Nil(os.WriteFile(device, bytes.Repeat([]byte{0x5a}, int(size)+backupChunkSize), 0644))
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	assert.Nil(err)
+	manifest, err := loadManifest(ctx, store, incremental.ID)
+	assert.Nil(err)
+	assert.Nil(restoreDevice(ctx, store, manifest, f, 0, nil))
+	assert.Nil(f.Close())
+	restored, err := os.ReadFile(device)
+	assert.Nil(err)
+	assert.Equal(volume, restored[:size])
+
+	// an interrupted restore resumes from the recorded chunk
+	assert.Nil(os.WriteFile(device, bytes.Repeat([]byte{0x5a}, int(size)), 0644))
+	f, err = os.OpenFile(device, os.O_WRONLY, 0)
+	assert.Nil(err)
+	assert.Nil(restoreDevice(ctx, store, manifest, f, 2, nil))
+	assert.Nil(f.Close())
+	restored, err = os.ReadFile(device)
+	assert.Nil(err)
+	assert.Equal(bytes.Repeat([]byte{0x5a}, 2*backupChunkSize), restored[:2*backupChunkSize])
+	assert.Equal(volume[2*backupChunkSize:], restored[2*backupChunkSize:])
+
+	// corrupted chunks are detected
+	for key := range fake.objects {
+		if filepath.Base(key) == full.Chunks[2] {
+			fake.objects[key], _ = compressChunk([]byte("corrupted"))
+		}
+	}
+	f, _ = os.OpenFile(device, os.O_WRONLY, 0)
+	defer f.Close()
+	assert.NotNil(restoreDevice(ctx, store, manifest, f, 0, nil))
+
+	_, err = loadManifest(ctx, store, "lvm-1-3")
+	assert.NotNil(err)
+}
+
+func TestCheckRestoreSource(t *testing.T) {
+	assert := assert.New(t)
+	pvc := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-restored", Namespace: "team-a"}}
+	assert.Nil(checkRestoreSource(&backupManifest{ID: "lvm-1-1", Namespace: "team-a", Claim: "data"}, pvc))
+	assert.NotNil(checkRestoreSource(&backupManifest{ID: "lvm-1-1", Namespace: "team-b", Claim: "data"}, pvc))
+	assert.NotNil(checkRestoreSource(&backupManifest{ID: "lvm-1-1"}, pvc))
+}
+
+func TestBackupDue(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2022, 10, 18, 2, 0, 0, 0, time.UTC)
+	pvc := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	due, err := backupDue(pvc, now)
+	assert.Nil(err)
+	assert.False(due)
+
+	pvc.Annotations[BackupIntervalAnnotation] = "nightly"
+	_, err = backupDue(pvc, now)
+	assert.NotNil(err)
+
+	pvc.Annotations[BackupIntervalAnnotation] = "24h"
+	due, _ = backupDue(pvc, now)
+	assert.True(due)
+	pvc.Annotations[LastBackupTimeAnnotation] = "2022-10-17T03:00:00Z"
+	due, _ = backupDue(pvc, now)
+	assert.False(due)
+	pvc.Annotations[LastBackupTimeAnnotation] = "2022-10-17T02:00:00Z"
+	due, _ = backupDue(pvc, now)
+	assert.True(due)
+
+	assert.Equal("lvm-1-20221018020000", newBackupID("lvm-1", now))
+}
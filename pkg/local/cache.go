@@ -0,0 +1,403 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// CacheVGTag is the storageclass parameter of the fast vg holding the
+	// cache of the volume, e.g. a vg on an nvme disk. lvm only caches a
+	// volume with a cache pool of the same vg, the cache is a dm-cache
+	// device over the volume instead, which lvm does not know about.
+	CacheVGTag = "cacheVG"
+	// CacheModeTag is the storageclass parameter of the cache mode
+	CacheModeTag = "cacheMode"
+	// CacheSizeTag is the storageclass parameter of the cache size, 10% of the volume by default
+	CacheSizeTag = "cacheSize"
+	// CacheModeWritethrough writes to the cache and the origin
+	CacheModeWritethrough = "writethrough"
+	// CacheModeWriteback writes to the cache and flushes to the origin
+	// later, refused as the origin outside of the driver would be stale and
+	// the dirty blocks lost with the dm-cache table
+	CacheModeWriteback = "writeback"
+
+	// cacheDataSuffix is the name suffix of the cache data volume in the cache vg
+	cacheDataSuffix = "_cdata"
+	// cacheMetaSuffix is the name suffix of the cache metadata volume in the cache vg
+	cacheMetaSuffix = "_cmeta"
+	// cachedDeviceSuffix is the name suffix of the dm-cache device of the volume
+	cachedDeviceSuffix = "_cached"
+	// cacheBlockSectors is the dm-cache block size, 64KiB
+	cacheBlockSectors = 128
+	// cachePolicy is the dm-cache policy while serving the volume
+	cachePolicy = "smq"
+	// cacheConditionSource is the volume condition source of cache statistics
+	cacheConditionSource = "cache"
+	// cacheMonitorInterval is the interval to collect cache statistics
+	cacheMonitorInterval = time.Minute
+	// minCacheSize is the minimum size of a cache volume
+	minCacheSize = 32 * 1024 * 1024
+	// minCacheMetadataSize is the minimum size of a cache metadata volume
+	minCacheMetadataSize = 8 * 1024 * 1024
+)
+
+// cacheStats is the dm-cache statistics of a cached volume
+type cacheStats struct {
+	Name        string
+	ReadHits    int64
+	ReadMisses  int64
+	WriteHits   int64
+	WriteMisses int64
+}
+
+// validateCache checks the cache storageclass parameters
+func validateCache(parameters map[string]string) error {
+	cacheVG := parameters[CacheVGTag]
+	switch mode := parameters[CacheModeTag]; mode {
+	case "", CacheModeWritethrough:
+	case CacheModeWriteback:
+		return fmt.Errorf("%s %s is not supported, lvm does not know the cache on %s and its dirty blocks would be lost with the cache device", CacheModeTag, mode, CacheVGTag)
+	default:
+		return fmt.Errorf("unknown %s %q, supported: %s", CacheModeTag, mode, CacheModeWritethrough)
+	}
+	if cacheVG == "" {
+		if parameters[CacheModeTag] != "" || parameters[CacheSizeTag] != "" {
+			return fmt.Errorf("%s is required with %s or %s", CacheVGTag, CacheModeTag, CacheSizeTag)
+		}
+		return nil
+	}
+	if !lvmNamePattern.MatchString(cacheVG) {
+		return fmt.Errorf("%s %q is not a valid vg name", CacheVGTag, cacheVG)
+	}
+	if value := parameters[CacheSizeTag]; value != "" {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return fmt.Errorf("%s %q is invalid: %v", CacheSizeTag, value, err)
+		}
+	}
+	return nil
+}
+
+// cacheSize returns the cache volume size in bytes for a volume of sizeBytes
+func cacheSize(parameters map[string]string, sizeBytes int64) int64 {
+	size := sizeBytes / 10
+	if value := parameters[CacheSizeTag]; value != "" {
+		if quantity, err := resource.ParseQuantity(value); err == nil {
+			size = quantity.Value()
+		}
+	}
+	if size < minCacheSize {
+		size = minCacheSize
+	}
+	return roundUpMiB(size)
+}
+
+// cacheMetadataSize returns the metadata volume size of a cache of dataSize
+// bytes, 4MiB and 16 bytes per cache block
+func cacheMetadataSize(dataSize int64) int64 {
+	size := 4*1024*1024 + dataSize/(cacheBlockSectors*512)*16
+	if size < minCacheMetadataSize {
+		size = minCacheMetadataSize
+	}
+	return roundUpMiB(size)
+}
+
+// cacheSpace returns the cache vg space the cache of a volume of sizeBytes takes
+func cacheSpace(parameters map[string]string, sizeBytes int64) int64 {
+	dataSize := cacheSize(parameters, sizeBytes)
+	return dataSize + cacheMetadataSize(dataSize)
+}
+
+// roundUpMiB rounds the size up to MiB
+func roundUpMiB(size int64) int64 {
+	return (size + 1024*1024 - 1) / (1024 * 1024) * (1024 * 1024)
+}
+
+// cachedDevicePath returns the path of the dm-cache device of the volume
+func cachedDevicePath(volumeID string) string {
+	return "/dev/mapper/" + volumeID + cachedDeviceSuffix
+}
+
+// cacheTable returns the writethrough dm-cache table of the volume with
+// its cache volumes on the cache vg, the origin is always up to date.
+func cacheTable(cacheVG, vgName, volumeID string, originSectors int64) string {
+	return fmt.Sprintf("0 %d cache /dev/%s/%s%s /dev/%s/%s%s /dev/%s/%s %d 1 %s %s 0", originSectors,
+		cacheVG, volumeID, cacheMetaSuffix, cacheVG, volumeID, cacheDataSuffix, vgName, volumeID, cacheBlockSectors, CacheModeWritethrough, cachePolicy)
+}
+
+// tableWithLength returns the dm-cache table with the origin length replaced
+func tableWithLength(table string, sectors int64) (string, error) {
+	fields := strings.Fields(table)
+	if len(fields) < 8 || fields[2] != "cache" {
+		return "", fmt.Errorf("not a dm-cache table: %q", table)
+	}
+	fields[1] = strconv.FormatInt(sectors, 10)
+	return strings.Join(fields, " "), nil
+}
+
+// deviceSectors returns the size of the block device in 512 bytes sectors
+func deviceSectors(ctx context.Context, devicePath string) (int64, error) {
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s blockdev --getsz %s", NsenterCmd, devicePath))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// cacheDeviceTable returns the table of the dm-cache device of the volume,
+// an error if the volume has no cache device
+func cacheDeviceTable(volumeID string) (string, error) {
+	out, err := utils.Run(fmt.Sprintf("%s dmsetup table %s%s", NsenterCmd, volumeID, cachedDeviceSuffix))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// reloadCacheDevice loads the table in the dm-cache device of the volume
+func reloadCacheDevice(ctx context.Context, volumeID, table string) error {
+	name := volumeID + cachedDeviceSuffix
+	if _, err := utils.RunContext(ctx, fmt.Sprintf("%s dmsetup suspend %s", NsenterCmd, name)); err != nil {
+		return err
+	}
+	_, err := utils.RunContext(ctx, fmt.Sprintf("%s dmsetup reload %s --table '%s'", NsenterCmd, name, table))
+	// always resume, a suspended device blocks its io
+	if _, resumeErr := utils.Run(fmt.Sprintf("%s dmsetup resume %s", NsenterCmd, name)); resumeErr != nil && err == nil {
+		err = resumeErr
+	}
+	return err
+}
+
+// activateCache serves the volume through a dm-cache device with its cache
+// volumes on the cache vg, it creates the cache of a new volume and loads
+// the device again after a reboot. It returns the path of the device.
+func activateCache(ctx context.Context, vgName, volumeID string, parameters map[string]string) (string, error) {
+	if _, err := cacheDeviceTable(volumeID); err == nil {
+		return cachedDevicePath(volumeID), nil
+	}
+	cacheVG := parameters[CacheVGTag]
+	originSectors, err := deviceSectors(ctx, fmt.Sprintf("/dev/%s/%s", vgName, volumeID))
+	if err != nil {
+		return "", err
+	}
+	dataPath := fmt.Sprintf("%s/%s%s", cacheVG, volumeID, cacheDataSuffix)
+	metaPath := fmt.Sprintf("%s/%s%s", cacheVG, volumeID, cacheMetaSuffix)
+	_, dataErr := utils.Run(fmt.Sprintf("%s lvs %s", NsenterCmd, dataPath))
+	_, metaErr := utils.Run(fmt.Sprintf("%s lvs %s", NsenterCmd, metaPath))
+	if dataErr != nil || metaErr != nil {
+		// a new cache, the zeroed metadata is an empty clean cache; no
+		// driver tag, the cache volumes are removed with the volume
+		if err := removeCacheVolumes(volumeID); err != nil {
+			return "", err
+		}
+		dataSize := cacheSize(parameters, originSectors*512)
+		for _, volume := range []struct {
+			name string
+			size int64
+		}{{volumeID + cacheDataSuffix, dataSize}, {volumeID + cacheMetaSuffix, cacheMetadataSize(dataSize)}} {
+			cmd := fmt.Sprintf("%s lvcreate -y -Z y -n %s -L %db %s", NsenterCmd, volume.name, volume.size, cacheVG)
+			if _, err := utils.RunContext(ctx, cmd); err != nil {
+				if rmErr := removeCacheVolumes(volumeID); rmErr != nil {
+					log.Errorf("activateCache: remove cache volumes of %s with error: %s", volumeID, rmErr.Error())
+				}
+				return "", err
+			}
+		}
+		log.Infof("activateCache: create cache of %d bytes on vg %s for volume %s", dataSize, cacheVG, volumeID)
+	}
+	table := cacheTable(cacheVG, vgName, volumeID, originSectors)
+	name := volumeID + cachedDeviceSuffix
+	if _, err := utils.RunContext(ctx, fmt.Sprintf("%s dmsetup create %s --table '%s'", NsenterCmd, name, table)); err != nil {
+		return "", err
+	}
+	if _, err := utils.Run(fmt.Sprintf("%s dmsetup mknodes %s", NsenterCmd, name)); err != nil {
+		return "", err
+	}
+	log.Infof("activateCache: serve volume %s/%s through cache on vg %s", vgName, volumeID, cacheVG)
+	return cachedDevicePath(volumeID), nil
+}
+
+// resizeCache resizes the dm-cache device to its extended origin volume,
+// it returns whether the volume has a cache device.
+func resizeCache(ctx context.Context, vgName, volumeID string) (bool, error) {
+	table, err := cacheDeviceTable(volumeID)
+	if err != nil {
+		return false, nil
+	}
+	sectors, err := deviceSectors(ctx, fmt.Sprintf("/dev/%s/%s", vgName, volumeID))
+	if err != nil {
+		return true, err
+	}
+	if table, err = tableWithLength(table, sectors); err != nil {
+		return true, err
+	}
+	return true, reloadCacheDevice(ctx, volumeID, table)
+}
+
+// cacheDeviceOpenCount returns the open count of the dm-cache device of the
+// volume, an error if the volume has no cache device
+func cacheDeviceOpenCount(volumeID string) (int, error) {
+	out, err := utils.Run(fmt.Sprintf("%s dmsetup info -c --noheadings -o open %s%s", NsenterCmd, volumeID, cachedDeviceSuffix))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// volumeInUse checks whether the volume is opened, e.g. mounted, the cache
+// device of a cached volume always holds its origin open
+func volumeInUse(lv *logicalVolume) bool {
+	if !lv.IsOpen() {
+		return false
+	}
+	count, err := cacheDeviceOpenCount(lv.Name)
+	return err != nil || count > 0
+}
+
+// removeCache removes the dm-cache device and the cache volumes of the volume
+func removeCache(volumeID string) error {
+	if _, err := cacheDeviceTable(volumeID); err == nil {
+		log.Infof("removeCache: remove the cache of volume %s", volumeID)
+		if _, err := utils.Run(fmt.Sprintf("%s dmsetup remove %s%s", NsenterCmd, volumeID, cachedDeviceSuffix)); err != nil {
+			return err
+		}
+	}
+	return removeCacheVolumes(volumeID)
+}
+
+// removeCacheVolumes removes the cache volumes of the volume in any vg
+func removeCacheVolumes(volumeID string) error {
+	cmd := fmt.Sprintf("%s lvs --noheadings --separator '|' -o vg_name,lv_name -S 'lv_name=%s%s||lv_name=%s%s'", NsenterCmd, volumeID, cacheDataSuffix, volumeID, cacheMetaSuffix)
+	out, err := utils.Run(cmd)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 2 {
+			continue
+		}
+		if _, err := utils.Run(fmt.Sprintf("%s lvremove -f %s/%s", NsenterCmd, strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheDeviceStats returns the statistics of the dm-cache device of the volume
+func cacheDeviceStats(volumeID string) (cacheStats, error) {
+	out, err := utils.Run(fmt.Sprintf("%s dmsetup status %s%s", NsenterCmd, volumeID, cachedDeviceSuffix))
+	if err != nil {
+		return cacheStats{}, err
+	}
+	stats, ok := parseCacheStatus(volumeID, out)
+	if !ok {
+		return cacheStats{}, fmt.Errorf("invalid dm-cache status of %s: %q", volumeID, out)
+	}
+	return stats, nil
+}
+
+// parseCacheStatus parses the dm-cache status: 0 <length> cache <metadata
+// block size> <used>/<total metadata> <cache block size> <used>/<total
+// cache> <read hits> <read misses> <write hits> <write misses> ...
+func parseCacheStatus(volumeID, status string) (cacheStats, bool) {
+	fields := strings.Fields(status)
+	if len(fields) < 11 || fields[2] != "cache" {
+		return cacheStats{}, false
+	}
+	numbers := make([]int64, 4)
+	for i, index := range []int{7, 8, 9, 10} {
+		var err error
+		if numbers[i], err = strconv.ParseInt(fields[index], 10, 64); err != nil {
+			return cacheStats{}, false
+		}
+	}
+	return cacheStats{
+		Name:        volumeID,
+		ReadHits:    numbers[0],
+		ReadMisses:  numbers[1],
+		WriteHits:   numbers[2],
+		WriteMisses: numbers[3],
+	}, true
+}
+
+// parseCacheStats parses the output of dmsetup status --target cache, one
+// "<device>: <status>" line per dm-cache device
+func parseCacheStats(out string) []cacheStats {
+	stats := []cacheStats{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], cachedDeviceSuffix) {
+			continue
+		}
+		if volumeStats, ok := parseCacheStatus(strings.TrimSuffix(parts[0], cachedDeviceSuffix), parts[1]); ok {
+			stats = append(stats, volumeStats)
+		}
+	}
+	return stats
+}
+
+// hitRatio returns the hit percentage, 0 without any access
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) * 100 / float64(hits+misses)
+}
+
+// message describes the cache statistics for the volume condition
+func (stats cacheStats) message() string {
+	return fmt.Sprintf("read hit ratio %.1f%%, write hit ratio %.1f%%",
+		hitRatio(stats.ReadHits, stats.ReadMisses), hitRatio(stats.WriteHits, stats.WriteMisses))
+}
+
+// monitorCacheVolumes periodically reports the cache statistics of the
+// cached volumes in their volume condition and the hit ratio metrics.
+func (ns *nodeServer) monitorCacheVolumes() {
+	for {
+		if err := updateCacheStats(); err != nil {
+			log.Errorf("monitorCacheVolumes: %s", err.Error())
+		}
+		time.Sleep(cacheMonitorInterval)
+	}
+}
+
+func updateCacheStats() error {
+	out, err := utils.Run(fmt.Sprintf("%s dmsetup status --target cache", NsenterCmd))
+	if err != nil {
+		return fmt.Errorf("list cached volumes: %v", err)
+	}
+	stats := parseCacheStats(out)
+	for _, volumeStats := range stats {
+		setVolumeCondition(volumeStats.Name, cacheConditionSource, false, volumeStats.message())
+	}
+	lvs, err := listLogicalVolumes(localDriverTags())
+	if err != nil {
+		return fmt.Errorf("list lvm volumes: %v", err)
+	}
+	setCacheMetrics(stats, lvs)
+	return nil
+}
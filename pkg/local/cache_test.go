@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCache(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateCache(map[string]string{}))
+	assert.Nil(validateCache(map[string]string{CacheVGTag: "vg-nvme", CacheModeTag: CacheModeWritethrough, CacheSizeTag: "10Gi"}))
+	// lvm does not know the cache on another vg, writeback may lose data
+	assert.NotNil(validateCache(map[string]string{CacheVGTag: "vg-nvme", CacheModeTag: CacheModeWriteback}))
+	assert.NotNil(validateCache(map[string]string{CacheModeTag: CacheModeWritethrough}))
+	assert.NotNil(validateCache(map[string]string{CacheVGTag: "vg-nvme", CacheModeTag: "writearound"}))
+	assert.NotNil(validateCache(map[string]string{CacheVGTag: "vg-nvme; reboot"}))
+	assert.NotNil(validateCache(map[string]string{CacheVGTag: "vg-nvme", CacheSizeTag: "ten"}))
+}
+
+func TestCacheSize(t *testing.T) {
+	assert := assert.New(t)
+	gi := int64(1024 * 1024 * 1024)
+	assert.Equal(int64(1024*1024*1024/10+1024*1024-1)/(1024*1024)*(1024*1024), cacheSize(map[string]string{}, gi))
+	assert.Equal(2*gi, cacheSize(map[string]string{CacheSizeTag: "2Gi"}, 100*gi))
+	assert.Equal(int64(minCacheSize), cacheSize(map[string]string{}, 100*1024*1024))
+
+	assert.Equal(int64(minCacheMetadataSize), cacheMetadataSize(gi))
+	// 4MiB and 16 bytes per 64KiB block
+	assert.Equal(int64(4+16*16)*1024*1024, cacheMetadataSize(1024*gi))
+	assert.Equal(2*gi+int64(minCacheMetadataSize), cacheSpace(map[string]string{CacheSizeTag: "2Gi"}, 100*gi))
+}
+
+func TestCacheTable(t *testing.T) {
+	assert := assert.New(t)
+	table := cacheTable("vg-nvme", "vg-hdd", "pv-1", 2097152)
+	assert.Equal("0 2097152 cache /dev/vg-nvme/pv-1_cmeta /dev/vg-nvme/pv-1_cdata /dev/vg-hdd/pv-1 128 1 writethrough smq 0", table)
+
+	// dmsetup table shows the devices by number
+	loaded := "0 2097152 cache 253:3 253:2 253:1 128 1 writethrough smq 0"
+	resized, err := tableWithLength(loaded, 4194304)
+	assert.Nil(err)
+	assert.Equal("0 4194304 cache 253:3 253:2 253:1 128 1 writethrough smq 0", resized)
+	_, err = tableWithLength("0 2097152 linear 253:1 0", 4194304)
+	assert.NotNil(err)
+}
+
+func TestParseCache(t *testing.T) {
+	assert := assert.New(t)
+	status := "0 2097152 cache 8 27/2048 128 100/16384 90 10 30 10 0 100 0 1 writethrough 2 migration_threshold 2048 smq 0 rw -"
+	stats, ok := parseCacheStatus("pv-1", status)
+	assert.True(ok)
+	assert.Equal(int64(90), stats.ReadHits)
+	assert.Equal(int64(10), stats.WriteMisses)
+	_, ok = parseCacheStatus("pv-1", "0 2097152 linear")
+	assert.False(ok)
+
+	all := parseCacheStats("pv-1_cached: " + status + "\nvg-root: 0 2048 linear\n")
+	assert.Len(all, 1)
+	assert.Equal("pv-1", all[0].Name)
+	assert.Equal("read hit ratio 90.0%, write hit ratio 75.0%", all[0].message())
+	assert.Len(parseCacheStats("No devices found\n"), 0)
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// VGsAnnotation is the node annotation advertising the size and free space of the vgs
+	VGsAnnotation = "local.csi.ecloud.cmss.com/vgs"
+)
+
+// volumeGroup is the capacity of a vg advertised by a node
+type volumeGroup struct {
+	Name string   `json:"name"`
+	Size int64    `json:"size"`
+	Free int64    `json:"free"`
+	Tags []string `json:"tags,omitempty"`
+	// Volumes are the driver volumes in the vg, the controller releases
+	// the capacity reserved for a volume once it is reported here.
+	Volumes []string `json:"volumes,omitempty"`
+	// Pools are the storage pools the vg or thin pool belongs to
+	Pools []string `json:"pools,omitempty"`
+}
+
+// parseVolumeGroups parses the output of vgs -o vg_name,vg_size,vg_free,vg_tags
+func parseVolumeGroups(out string) []volumeGroup {
+	vgs := []volumeGroup{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		free, err := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		if err != nil {
+			continue
+		}
+		vg := volumeGroup{Name: strings.TrimSpace(fields[0]), Size: size, Free: free}
+		if len(fields) > 3 && strings.TrimSpace(fields[3]) != "" {
+			vg.Tags = strings.Split(strings.TrimSpace(fields[3]), ",")
+		}
+		vgs = append(vgs, vg)
+	}
+	return vgs
+}
+
+// listVolumeGroups returns the capacity and the driver volumes of the vgs of the node
+func listVolumeGroups() ([]volumeGroup, error) {
+	out, err := utils.Run(fmt.Sprintf("%s vgs --noheadings --units b --nosuffix --separator '|' -o vg_name,vg_size,vg_free,vg_tags", NsenterCmd))
+	if err != nil {
+		return nil, err
+	}
+	vgs := parseVolumeGroups(out)
+	out, err = utils.Run(fmt.Sprintf("%s lvs --noheadings --units b --nosuffix --separator '|' -o vg_name,lv_name,pool_lv,lv_size,data_percent %s", NsenterCmd, localDriverTags()))
+	if err != nil {
+		return nil, err
+	}
+	volumes := parseVGVolumes(out)
+	for i := range vgs {
+		vgs[i].Volumes = volumes[vgs[i].Name]
+	}
+	pools, _, err := nodeStoragePools()
+	if err != nil {
+		log.Errorf("listVolumeGroups: %s", err.Error())
+	}
+	vgs = applyStoragePools(vgs, pools, getThinPoolFree)
+	return holdWipeSpace(vgs, parseWipeSpace(out, overwritingVolumes())), nil
+}
+
+// overwritingVolumes returns the volumes waiting for a zero or shred wipe
+func overwritingVolumes() map[string]bool {
+	volumes := map[string]bool{}
+	names, err := listNodeStates(wipeStateKind)
+	if err != nil {
+		log.Errorf("overwritingVolumes: list wipe states with error: %s", err.Error())
+		return volumes
+	}
+	for _, name := range names {
+		state := &wipeState{}
+		if err := loadNodeState(wipeStateKind, name, state); err == nil && state.Device == "" && state.DeviceID == "" &&
+			(state.Policy == WipePolicyZero || state.Policy == WipePolicyShred) {
+			volumes[name] = true
+		}
+	}
+	return volumes
+}
+
+// parseWipeSpace parses the output of lvs -o vg_name,lv_name,pool_lv,
+// lv_size,data_percent to the space of every thin pool the wipe of the
+// volumes still allocates, overwriting a thin volume allocates all of it.
+func parseWipeSpace(out string, wiping map[string]bool) map[string]int64 {
+	held := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 5 || !wiping[strings.TrimSpace(fields[1])] || strings.TrimSpace(fields[2]) == "" {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(fields[3]), 10, 64)
+		if err != nil {
+			continue
+		}
+		dataPercent, _ := strconv.ParseFloat(strings.TrimSpace(fields[4]), 64)
+		member := fmt.Sprintf("%s/%s", strings.TrimSpace(fields[0]), strings.TrimSpace(fields[2]))
+		held[member] += int64(float64(size) * (100 - dataPercent) / 100)
+	}
+	return held
+}
+
+// holdWipeSpace counts the space the pending wipes allocate in the thin
+// pools as used, the extents of thick volumes are used until they are removed.
+func holdWipeSpace(vgs []volumeGroup, held map[string]int64) []volumeGroup {
+	for i := range vgs {
+		if space := held[vgs[i].Name]; space > 0 {
+			vgs[i].Free -= space
+			if vgs[i].Free < 0 {
+				vgs[i].Free = 0
+			}
+		}
+	}
+	return vgs
+}
+
+// parseVGVolumes parses the output of lvs -o vg_name,lv_name to the volumes of every vg
+func parseVGVolumes(out string) map[string][]string {
+	volumes := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 2 {
+			continue
+		}
+		vgName := strings.TrimSpace(fields[0])
+		volumes[vgName] = append(volumes[vgName], strings.TrimSpace(fields[1]))
+	}
+	return volumes
+}
+
+// advertiseCapacity periodically publishes the capacity of the vgs in the
+// node annotation, the controller reports it in GetCapacity.
+func (ns *nodeServer) advertiseCapacity() {
+	for {
+		if err := ns.refreshStoragePools(); err != nil {
+			log.Errorf("advertiseCapacity: get storage pools of the node with error: %s", err.Error())
+		}
+		if err := ns.updateCapacity(); err != nil {
+			log.Errorf("advertiseCapacity: update vg capacity with error: %s", err.Error())
+		}
+		if err := ns.updateVolumeMetrics(); err != nil {
+			log.Errorf("advertiseCapacity: update volume metrics with error: %s", err.Error())
+		}
+		time.Sleep(inventoryInterval)
+	}
+}
+
+func (ns *nodeServer) updateCapacity() error {
+	vgs, err := listVolumeGroups()
+	if err != nil {
+		return err
+	}
+	setVGMetrics(vgs)
+	data, err := json.Marshal(vgs)
+	if err != nil {
+		return err
+	}
+	failed, err := json.Marshal(reportedCreateFailures(time.Now()))
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{VGsAnnotation: string(data), FailedVolumesAnnotation: string(failed)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ns.client.CoreV1().Nodes().Patch(context.Background(), ns.nodeID, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// nodeCapacity returns the available and maximum volume size of the node
+// for the storageclass parameters.
+func nodeCapacity(node *v1.Node, parameters map[string]string) (int64, int64, error) {
+	if parameters[PvTypeTag] == DeviceType {
+		devices := []nodeDevice{}
+		if value := node.Annotations[DevicesAnnotation]; value != "" {
+			if err := json.Unmarshal([]byte(value), &devices); err != nil {
+				return 0, 0, err
+			}
+		}
+		var available, maximum int64
+		for _, device := range devices {
+			available += device.Size
+			if device.Size > maximum {
+				maximum = device.Size
+			}
+		}
+		return available, maximum, nil
+	}
+
+	vgs, err := nodeVGs(node)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the capacity reserved for volumes placed but not created is not free
+	vgs, err = matchVGs(reservedVGs(node.Name, vgs, nodeCreateFailures(node)), parameters)
+	if err != nil {
+		return 0, 0, err
+	}
+	// vdo volumes take the physical size divided by the ratio, never
+	// report more than the configured overcommit
+	ratio, err := parseVDORatio(parameters)
+	if err != nil {
+		return 0, 0, err
+	}
+	var available, maximum int64
+	for _, vg := range vgs {
+		free := vg.Free
+		if parameters[LvmTypeTag] == VDOType {
+			free = int64(float64(free) * ratio)
+		}
+		available += free
+		if free > maximum {
+			maximum = free
+		}
+	}
+	return available, maximum, nil
+}
+
+// GetCapacity reports the free space of the vg, or the free disks for
+// device volumes, on the node of the topology or on all nodes.
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	parameters := driverParameters(cs.driverName, req.GetParameters())
+	pvType := parameters[PvTypeTag]
+	if pvType == QuotaPathType {
+		return nil, status.Errorf(codes.InvalidArgument, "GetCapacity: capacity of pvType %s is not tracked", QuotaPathType)
+	}
+	if pvType != DeviceType && parameters[VgNameTag] == "" && parameters[VGSelectorTag] == "" && parameters[PoolTag] == "" {
+		return nil, status.Error(codes.InvalidArgument, "GetCapacity: vgName, vgSelector or pool is not provided")
+	}
+
+	nodes := []v1.Node{}
+	if nodeID := req.GetAccessibleTopology().GetSegments()[driverTopologyKey(cs.driverName)]; nodeID != "" {
+		node, err := cs.client.CoreV1().Nodes().Get(ctx, nodeID, metav1.GetOptions{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		nodes = append(nodes, *node)
+	} else {
+		nodeList, err := cs.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		nodes = nodeList.Items
+	}
+
+	var available, maximum int64
+	for i := range nodes {
+		nodeAvailable, nodeMaximum, err := nodeCapacity(&nodes[i], parameters)
+		if err != nil {
+			log.Errorf("GetCapacity: capacity of node %s with error: %s", nodes[i].Name, err.Error())
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		available += nodeAvailable
+		if nodeMaximum > maximum {
+			maximum = nodeMaximum
+		}
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: maximum},
+	}, nil
+}
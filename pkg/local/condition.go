@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// volumeCondition is the condition of a volume reported by one source, e.g. fsck
+type volumeCondition struct {
+	abnormal bool
+	message  string
+}
+
+var (
+	// volumeConditions map volumeID to the conditions reported by every source
+	volumeConditions = map[string]map[string]volumeCondition{}
+	// volumeConditionsMutex Mutex for volumeConditions map
+	volumeConditionsMutex sync.RWMutex
+)
+
+// setVolumeCondition records the condition of a volume reported by source
+func setVolumeCondition(volumeID, source string, abnormal bool, message string) {
+	volumeConditionsMutex.Lock()
+	defer volumeConditionsMutex.Unlock()
+	if _, ok := volumeConditions[volumeID]; !ok {
+		volumeConditions[volumeID] = map[string]volumeCondition{}
+	}
+	volumeConditions[volumeID][source] = volumeCondition{abnormal: abnormal, message: message}
+}
+
+// clearVolumeCondition removes all the conditions recorded for a volume
+func clearVolumeCondition(volumeID string) {
+	volumeConditionsMutex.Lock()
+	delete(volumeConditions, volumeID)
+	volumeConditionsMutex.Unlock()
+}
+
+// getVolumeCondition merges the conditions of a volume, the volume is
+// abnormal if any source reports it abnormal.
+func getVolumeCondition(volumeID string) *csi.VolumeCondition {
+	volumeConditionsMutex.RLock()
+	defer volumeConditionsMutex.RUnlock()
+
+	condition := &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	sources := []string{}
+	for source := range volumeConditions[volumeID] {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	messages := []string{}
+	for _, source := range sources {
+		value := volumeConditions[volumeID][source]
+		if value.abnormal {
+			condition.Abnormal = true
+		}
+		if value.message != "" {
+			messages = append(messages, source+": "+value.message)
+		}
+	}
+	if len(messages) > 0 {
+		condition.Message = strings.Join(messages, "; ")
+	}
+	return condition
+}
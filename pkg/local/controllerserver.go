@@ -18,21 +18,41 @@ package lvm
 
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/options"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	driverName string
+	client     kubernetes.Interface
 }
 
 // newControllerServer creates a controllerServer object
-func newControllerServer(d *csicommon.CSIDriver) *controllerServer {
+func newControllerServer(d *csicommon.CSIDriver, driverName string) *controllerServer {
+	cfg, err := clientcmd.BuildConfigFromFlags(options.MasterURL, options.Kubeconfig)
+	if err != nil {
+		log.Fatalf("Error building kubeconfig: %s", err.Error())
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		log.Fatalf("Error building kubernetes clientset: %s", err.Error())
+	}
+
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		driverName:              driverName,
+		client:                  kubeClient,
 	}
 }
 
@@ -43,7 +63,7 @@ func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.Co
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		log.Infof("invalid create volume req: %v", req)
+		requestLog(ctx).Infof("invalid create volume req: %s", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
 	if len(req.Name) == 0 {
@@ -52,18 +72,94 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.VolumeCapabilities == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
+	parameters := driverParameters(cs.driverName, req.GetParameters())
+	topologyKey := driverTopologyKey(cs.driverName)
+
+	if err := validateWipePolicy(parameters[WipePolicyTag]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateLvmType(parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateCache(parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateVGSelection(parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if parameters[PvTypeTag] == QuotaPathType {
+		if err := validateRootPath(parameters[RootPathTag]); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 
 	volumeID := req.GetName()
 	var response *csi.CreateVolumeResponse
 
 	// Get nodeID if pvc in topology mode.
-	nodeID := pickNodeID(req.GetAccessibilityRequirements())
+	nodeID := pickNodeID(req.GetAccessibilityRequirements(), topologyKey)
+
+	// device volumes own a whole disk of the node
+	if parameters[PvTypeTag] == DeviceType {
+		allocation, err := cs.allocateDevice(volumeID, nodeID, req.GetCapacityRange().GetRequiredBytes())
+		if err != nil {
+			log.Errorf("CreateVolume: allocate device for volume %s with error: %s", volumeID, err.Error())
+			return nil, err
+		}
+		volumeContext := map[string]string{}
+		for key, value := range parameters {
+			volumeContext[key] = value
+		}
+		volumeContext[DeviceIDTag] = allocation.device.ID
+		volumeContext[DevicePathTag] = allocation.device.Path
+		volumeContext[DeviceNodeTag] = allocation.nodeID
+		log.Infof("Success create Volume: %s, Size: %d, device: %s at %s on node %s", volumeID, allocation.device.Size, allocation.device.ID, allocation.device.Path, allocation.nodeID)
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: allocation.device.Size,
+				VolumeContext: volumeContext,
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: map[string]string{
+							topologyKey: allocation.nodeID,
+						},
+					},
+				},
+			},
+		}, nil
+	}
+
+	// the controller knows no free space of the quotapath root paths, so it
+	// can not choose their node for Immediate binding.
+	if parameters[PvTypeTag] == QuotaPathType && nodeID == "" && parameters[NodeAffinity] != "false" {
+		return nil, status.Errorf(codes.InvalidArgument, "pvType %s needs volumeBindingMode WaitForFirstConsumer or %s false", QuotaPathType, NodeAffinity)
+	}
+
+	// hold the capacity on the node until it creates the lvm volume, with
+	// Immediate binding the node is chosen here, unless nodeAffinity is
+	// false and the volume is created on the node of its first pod.
+	if parameters[PvTypeTag] != QuotaPathType {
+		if nodeID != "" {
+			if err := cs.reserveCapacity(volumeID, nodeID, parameters, req.GetCapacityRange().GetRequiredBytes()); err != nil {
+				log.Errorf("CreateVolume: reserve capacity for volume %s on node %s with error: %s", volumeID, nodeID, err.Error())
+				return nil, err
+			}
+		} else if parameters[NodeAffinity] != "false" {
+			var err error
+			if nodeID, err = cs.chooseNode(volumeID, req.GetAccessibilityRequirements(), parameters, req.GetCapacityRange().GetRequiredBytes()); err != nil {
+				log.Errorf("CreateVolume: choose node for volume %s with error: %s", volumeID, err.Error())
+				return nil, err
+			}
+		}
+	}
+
 	if nodeID == "" {
 		response = &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
 				VolumeId:      volumeID,
 				CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-				VolumeContext: req.GetParameters(),
+				VolumeContext: parameters,
 			},
 		}
 	} else {
@@ -71,11 +167,11 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			Volume: &csi.Volume{
 				VolumeId:      volumeID,
 				CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-				VolumeContext: req.GetParameters(),
+				VolumeContext: parameters,
 				AccessibleTopology: []*csi.Topology{
 					{
 						Segments: map[string]string{
-							TopologyNodeKey: nodeID,
+							topologyKey: nodeID,
 						},
 					},
 				},
@@ -89,18 +185,18 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 // pickNodeID selects node given topology requirement.
 // if not found, empty string is returned.
-func pickNodeID(requirement *csi.TopologyRequirement) string {
+func pickNodeID(requirement *csi.TopologyRequirement, topologyKey string) string {
 	if requirement == nil {
 		return ""
 	}
 	for _, topology := range requirement.GetPreferred() {
-		nodeID, exists := topology.GetSegments()[TopologyNodeKey]
+		nodeID, exists := topology.GetSegments()[topologyKey]
 		if exists {
 			return nodeID
 		}
 	}
 	for _, topology := range requirement.GetRequisite() {
-		nodeID, exists := topology.GetSegments()[TopologyNodeKey]
+		nodeID, exists := topology.GetSegments()[topologyKey]
 		if exists {
 			return nodeID
 		}
@@ -108,7 +204,11 @@ func pickNodeID(requirement *csi.TopologyRequirement) string {
 	return ""
 }
 
+// DeleteVolume is idempotent: the node plugin wipes the lvm volume according
+// to its wipe policy and removes it once the persistent volume is gone.
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	releaseCapacity(req.GetVolumeId())
+	releaseDeviceAllocation(req.GetVolumeId())
 	log.Infof("DeleteVolume: Successfully deleting volume: %s", req.GetVolumeId())
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -124,7 +224,17 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	log.Infof("ControllerExpandVolume::: %v", req)
+	requestLog(ctx).Infof("ControllerExpandVolume:: volume %s to %d bytes", req.GetVolumeId(), req.GetCapacityRange().GetRequiredBytes())
 	volSizeBytes := int64(req.GetCapacityRange().GetRequiredBytes())
+
+	// device volumes can not grow beyond their disk
+	pv, err := cs.client.CoreV1().PersistentVolumes().Get(ctx, req.GetVolumeId(), metav1.GetOptions{})
+	if err == nil && pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes[PvTypeTag] == DeviceType {
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		if volSizeBytes > capacity.Value() {
+			return nil, status.Errorf(codes.OutOfRange, "device volume %s can not be expanded beyond its device size %d", req.GetVolumeId(), capacity.Value())
+		}
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacity.Value(), NodeExpansionRequired: false}, nil
+	}
 	return &csi.ControllerExpandVolumeResponse{CapacityBytes: volSizeBytes, NodeExpansionRequired: true}, nil
 }
@@ -0,0 +1,573 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DeviceType is the pv type of volumes owning a whole raw disk
+	DeviceType = "device"
+	// DevicePathTag is the volume attribute of the kernel path of the allocated
+	// disk at allocation, kernel names change across reboots and hotplug
+	DevicePathTag = "devicePath"
+	// DeviceIDTag is the volume attribute of the stable identity of the
+	// allocated disk, its wwn or model and serial
+	DeviceIDTag = "deviceID"
+	// DeviceNodeTag is the volume attribute of the node owning the allocated disk
+	DeviceNodeTag = "deviceNode"
+	// DevicesAnnotation is the node annotation advertising the free raw disks
+	DevicesAnnotation = "local.csi.ecloud.cmss.com/devices"
+
+	// DevicePathPattern env, the regexp of the disk paths to advertise, unset disables device mode
+	DevicePathPattern = "DEVICE_PATH_PATTERN"
+	// DeviceModelPattern env, the regexp of the disk models to advertise
+	DeviceModelPattern = "DEVICE_MODEL_PATTERN"
+	// DeviceMinSize env, the minimum size of the disks to advertise, e.g. 100Gi
+	DeviceMinSize = "DEVICE_MIN_SIZE"
+
+	// deviceStateKind is the node state kind of allocated disks
+	deviceStateKind = "device"
+	// inventoryInterval is the interval to advertise the free disks
+	inventoryInterval = time.Minute
+)
+
+// nodeDevice is a free raw disk advertised by a node
+type nodeDevice struct {
+	ID    string `json:"id"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Model string `json:"model,omitempty"`
+}
+
+// deviceState records the disk owned by a volume on the node, Path is
+// the kernel path the disk last resolved to
+type deviceState struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	VolumeID string `json:"volumeID"`
+	Policy   string `json:"policy"`
+}
+
+// deviceFilter selects the disks a node advertises
+type deviceFilter struct {
+	path    *regexp.Regexp
+	model   *regexp.Regexp
+	minSize int64
+}
+
+// blockDevice is a line of lsblk output
+type blockDevice struct {
+	Name       string
+	ParentName string
+	Type       string
+	Size       int64
+	Model      string
+	FsType     string
+	MountPoint string
+	WWN        string
+	Serial     string
+}
+
+// newDeviceFilter builds the disk filter from env, nil when device mode is disabled
+func newDeviceFilter() (*deviceFilter, error) {
+	pathPattern := os.Getenv(DevicePathPattern)
+	if pathPattern == "" {
+		return nil, nil
+	}
+	filter := &deviceFilter{}
+	var err error
+	if filter.path, err = regexp.Compile(pathPattern); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", DevicePathPattern, pathPattern, err)
+	}
+	if modelPattern := os.Getenv(DeviceModelPattern); modelPattern != "" {
+		if filter.model, err = regexp.Compile(modelPattern); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", DeviceModelPattern, modelPattern, err)
+		}
+	}
+	if minSize := os.Getenv(DeviceMinSize); minSize != "" {
+		quantity, err := resource.ParseQuantity(minSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", DeviceMinSize, minSize, err)
+		}
+		filter.minSize = quantity.Value()
+	}
+	return filter, nil
+}
+
+// match checks whether the disk passes the filter
+func (f *deviceFilter) match(device nodeDevice) bool {
+	if !f.path.MatchString(device.Path) {
+		return false
+	}
+	if f.model != nil && !f.model.MatchString(device.Model) {
+		return false
+	}
+	return device.Size >= f.minSize
+}
+
+var lsblkPairPattern = regexp.MustCompile(`([A-Z:]+)="([^"]*)"`)
+
+// parseBlockDevices parses the output of lsblk -b -n -P -o KNAME,PKNAME,TYPE,SIZE,MODEL,FSTYPE,MOUNTPOINT,WWN,SERIAL
+func parseBlockDevices(out string) []blockDevice {
+	devices := []blockDevice{}
+	for _, line := range strings.Split(out, "\n") {
+		pairs := lsblkPairPattern.FindAllStringSubmatch(line, -1)
+		if len(pairs) == 0 {
+			continue
+		}
+		device := blockDevice{}
+		for _, pair := range pairs {
+			value := strings.TrimSpace(pair[2])
+			switch pair[1] {
+			case "KNAME":
+				device.Name = value
+			case "PKNAME":
+				device.ParentName = value
+			case "TYPE":
+				device.Type = value
+			case "SIZE":
+				device.Size, _ = strconv.ParseInt(value, 10, 64)
+			case "MODEL":
+				device.Model = value
+			case "FSTYPE":
+				device.FsType = value
+			case "MOUNTPOINT":
+				device.MountPoint = value
+			case "WWN":
+				device.WWN = value
+			case "SERIAL":
+				device.Serial = value
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// stableID returns the identity of the disk kept across reboots, the wwn
+// or else the model and serial like /dev/disk/by-id, empty if it has none.
+func (device blockDevice) stableID() string {
+	if device.WWN != "" {
+		return "wwn-" + device.WWN
+	}
+	if device.Serial != "" {
+		return strings.Join(strings.Fields("serial-"+device.Model+" "+device.Serial), "_")
+	}
+	return ""
+}
+
+// resolveDevice returns the kernel path of the whole disk with the stable
+// identity among blockDevices.
+func resolveDevice(deviceID string, blockDevices []blockDevice) (string, error) {
+	for _, device := range blockDevices {
+		if device.Type == "disk" && deviceID != "" && device.stableID() == deviceID {
+			return filepath.Join("/dev", device.Name), nil
+		}
+	}
+	return "", fmt.Errorf("device %s is not attached to the node", deviceID)
+}
+
+// devicePathByID returns the current kernel path of the disk with the stable identity
+func devicePathByID(deviceID string) (string, error) {
+	blockDevices, err := listBlockDevices()
+	if err != nil {
+		return "", err
+	}
+	return resolveDevice(deviceID, blockDevices)
+}
+
+// freeDevices returns the disks without partitions, holders, filesystem or
+// mount which pass the filter and are not claimed by a volume, the disks
+// without a stable identity are never advertised.
+func freeDevices(blockDevices []blockDevice, filter *deviceFilter, claimed map[string]bool) []nodeDevice {
+	hasChildren := map[string]bool{}
+	for _, device := range blockDevices {
+		if device.ParentName != "" {
+			hasChildren[device.ParentName] = true
+		}
+	}
+	devices := []nodeDevice{}
+	for _, device := range blockDevices {
+		if device.Type != "disk" || hasChildren[device.Name] || device.FsType != "" || device.MountPoint != "" {
+			continue
+		}
+		free := nodeDevice{ID: device.stableID(), Path: filepath.Join("/dev", device.Name), Size: device.Size, Model: device.Model}
+		if free.ID == "" || claimed[free.ID] || !filter.match(free) {
+			continue
+		}
+		devices = append(devices, free)
+	}
+	return devices
+}
+
+// advertiseDevices periodically publishes the free disks of the node in
+// the node annotation, the controller allocates disks from it.
+func (ns *nodeServer) advertiseDevices() {
+	filter, err := newDeviceFilter()
+	if err != nil {
+		log.Errorf("advertiseDevices: %s", err.Error())
+		return
+	}
+	if filter == nil {
+		log.Infof("advertiseDevices: %s is not set, device mode is disabled", DevicePathPattern)
+		return
+	}
+	for {
+		if err := ns.updateDeviceInventory(filter); err != nil {
+			log.Errorf("advertiseDevices: update device inventory with error: %s", err.Error())
+		}
+		time.Sleep(inventoryInterval)
+	}
+}
+
+// listBlockDevices returns the block devices of the node
+func listBlockDevices() ([]blockDevice, error) {
+	out, err := utils.Run(fmt.Sprintf("%s lsblk -b -n -P -o KNAME,PKNAME,TYPE,SIZE,MODEL,FSTYPE,MOUNTPOINT,WWN,SERIAL", NsenterCmd))
+	if err != nil {
+		return nil, err
+	}
+	return parseBlockDevices(out), nil
+}
+
+func (ns *nodeServer) updateDeviceInventory(filter *deviceFilter) error {
+	blockDevices, err := listBlockDevices()
+	if err != nil {
+		return err
+	}
+	claimed, err := claimedDevices()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(freeDevices(blockDevices, filter, claimed))
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{DevicesAnnotation: string(data)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ns.client.CoreV1().Nodes().Patch(context.Background(), ns.nodeID, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// claimedDevices returns the identities of the disks owned by volumes or being wiped
+func claimedDevices() (map[string]bool, error) {
+	claimed := map[string]bool{}
+	names, err := listNodeStates(deviceStateKind)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		state := &deviceState{}
+		if err := loadNodeState(deviceStateKind, name, state); err == nil {
+			claimed[state.ID] = true
+		}
+	}
+	names, err = listNodeStates(wipeStateKind)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		state := &wipeState{}
+		if err := loadNodeState(wipeStateKind, name, state); err == nil && state.DeviceID != "" {
+			claimed[state.DeviceID] = true
+		}
+	}
+	return claimed, nil
+}
+
+// claimDevice records the disk with the stable identity as owned by the
+// volume with the wipe policy on delete and returns its current kernel
+// path. A new claim must be a free disk of the node inventory, that is among
+// blockDevices a whole disk passing the device filter.
+func claimDevice(volumeID, deviceID, policy string, blockDevices []blockDevice) (string, error) {
+	deviceClaimMutex.Lock()
+	defer deviceClaimMutex.Unlock()
+
+	devicePath, err := resolveDevice(deviceID, blockDevices)
+	if err != nil {
+		return "", err
+	}
+	state := &deviceState{}
+	if err := loadNodeState(deviceStateKind, volumeID, state); err == nil {
+		if state.ID != deviceID {
+			return "", fmt.Errorf("volume %s owns device %s, not %s", volumeID, state.ID, deviceID)
+		}
+		if state.Path != devicePath {
+			log.Infof("claimDevice: device %s of volume %s moved from %s to %s", deviceID, volumeID, state.Path, devicePath)
+			state.Path = devicePath
+			if err := saveNodeState(deviceStateKind, volumeID, state); err != nil {
+				return "", err
+			}
+		}
+		return devicePath, nil
+	}
+	if isVolumeWiping(volumeID) {
+		return "", fmt.Errorf("device %s of volume %s is being wiped", deviceID, volumeID)
+	}
+	claimed, err := claimedDevices()
+	if err != nil {
+		return "", err
+	}
+	if claimed[deviceID] {
+		return "", fmt.Errorf("device %s is owned by another volume", deviceID)
+	}
+	filter, err := newDeviceFilter()
+	if err != nil {
+		return "", err
+	}
+	if filter == nil {
+		return "", fmt.Errorf("%s is not set, device mode is disabled", DevicePathPattern)
+	}
+	inventory := false
+	for _, device := range freeDevices(blockDevices, filter, claimed) {
+		inventory = inventory || device.ID == deviceID
+	}
+	if !inventory {
+		return "", fmt.Errorf("device %s is not a free disk of the node inventory", deviceID)
+	}
+	if policy == "" {
+		policy = WipePolicyNone
+	}
+	return devicePath, saveNodeState(deviceStateKind, volumeID, &deviceState{ID: deviceID, Path: devicePath, VolumeID: volumeID, Policy: policy})
+}
+
+// deviceClaimMutex serializes disk claims on the node
+var deviceClaimMutex sync.Mutex
+
+// reclaimDevices wipes and releases the disks whose persistent volume is deleted
+func (ns *nodeServer) reclaimDevices() {
+	names, err := listNodeStates(deviceStateKind)
+	if err != nil {
+		log.Errorf("reclaimVolumes: list device states with error: %s", err.Error())
+		return
+	}
+	for _, name := range names {
+		state := &deviceState{}
+		if err := loadNodeState(deviceStateKind, name, state); err != nil || isVolumeWiping(name) {
+			continue
+		}
+		_, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		if err == nil || !apierrors.IsNotFound(err) {
+			continue
+		}
+		devicePath, err := devicePathByID(state.ID)
+		if err != nil {
+			log.Errorf("reclaimVolumes: persistent volume %s is deleted, resolve its device with error: %s", name, err.Error())
+			continue
+		}
+		if ns.isDeviceMounted(devicePath) {
+			log.Warnf("reclaimVolumes: persistent volume %s is deleted but device %s is still mounted", name, devicePath)
+			continue
+		}
+		log.Infof("reclaimVolumes: persistent volume %s is deleted, reclaim device %s at %s", name, state.ID, devicePath)
+		if err := ns.releaseDevice(name, state.ID, devicePath, state.Policy); err != nil {
+			log.Errorf("reclaimVolumes: release device %s with error: %s", devicePath, err.Error())
+		}
+	}
+}
+
+// releaseDevice wipes the disk with the wipe policy in background, the
+// disk is advertised again once the wipe completes.
+func (ns *nodeServer) releaseDevice(volumeID, deviceID, devicePath, policy string) error {
+	sizeByte, err := getBlockDeviceSize(devicePath)
+	if err != nil {
+		return err
+	}
+	state := &wipeState{
+		LVName:    volumeID,
+		Device:    devicePath,
+		DeviceID:  deviceID,
+		Policy:    policy,
+		Size:      sizeByte,
+		StartedAt: time.Now(),
+	}
+	if err := saveNodeState(wipeStateKind, volumeID, state); err != nil {
+		return err
+	}
+	if err := removeNodeState(deviceStateKind, volumeID); err != nil {
+		return err
+	}
+	log.Infof("releaseDevice: wipe device %s of volume %s with wipe policy %s", devicePath, volumeID, policy)
+	ns.startWipe(state)
+	return nil
+}
+
+// getBlockDeviceSize returns the size of the block device in bytes
+func getBlockDeviceSize(devicePath string) (int64, error) {
+	out, err := utils.Run(fmt.Sprintf("%s blockdev --getsize64 %s", NsenterCmd, devicePath))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// pickDevice returns the smallest disk holding size bytes whose identity is
+// not used, nil if none
+func pickDevice(devices []nodeDevice, used map[string]bool, size int64) *nodeDevice {
+	candidates := []nodeDevice{}
+	for _, device := range devices {
+		if device.Size >= size && device.ID != "" && !used[device.ID] {
+			candidates = append(candidates, device)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Size < candidates[j].Size })
+	return &candidates[0]
+}
+
+// deviceAllocation is a disk handed out by the controller which may not
+// have a persistent volume yet, held until it expires like the capacity
+// reservations.
+type deviceAllocation struct {
+	nodeID  string
+	device  nodeDevice
+	expires time.Time
+}
+
+var (
+	// pendingDevices map volumeID to the disks allocated by the controller
+	pendingDevices = map[string]deviceAllocation{}
+	// pendingDevicesMutex Mutex for pendingDevices map
+	pendingDevicesMutex sync.Mutex
+)
+
+// prunePendingDevices releases the expired disk allocations, whose volume
+// may never get a persistent volume, the caller holds pendingDevicesMutex.
+func prunePendingDevices(now time.Time) {
+	for volumeID, allocation := range pendingDevices {
+		if now.After(allocation.expires) {
+			log.Infof("prunePendingDevices: allocation of device %s on node %s to volume %s timed out", allocation.device.ID, allocation.nodeID, volumeID)
+			delete(pendingDevices, volumeID)
+		}
+	}
+}
+
+// allocateDevice picks a free disk of at least size bytes for the volume,
+// on nodeID if set or else on any node advertising disks.
+func (cs *controllerServer) allocateDevice(volumeID, nodeID string, size int64) (*deviceAllocation, error) {
+	pendingDevicesMutex.Lock()
+	defer pendingDevicesMutex.Unlock()
+	now := time.Now()
+	prunePendingDevices(now)
+	if allocation, ok := pendingDevices[volumeID]; ok && (nodeID == "" || allocation.nodeID == nodeID) {
+		return &allocation, nil
+	}
+
+	// disks owned by persistent volumes, the pending ones whose persistent
+	// volume is created are dropped.
+	used := map[string]bool{}
+	pvs, err := cs.client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil || !isLocalDriver(pv.Spec.CSI.Driver) {
+			continue
+		}
+		attributes := pv.Spec.CSI.VolumeAttributes
+		if attributes[PvTypeTag] == DeviceType {
+			used[attributes[DeviceNodeTag]+":"+attributes[DeviceIDTag]] = true
+		}
+		delete(pendingDevices, pv.Name)
+	}
+	for _, allocation := range pendingDevices {
+		used[allocation.nodeID+":"+allocation.device.ID] = true
+	}
+
+	nodeNames := []string{nodeID}
+	if nodeID == "" {
+		nodes, err := cs.client.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		nodeNames = []string{}
+		for _, node := range nodes.Items {
+			if node.Annotations[DevicesAnnotation] != "" {
+				nodeNames = append(nodeNames, node.Name)
+			}
+		}
+		sort.Strings(nodeNames)
+	}
+
+	var best *deviceAllocation
+	for _, nodeName := range nodeNames {
+		node, err := cs.client.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		devices := []nodeDevice{}
+		if value := node.Annotations[DevicesAnnotation]; value != "" {
+			if err := json.Unmarshal([]byte(value), &devices); err != nil {
+				log.Errorf("allocateDevice: parse devices of node %s with error: %s", nodeName, err.Error())
+				continue
+			}
+		}
+		nodeUsed := map[string]bool{}
+		for _, device := range devices {
+			nodeUsed[device.ID] = used[nodeName+":"+device.ID]
+		}
+		device := pickDevice(devices, nodeUsed, size)
+		if device != nil && (best == nil || device.Size < best.device.Size) {
+			best = &deviceAllocation{nodeID: nodeName, device: *device}
+		}
+	}
+	if best == nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "no free device of %d bytes found on node %q", size, nodeID)
+	}
+	best.expires = now.Add(reservationTimeout())
+	pendingDevices[volumeID] = *best
+	log.Infof("allocateDevice: allocate device %s at %s of %d bytes on node %s to volume %s", best.device.ID, best.device.Path, best.device.Size, best.nodeID, volumeID)
+	return best, nil
+}
+
+// releaseDeviceAllocation releases the disk allocated to the volume
+func releaseDeviceAllocation(volumeID string) {
+	pendingDevicesMutex.Lock()
+	defer pendingDevicesMutex.Unlock()
+	if allocation, ok := pendingDevices[volumeID]; ok {
+		log.Infof("releaseDeviceAllocation: release device %s on node %s of volume %s", allocation.device.ID, allocation.nodeID, volumeID)
+		delete(pendingDevices, volumeID)
+	}
+}
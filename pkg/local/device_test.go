@@ -0,0 +1,148 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeDevices(t *testing.T) {
+	assert := assert.New(t)
+	out := `KNAME="vda" PKNAME="" TYPE="disk" SIZE="42949672960" MODEL="" FSTYPE="" MOUNTPOINT="" WWN="" SERIAL=""
+KNAME="vda1" PKNAME="vda" TYPE="part" SIZE="42948624384" MODEL="" FSTYPE="ext4" MOUNTPOINT="/" WWN="" SERIAL=""
+KNAME="nvme0n1" PKNAME="" TYPE="disk" SIZE="1600321314816" MODEL="INTEL SSDPE2KE016T8" FSTYPE="" MOUNTPOINT="" WWN="eui.01000000010000005cd2e4b5e8e04f51" SERIAL="PHLN0123"
+KNAME="nvme1n1" PKNAME="" TYPE="disk" SIZE="800166076416" MODEL="INTEL SSDPE2KE800G8" FSTYPE="" MOUNTPOINT="" WWN="" SERIAL="PHLN4567"
+KNAME="nvme2n1" PKNAME="" TYPE="disk" SIZE="800166076416" MODEL="INTEL SSDPE2KE800G8" FSTYPE="LVM2_member" MOUNTPOINT="" WWN="" SERIAL="PHLN8901"
+KNAME="nvme3n1" PKNAME="" TYPE="disk" SIZE="800166076416" MODEL="INTEL SSDPE2KE800G8" FSTYPE="" MOUNTPOINT="" WWN="" SERIAL="PHLN2345"
+KNAME="nvme4n1" PKNAME="" TYPE="disk" SIZE="800166076416" MODEL="INTEL SSDPE2KE800G8" FSTYPE="" MOUNTPOINT="" WWN="" SERIAL=""
+`
+	blockDevices := parseBlockDevices(out)
+	assert.Len(blockDevices, 7)
+	assert.Equal("vda", blockDevices[1].ParentName)
+	assert.Equal(int64(1600321314816), blockDevices[2].Size)
+	assert.Equal("INTEL SSDPE2KE016T8", blockDevices[2].Model)
+	assert.Equal("wwn-eui.01000000010000005cd2e4b5e8e04f51", blockDevices[2].stableID())
+	assert.Equal("serial-INTEL_SSDPE2KE800G8_PHLN4567", blockDevices[3].stableID())
+
+	// nvme3n1 is claimed, nvme4n1 has no stable identity
+	filter := &deviceFilter{path: regexp.MustCompile(`^/dev/nvme`), minSize: 100 * 1024 * 1024 * 1024}
+	devices := freeDevices(blockDevices, filter, map[string]bool{"serial-INTEL_SSDPE2KE800G8_PHLN2345": true})
+	assert.Equal([]nodeDevice{
+		{ID: "wwn-eui.01000000010000005cd2e4b5e8e04f51", Path: "/dev/nvme0n1", Size: 1600321314816, Model: "INTEL SSDPE2KE016T8"},
+		{ID: "serial-INTEL_SSDPE2KE800G8_PHLN4567", Path: "/dev/nvme1n1", Size: 800166076416, Model: "INTEL SSDPE2KE800G8"},
+	}, devices)
+
+	filter.model = regexp.MustCompile(`800G`)
+	assert.Len(freeDevices(blockDevices, filter, map[string]bool{}), 2)
+
+	devicePath, err := resolveDevice("serial-INTEL_SSDPE2KE800G8_PHLN4567", blockDevices)
+	assert.Nil(err)
+	assert.Equal("/dev/nvme1n1", devicePath)
+	_, err = resolveDevice("serial-INTEL_SSDPE2KE800G8_PHLN0000", blockDevices)
+	assert.NotNil(err)
+	_, err = resolveDevice("", blockDevices)
+	assert.NotNil(err)
+}
+
+func TestPickDevice(t *testing.T) {
+	assert := assert.New(t)
+	devices := []nodeDevice{
+		{ID: "wwn-0", Path: "/dev/nvme0n1", Size: 1600},
+		{ID: "wwn-1", Path: "/dev/nvme1n1", Size: 800},
+		{ID: "wwn-2", Path: "/dev/nvme2n1", Size: 800},
+		{Path: "/dev/nvme3n1", Size: 600},
+	}
+	assert.Equal("/dev/nvme1n1", pickDevice(devices, map[string]bool{}, 500).Path)
+	assert.Equal("/dev/nvme2n1", pickDevice(devices, map[string]bool{"wwn-1": true}, 500).Path)
+	assert.Equal("/dev/nvme0n1", pickDevice(devices, map[string]bool{}, 1000).Path)
+	assert.Nil(pickDevice(devices, map[string]bool{}, 2000))
+}
+
+func TestClaimDevice(t *testing.T) {
+	assert := assert.New(t)
+	kubeletRootDir := utils.KubeletRootDir
+	utils.KubeletRootDir = t.TempDir()
+	defer func() { utils.KubeletRootDir = kubeletRootDir }()
+
+	blockDevices := parseBlockDevices(`KNAME="vda" PKNAME="" TYPE="disk" SIZE="42949672960" MODEL="" FSTYPE="" MOUNTPOINT="" WWN="wwn-vda" SERIAL=""
+KNAME="vda1" PKNAME="vda" TYPE="part" SIZE="42948624384" MODEL="" FSTYPE="ext4" MOUNTPOINT="/" WWN="wwn-vda" SERIAL=""
+KNAME="nvme0n1" PKNAME="" TYPE="disk" SIZE="1600321314816" MODEL="" FSTYPE="" MOUNTPOINT="" WWN="0x1" SERIAL=""
+KNAME="nvme1n1" PKNAME="" TYPE="disk" SIZE="800166076416" MODEL="" FSTYPE="" MOUNTPOINT="" WWN="0x2" SERIAL=""
+`)
+	// device mode is disabled without the path pattern
+	_, err := claimDevice("pv-1", "wwn-0x1", "", blockDevices)
+	assert.NotNil(err)
+	t.Setenv(DevicePathPattern, "^/dev/")
+
+	devicePath, err := claimDevice("pv-1", "wwn-0x1", "", blockDevices)
+	assert.Nil(err)
+	assert.Equal("/dev/nvme0n1", devicePath)
+	_, err = claimDevice("pv-1", "wwn-0x1", "", blockDevices)
+	assert.Nil(err)
+	_, err = claimDevice("pv-1", "wwn-0x2", "", blockDevices)
+	assert.NotNil(err)
+	_, err = claimDevice("pv-2", "wwn-0x1", "", blockDevices)
+	assert.NotNil(err)
+	_, err = claimDevice("pv-2", "wwn-wwn-vda", "", blockDevices)
+	assert.NotNil(err)
+	_, err = claimDevice("pv-2", "wwn-0x3", "", blockDevices)
+	assert.NotNil(err)
+
+	state := &deviceState{}
+	assert.Nil(loadNodeState(deviceStateKind, "pv-1", state))
+	assert.Equal(WipePolicyNone, state.Policy)
+
+	// after a reboot the disks come up with other kernel names
+	swapped := parseBlockDevices(`KNAME="nvme0n1" PKNAME="" TYPE="disk" SIZE="800166076416" MODEL="" FSTYPE="" MOUNTPOINT="" WWN="0x2" SERIAL=""
+KNAME="nvme1n1" PKNAME="" TYPE="disk" SIZE="1600321314816" MODEL="" FSTYPE="" MOUNTPOINT="" WWN="0x1" SERIAL=""
+`)
+	devicePath, err = claimDevice("pv-1", "wwn-0x1", "", swapped)
+	assert.Nil(err)
+	assert.Equal("/dev/nvme1n1", devicePath)
+	assert.Nil(loadNodeState(deviceStateKind, "pv-1", state))
+	assert.Equal("/dev/nvme1n1", state.Path)
+	// the disk is detached
+	_, err = claimDevice("pv-1", "wwn-0x1", "", blockDevices[:2])
+	assert.NotNil(err)
+
+	claimed, err := claimedDevices()
+	assert.Nil(err)
+	assert.Equal(map[string]bool{"wwn-0x1": true}, claimed)
+}
+
+func TestPendingDevices(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	pendingDevices = map[string]deviceAllocation{
+		"pv-1": {nodeID: "node1", device: nodeDevice{ID: "wwn-0x1"}, expires: now.Add(time.Minute)},
+		"pv-2": {nodeID: "node1", device: nodeDevice{ID: "wwn-0x2"}, expires: now.Add(-time.Second)},
+		"pv-3": {nodeID: "node2", device: nodeDevice{ID: "wwn-0x1"}, expires: now.Add(time.Minute)},
+	}
+	defer func() { pendingDevices = map[string]deviceAllocation{} }()
+	prunePendingDevices(now)
+	assert.Len(pendingDevices, 2)
+	releaseDeviceAllocation("pv-3")
+	releaseDeviceAllocation("pv-4")
+	_, ok := pendingDevices["pv-1"]
+	assert.True(ok)
+	assert.Len(pendingDevices, 1)
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultDriverName is the driver name when --driver is not set
+	DefaultDriverName = "local.csi.ecloud.cmss.com"
+	// EndpointOption is the driver option of the csi endpoint
+	EndpointOption = "endpoint"
+	// TopologyKeyOption is the driver option of the node topology key
+	TopologyKeyOption = "topologyKey"
+)
+
+// DriverOptions are the settings of one driver instance
+type DriverOptions struct {
+	Name     string
+	Endpoint string
+	// TopologyKey is the topology segment of the node name
+	TopologyKey string
+	// Parameters are the default storage class parameters of the volumes
+	Parameters map[string]string
+}
+
+var (
+	// drivers are the driver instances of the process by name
+	drivers = map[string]*DriverOptions{}
+	// nodeServers are the node servers of the driver instances by name
+	nodeServers = map[string]*nodeServer{}
+	// defaultParameters are the volume defaults of all the drivers
+	defaultParameters = map[string]string{}
+	driversMutex      sync.RWMutex
+)
+
+// ParseDriverOptions parses the comma separated --driver entries, each is
+// "name" or "name:key=value;key=value". The endpoint and topologyKey keys
+// set the csi endpoint, which defaults to the --endpoint flag, and the node
+// topology key, the other keys are default storage class parameters.
+func ParseDriverOptions(driverFlag, endpoint string) ([]*DriverOptions, error) {
+	options := []*DriverOptions{}
+	names := map[string]bool{}
+	endpoints := map[string]string{}
+	for _, entry := range strings.Split(driverFlag, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		opts := &DriverOptions{Name: strings.TrimSpace(parts[0]), Endpoint: endpoint, Parameters: map[string]string{}}
+		if opts.Name == "" {
+			return nil, fmt.Errorf("driver %q has no name", entry)
+		}
+		if names[opts.Name] {
+			return nil, fmt.Errorf("driver %s is set twice", opts.Name)
+		}
+		names[opts.Name] = true
+		if len(parts) == 2 {
+			for _, option := range strings.Split(parts[1], ";") {
+				if strings.TrimSpace(option) == "" {
+					continue
+				}
+				kv := strings.SplitN(option, "=", 2)
+				key := strings.TrimSpace(kv[0])
+				if len(kv) != 2 || key == "" {
+					return nil, fmt.Errorf("driver %s: invalid option %q, expect key=value", opts.Name, option)
+				}
+				value := strings.TrimSpace(kv[1])
+				switch key {
+				case EndpointOption:
+					opts.Endpoint = value
+				case TopologyKeyOption:
+					opts.TopologyKey = value
+				default:
+					opts.Parameters[key] = value
+				}
+			}
+		}
+		if opts.TopologyKey == "" {
+			opts.TopologyKey = defaultTopologyKey(opts.Name)
+		}
+		if other, ok := endpoints[opts.Endpoint]; ok {
+			return nil, fmt.Errorf("drivers %s and %s use the same endpoint %s", other, opts.Name, opts.Endpoint)
+		}
+		endpoints[opts.Endpoint] = opts.Name
+		options = append(options, opts)
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("no driver is set")
+	}
+	return options, nil
+}
+
+// defaultTopologyKey returns the node topology key of a driver without topologyKey option
+func defaultTopologyKey(name string) string {
+	return "topology." + name + "/hostname"
+}
+
+// registerDriver adds a driver instance of the process
+func registerDriver(opts *DriverOptions) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	drivers[opts.Name] = opts
+}
+
+// registerNodeServer adds the node server of a driver instance
+func registerNodeServer(ns *nodeServer) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	nodeServers[ns.driverName] = ns
+}
+
+// driverNodeServer returns the node server of the driver instance, nil if not local
+func driverNodeServer(name string) *nodeServer {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	return nodeServers[name]
+}
+
+// isLocalDriver returns whether name is a driver instance of the process,
+// or the default driver when no instance is registered.
+func isLocalDriver(name string) bool {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	if len(drivers) == 0 {
+		return name == DefaultDriverName
+	}
+	_, ok := drivers[name]
+	return ok
+}
+
+// localDriverNames returns the sorted names of the driver instances
+func localDriverNames() []string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	if len(drivers) == 0 {
+		return []string{DefaultDriverName}
+	}
+	names := []string{}
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// localDriverTags returns the lvs tag selection of the volumes of all the
+// driver instances, the vgs and devices of the node are shared by them.
+func localDriverTags() string {
+	return "@" + strings.Join(localDriverNames(), " @")
+}
+
+// driverTopologyKey returns the node topology key of the driver
+func driverTopologyKey(name string) string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	if opts, ok := drivers[name]; ok {
+		return opts.TopologyKey
+	}
+	return defaultTopologyKey(name)
+}
+
+// driverParameters returns the volume parameters with the defaults of the
+// driver, which take precedence over the defaults of all the drivers.
+func driverParameters(name string, parameters map[string]string) map[string]string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	defaults := []map[string]string{defaultParameters}
+	if opts, ok := drivers[name]; ok {
+		defaults = append(defaults, opts.Parameters)
+	}
+	merged := map[string]string{}
+	for _, values := range append(defaults, parameters) {
+		for key, value := range values {
+			merged[key] = value
+		}
+	}
+	if len(merged) == len(parameters) {
+		return parameters
+	}
+	return merged
+}
+
+// ValidateDefaultParameters checks the volume defaults of all the drivers
+func ValidateDefaultParameters(parameters map[string]string) error {
+	if err := validateVGSelection(parameters); err != nil {
+		return err
+	}
+	for _, tag := range ioLimitTags {
+		if value := parameters[tag]; value != "" && !strings.HasSuffix(tag, "BPS") {
+			if _, err := strconv.Atoi(value); err != nil {
+				return fmt.Errorf("%s %q is not a number", tag, value)
+			}
+		}
+	}
+	return nil
+}
+
+// SetDefaultParameters sets the volume defaults of all the drivers, used
+// by the volumes whose storage class and driver do not set them.
+func SetDefaultParameters(parameters map[string]string) error {
+	if err := ValidateDefaultParameters(parameters); err != nil {
+		return err
+	}
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	defaultParameters = map[string]string{}
+	for key, value := range parameters {
+		defaultParameters[key] = value
+	}
+	return nil
+}
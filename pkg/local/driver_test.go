@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDriverOptions(t *testing.T) {
+	assert := assert.New(t)
+	options, err := ParseDriverOptions(DefaultDriverName, "unix://tmp/csi.sock")
+	assert.Nil(err)
+	assert.Equal([]*DriverOptions{{Name: DefaultDriverName, Endpoint: "unix://tmp/csi.sock", TopologyKey: TopologyNodeKey, Parameters: map[string]string{}}}, options)
+
+	options, err = ParseDriverOptions("ssd.local.csi.ecloud.cmss.com:endpoint=unix://var/lib/kubelet/csi-plugins/ssd/csi.sock;vgName=vg-ssd, hdd.local.csi.ecloud.cmss.com:topologyKey=example.com/node; vgName=vg-hdd;fsType=xfs", "unix://tmp/csi.sock")
+	assert.Nil(err)
+	assert.Len(options, 2)
+	assert.Equal("ssd.local.csi.ecloud.cmss.com", options[0].Name)
+	assert.Equal("unix://var/lib/kubelet/csi-plugins/ssd/csi.sock", options[0].Endpoint)
+	assert.Equal("topology.ssd.local.csi.ecloud.cmss.com/hostname", options[0].TopologyKey)
+	assert.Equal(map[string]string{VgNameTag: "vg-ssd"}, options[0].Parameters)
+	assert.Equal("unix://tmp/csi.sock", options[1].Endpoint)
+	assert.Equal("example.com/node", options[1].TopologyKey)
+	assert.Equal(map[string]string{VgNameTag: "vg-hdd", FsTypeTag: "xfs"}, options[1].Parameters)
+
+	for _, value := range []string{
+		"",
+		":vgName=vg1",
+		"a.csi,a.csi:endpoint=unix://tmp/a.sock",
+		"a.csi,b.csi",
+		"a.csi:vgName",
+		"a.csi:=vg1",
+	} {
+		_, err = ParseDriverOptions(value, "unix://tmp/csi.sock")
+		assert.NotNil(err, value)
+	}
+}
+
+func TestDriverRegistry(t *testing.T) {
+	assert := assert.New(t)
+	saved := drivers
+	defer func() { drivers = saved }()
+	drivers = map[string]*DriverOptions{}
+
+	// without instances the default driver is assumed
+	assert.True(isLocalDriver(DefaultDriverName))
+	assert.Equal("@"+DefaultDriverName, localDriverTags())
+	assert.Equal(TopologyNodeKey, driverTopologyKey(DefaultDriverName))
+
+	options, err := ParseDriverOptions("ssd.csi:endpoint=unix://tmp/ssd.sock;vgName=vg-ssd;fsType=xfs,hdd.csi:topologyKey=example.com/node", "unix://tmp/csi.sock")
+	assert.Nil(err)
+	for _, opts := range options {
+		registerDriver(opts)
+	}
+	assert.True(isLocalDriver("ssd.csi"))
+	assert.False(isLocalDriver(DefaultDriverName))
+	assert.Equal("@hdd.csi @ssd.csi", localDriverTags())
+	assert.Equal("example.com/node", driverTopologyKey("hdd.csi"))
+	assert.Equal("topology.other.csi/hostname", driverTopologyKey("other.csi"))
+
+	// the storage class parameters override the defaults
+	parameters := map[string]string{FsTypeTag: "ext4"}
+	assert.Equal(map[string]string{VgNameTag: "vg-ssd", FsTypeTag: "ext4"}, driverParameters("ssd.csi", parameters))
+	assert.Equal(map[string]string{FsTypeTag: "ext4"}, parameters)
+	assert.Equal(parameters, driverParameters("hdd.csi", parameters))
+
+	// the defaults of all the drivers come last
+	defer func() { defaultParameters = map[string]string{} }()
+	assert.Nil(SetDefaultParameters(map[string]string{VgNameTag: "vg-default", "readIOPS": "1000"}))
+	assert.Equal(map[string]string{VgNameTag: "vg-ssd", FsTypeTag: "ext4", "readIOPS": "1000"}, driverParameters("ssd.csi", parameters))
+	assert.Equal(map[string]string{VgNameTag: "vg-default", FsTypeTag: "ext4", "readIOPS": "1000"}, driverParameters("hdd.csi", parameters))
+	assert.NotNil(SetDefaultParameters(map[string]string{VGPolicyTag: "random"}))
+	assert.NotNil(SetDefaultParameters(map[string]string{"writeIOPS": "fast"}))
+	assert.Equal("vg-default", driverParameters("hdd.csi", nil)[VgNameTag])
+}
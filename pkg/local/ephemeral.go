@@ -0,0 +1,157 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// EphemeralTag is the volume context key set by kubelet for inline volumes
+	EphemeralTag = "csi.storage.k8s.io/ephemeral"
+	// PodUIDTag is the volume context key of the pod uid
+	PodUIDTag = "csi.storage.k8s.io/pod.uid"
+	// SizeTag is the volume attribute of the ephemeral inline volume size
+	SizeTag = "size"
+
+	// ephemeralStateKind is the node state kind of the ephemeral inline lvm volumes
+	ephemeralStateKind = "ephemeral"
+
+	// EphemeralVGs env, the comma separated vgs ephemeral inline volumes may use besides the driver default
+	EphemeralVGs = "EPHEMERAL_VGS"
+)
+
+// ephemeralState records an ephemeral inline lvm volume of the node, so
+// only these volumes are looked up when they are unpublished, and how it
+// was published as it has no persistent volume to reconcile it from.
+type ephemeralState struct {
+	VolumeID      string            `json:"volumeID"`
+	VGName        string            `json:"vgName"`
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	ReadOnly      bool              `json:"readOnly,omitempty"`
+	MountFlags    []string          `json:"mountFlags,omitempty"`
+}
+
+// lvmNamePattern matches the vg, lv and tag names passed to the lvm commands
+var lvmNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+
+// isEphemeral checks whether the volume is a csi ephemeral inline volume
+func isEphemeral(volumeContext map[string]string) bool {
+	ephemeral, err := strconv.ParseBool(volumeContext[EphemeralTag])
+	return err == nil && ephemeral
+}
+
+// ephemeralVolumeSize parses the size attribute of an ephemeral inline volume
+func ephemeralVolumeSize(volumeContext map[string]string) (int64, error) {
+	sizeStr, ok := volumeContext[SizeTag]
+	if !ok || sizeStr == "" {
+		return 0, fmt.Errorf("ephemeral volume attribute %s is not provided", SizeTag)
+	}
+	quantity, err := resource.ParseQuantity(sizeStr)
+	if err != nil {
+		return 0, fmt.Errorf("ephemeral volume attribute %s %q is invalid: %v", SizeTag, sizeStr, err)
+	}
+	if quantity.Value() <= 0 {
+		return 0, fmt.Errorf("ephemeral volume attribute %s %q must be positive", SizeTag, sizeStr)
+	}
+	return quantity.Value(), nil
+}
+
+// validateEphemeralVolume checks the attributes of an ephemeral inline volume,
+// they come from the pod spec and only the driver defaults and the vgs of
+// EPHEMERAL_VGS are trusted.
+func validateEphemeralVolume(driverName string, attributes map[string]string) error {
+	defaults := driverParameters(driverName, nil)
+	for _, tag := range []string{VGSelectorTag, PoolTag, CacheVGTag, RootPathTag} {
+		if value, ok := attributes[tag]; ok && value != defaults[tag] {
+			return fmt.Errorf("ephemeral volumes can not set %s", tag)
+		}
+	}
+	if value, ok := attributes[VgNameTag]; ok && value != defaults[VgNameTag] {
+		allowed := parseVGNames(os.Getenv(EphemeralVGs))
+		for _, vgName := range parseVGNames(value) {
+			if !containsString(allowed, vgName) {
+				return fmt.Errorf("vg %q is not allowed for ephemeral volumes", vgName)
+			}
+		}
+	}
+	parameters := driverParameters(driverName, attributes)
+	if parameters[PvTypeTag] == DeviceType {
+		return fmt.Errorf("ephemeral volumes can not use %s %s", PvTypeTag, DeviceType)
+	}
+	for _, vgName := range parseVGNames(parameters[VgNameTag]) {
+		if !lvmNamePattern.MatchString(vgName) {
+			return fmt.Errorf("%s %q is invalid", VgNameTag, vgName)
+		}
+	}
+	if uid := parameters[PodUIDTag]; uid != "" && !lvmNamePattern.MatchString(uid) {
+		return fmt.Errorf("%s %q is invalid", PodUIDTag, uid)
+	}
+	if err := validateWipePolicy(parameters[WipePolicyTag]); err != nil {
+		return err
+	}
+	if err := validateLvmType(parameters); err != nil {
+		return err
+	}
+	if err := validateCache(parameters); err != nil {
+		return err
+	}
+	return validateVGSelection(parameters)
+}
+
+// ephemeralVolumeContext returns a copy of the volume context with the pod
+// uid filled from the target path when kubelet does not provide it.
+func ephemeralVolumeContext(volumeContext map[string]string, targetPath string) map[string]string {
+	newContext := map[string]string{}
+	for key, value := range volumeContext {
+		newContext[key] = value
+	}
+	if newContext[PodUIDTag] == "" {
+		newContext[PodUIDTag] = utils.GetPodUIDFromTargetPath(targetPath)
+	}
+	return newContext
+}
+
+// removeEphemeralVolume releases the lvm volume of an ephemeral inline
+// volume, it does nothing for other volumes.
+func (ns *nodeServer) removeEphemeralVolume(volumeID string) error {
+	state := &ephemeralState{}
+	if err := loadNodeState(ephemeralStateKind, volumeID, state); err != nil {
+		return nil
+	}
+	lvs, err := listLogicalVolumes("@" + utils.EphemeralLVTag)
+	if err != nil {
+		return err
+	}
+	for _, lv := range lvs {
+		if lv.Name != volumeID {
+			continue
+		}
+		log.Infof("removeEphemeralVolume: release ephemeral lvm volume %s of pod %s", lv.DevicePath(), utils.EphemeralPodUID(lv.Tags))
+		if err := ns.releaseVolume(lv); err != nil {
+			return err
+		}
+	}
+	return removeNodeState(ephemeralStateKind, volumeID)
+}
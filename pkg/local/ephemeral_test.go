@@ -0,0 +1,72 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEphemeralVolume(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(isEphemeral(map[string]string{}))
+	assert.True(isEphemeral(map[string]string{EphemeralTag: "true"}))
+
+	size, err := ephemeralVolumeSize(map[string]string{SizeTag: "2Gi"})
+	assert.Nil(err)
+	assert.Equal(int64(2*1024*1024*1024), size)
+	_, err = ephemeralVolumeSize(map[string]string{})
+	assert.NotNil(err)
+	_, err = ephemeralVolumeSize(map[string]string{SizeTag: "-1Gi"})
+	assert.NotNil(err)
+
+	volumeContext := ephemeralVolumeContext(map[string]string{EphemeralTag: "true", WipePolicyTag: WipePolicyZero},
+		"/var/lib/kubelet/pods/c06d5521-3d9c-4517-bdc2-e6df34b9e8f1/volumes/kubernetes.io~csi/data/mount")
+	assert.Equal("--addtag local.csi.ecloud.cmss.com --addtag wipe_zero --addtag ephemeral --addtag pod_c06d5521-3d9c-4517-bdc2-e6df34b9e8f1", volumeTags(DefaultDriverName, volumeContext))
+}
+
+func TestValidateEphemeralVolume(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { defaultParameters = map[string]string{} }()
+	assert.Nil(SetDefaultParameters(map[string]string{VgNameTag: "vg-default"}))
+
+	assert.Nil(validateEphemeralVolume(DefaultDriverName, map[string]string{EphemeralTag: "true", SizeTag: "1Gi"}))
+	assert.Nil(validateEphemeralVolume(DefaultDriverName, map[string]string{VgNameTag: "vg-default", WipePolicyTag: WipePolicyZero}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{VgNameTag: "vg-other"}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{VGSelectorTag: "tier=ssd"}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{CacheVGTag: "vg-nvme"}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{WipePolicyTag: "zero;reboot"}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{PodUIDTag: "$(reboot)"}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{PvTypeTag: DeviceType, DevicePathTag: "/dev/sda"}))
+
+	t.Setenv(EphemeralVGs, "vg-other, vg-tmp")
+	assert.Nil(validateEphemeralVolume(DefaultDriverName, map[string]string{VgNameTag: "vg-other"}))
+	assert.NotNil(validateEphemeralVolume(DefaultDriverName, map[string]string{VgNameTag: "vg-other;reboot"}))
+}
+
+func TestRemoveEphemeralVolume(t *testing.T) {
+	assert := assert.New(t)
+	kubeletRootDir := utils.KubeletRootDir
+	utils.KubeletRootDir = t.TempDir()
+	defer func() { utils.KubeletRootDir = kubeletRootDir }()
+
+	// volumes without ephemeral state are left to the other unpublish steps
+	ns := &nodeServer{}
+	assert.Nil(ns.removeEphemeralVolume("pv-1"))
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// VGNotFoundReason event reason, the vg of the volume is missing on the node
+	VGNotFoundReason = "VolumeGroupNotFound"
+	// InsufficientSpaceReason event reason, the vg has not enough free space for the volume
+	InsufficientSpaceReason = "InsufficientVolumeGroupSpace"
+	// VolumeCreateFailedReason event reason, the lvm volume failed to create
+	VolumeCreateFailedReason = "VolumeCreateFailed"
+	// FormatFailedReason event reason, the filesystem failed to create
+	FormatFailedReason = "VolumeFormatFailed"
+	// IOLimitFailedReason event reason, the io limits failed to apply
+	IOLimitFailedReason = "VolumeIOLimitFailed"
+	// VolumeResizedReason event reason, the volume and its filesystem are expanded
+	VolumeResizedReason = "VolumeResized"
+	// VolumeResizeFailedReason event reason, the volume or its filesystem failed to expand
+	VolumeResizeFailedReason = "VolumeResizeFailed"
+
+	// podNameTag and podNamespaceTag are the volume context keys of the pod with podInfoOnMount
+	podNameTag      = "csi.storage.k8s.io/pod.name"
+	podNamespaceTag = "csi.storage.k8s.io/pod.namespace"
+)
+
+// createFailedReason returns the event reason of an lvm volume creation error
+func createFailedReason(err error) string {
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "volume group") && strings.Contains(message, "not found"):
+		return VGNotFoundReason
+	case strings.Contains(message, "insufficient free space") || strings.Contains(message, "insufficient suitable allocatable extents") ||
+		strings.Contains(message, "not enough free"):
+		return InsufficientSpaceReason
+	}
+	return VolumeCreateFailedReason
+}
+
+// volumePod returns the reference of the pod publishing the volume, nil
+// if the driver does not get the pod info on mount.
+func volumePod(volumeContext map[string]string) *v1.ObjectReference {
+	if volumeContext[podNameTag] == "" || volumeContext[podNamespaceTag] == "" {
+		return nil
+	}
+	return &v1.ObjectReference{
+		Kind:      "Pod",
+		Name:      volumeContext[podNameTag],
+		Namespace: volumeContext[podNamespaceTag],
+		UID:       types.UID(volumeContext[PodUIDTag]),
+	}
+}
+
+// volumeEvent records the event on the claim of the volume and on the pod publishing it
+func (ns *nodeServer) volumeEvent(claim *volumeClaim, volumeContext map[string]string, eventType, reason, message string) {
+	message = fmt.Sprintf("volume %s: %s", claim.volumeID, message)
+	if !isEphemeral(volumeContext) {
+		if pvc := claim.get(); pvc != nil {
+			ns.claimEvent(pvc, eventType, reason, message)
+		}
+	}
+	if pod := volumePod(volumeContext); pod != nil {
+		utils.CreateEvent(ns.recorder, pod, eventType, reason, message)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCreateFailedReason(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(VGNotFoundReason, createFailedReason(errors.New(`failed to run cmd: vgck vg1, with out:   Volume group "vg1" not found`)))
+	assert.Equal(InsufficientSpaceReason, createFailedReason(errors.New("  Volume group \"vg1\" has insufficient free space (255 extents): 512 required.")))
+	assert.Equal(InsufficientSpaceReason, createFailedReason(errors.New("  Insufficient suitable allocatable extents for logical volume lvm-1: 512 more required")))
+	assert.Equal(VolumeCreateFailedReason, createFailedReason(errors.New("unknown lvmType \"mirror\"")))
+}
+
+func TestVolumePod(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(volumePod(map[string]string{VgNameTag: "vg1"}))
+	assert.Nil(volumePod(map[string]string{podNameTag: "nginx-0"}))
+
+	pod := volumePod(map[string]string{podNameTag: "nginx-0", podNamespaceTag: "default", PodUIDTag: "uid-1"})
+	assert.Equal("Pod", pod.Kind)
+	assert.Equal("nginx-0", pod.Name)
+	assert.Equal("default", pod.Namespace)
+	assert.Equal(types.UID("uid-1"), pod.UID)
+}
@@ -0,0 +1,490 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/options"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// IOPSCapacityAnnotation is the node annotation of the total iops the
+	// node disks sustain, the extender scores the headroom left by the
+	// readIOPS and writeIOPS limits of the volumes on the node.
+	IOPSCapacityAnnotation = "local.csi.ecloud.cmss.com/iops-capacity"
+
+	// maxExtenderScore is the highest score of the scheduler extender
+	maxExtenderScore = 10
+)
+
+// extenderArgs is the scheduler extender request
+type extenderArgs struct {
+	Pod       *v1.Pod      `json:"pod"`
+	Nodes     *v1.NodeList `json:"nodes,omitempty"`
+	NodeNames *[]string    `json:"nodenames,omitempty"`
+}
+
+// extenderFilterResult is the scheduler extender filter response
+type extenderFilterResult struct {
+	Nodes       *v1.NodeList      `json:"nodes,omitempty"`
+	NodeNames   *[]string         `json:"nodenames,omitempty"`
+	FailedNodes map[string]string `json:"failedNodes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// hostPriority is the score of a node in the scheduler extender prioritize response
+type hostPriority struct {
+	Host  string `json:"host"`
+	Score int64  `json:"score"`
+}
+
+// volumeRequest is a volume of the pod not placed on a node yet
+type volumeRequest struct {
+	Name       string
+	Size       int64
+	Parameters map[string]string
+}
+
+// Extender is the scheduler extender filtering and scoring nodes by the vg
+// and disk inventory the node plugins advertise.
+type Extender struct {
+	client kubernetes.Interface
+}
+
+// NewExtender creates the scheduler extender of the volumes of the drivers
+func NewExtender(drivers []*DriverOptions) *Extender {
+	for _, opts := range drivers {
+		registerDriver(opts)
+	}
+	if err := loadVDOMaxRatio(); err != nil {
+		log.Fatalf("NewExtender: %s", err.Error())
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags(options.MasterURL, options.Kubeconfig)
+	if err != nil {
+		log.Fatalf("Error building kubeconfig: %s", err.Error())
+	}
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		log.Fatalf("Error building kubernetes clientset: %s", err.Error())
+	}
+	// the extender is ready once it reaches the api server for the nodes and claims
+	registerHealthChecks(healthCheck{name: "kube-apiserver", check: func(ctx context.Context) error { return checkAPIServer(ctx, kubeClient) }})
+	return &Extender{client: kubeClient}
+}
+
+// Register registers the filter and prioritize verbs of the extender
+func (e *Extender) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/filter", e.filterHandler)
+	mux.HandleFunc("/prioritize", e.prioritizeHandler)
+}
+
+func (e *Extender) filterHandler(w http.ResponseWriter, r *http.Request) {
+	args := &extenderArgs{}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil {
+		writeExtenderResponse(w, &extenderFilterResult{Error: err.Error()})
+		return
+	}
+	result, err := e.filter(args)
+	if err != nil {
+		log.Errorf("Extender: filter nodes with error: %s", err.Error())
+		result = &extenderFilterResult{Error: err.Error()}
+	}
+	writeExtenderResponse(w, result)
+}
+
+func (e *Extender) prioritizeHandler(w http.ResponseWriter, r *http.Request) {
+	args := &extenderArgs{}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priorities, err := e.prioritize(args)
+	if err != nil {
+		log.Errorf("Extender: prioritize nodes with error: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeExtenderResponse(w, priorities)
+}
+
+func writeExtenderResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Extender: write response with error: %s", err.Error())
+	}
+}
+
+// filter removes the nodes that cannot fit all the pending volumes of the pod
+func (e *Extender) filter(args *extenderArgs) (*extenderFilterResult, error) {
+	nodes, err := e.candidateNodes(args)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := e.pendingVolumes(args.Pod)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &extenderFilterResult{FailedNodes: map[string]string{}}
+	fitNodes := []v1.Node{}
+	for i := range nodes {
+		if _, err := fitVolumes(&nodes[i], requests); err != nil {
+			result.FailedNodes[nodes[i].Name] = err.Error()
+			continue
+		}
+		fitNodes = append(fitNodes, nodes[i])
+	}
+	if args.Nodes != nil {
+		result.Nodes = &v1.NodeList{Items: fitNodes}
+	} else {
+		names := make([]string, 0, len(fitNodes))
+		for _, node := range fitNodes {
+			names = append(names, node.Name)
+		}
+		result.NodeNames = &names
+	}
+	log.Infof("Extender: pod %s/%s with %d pending volumes fits %d of %d nodes", args.Pod.Namespace, args.Pod.Name, len(requests), len(fitNodes), len(nodes))
+	return result, nil
+}
+
+// prioritize scores the nodes by the free capacity left after placing the
+// pending volumes and by the iops headroom.
+func (e *Extender) prioritize(args *extenderArgs) ([]hostPriority, error) {
+	nodes, err := e.candidateNodes(args)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := e.pendingVolumes(args.Pod)
+	if err != nil {
+		return nil, err
+	}
+	committed, err := e.committedIOPS()
+	if err != nil {
+		return nil, err
+	}
+	var requestedIOPS int64
+	for _, request := range requests {
+		requestedIOPS += volumeIOPS(request.Parameters)
+	}
+
+	priorities := make([]hostPriority, 0, len(nodes))
+	for i := range nodes {
+		freeRatio, err := fitVolumes(&nodes[i], requests)
+		if err != nil {
+			priorities = append(priorities, hostPriority{Host: nodes[i].Name})
+			continue
+		}
+		score := nodeScore(freeRatio, iopsHeadroom(&nodes[i], committed[nodes[i].Name]+requestedIOPS))
+		priorities = append(priorities, hostPriority{Host: nodes[i].Name, Score: score})
+	}
+	return priorities, nil
+}
+
+// candidateNodes returns the nodes of the request, fetched by name when the
+// scheduler only sends the node names.
+func (e *Extender) candidateNodes(args *extenderArgs) ([]v1.Node, error) {
+	if args.Pod == nil {
+		return nil, fmt.Errorf("pod is not provided")
+	}
+	if args.Nodes != nil {
+		return args.Nodes.Items, nil
+	}
+	nodes := []v1.Node{}
+	if args.NodeNames == nil {
+		return nodes, nil
+	}
+	for _, name := range *args.NodeNames {
+		node, err := e.client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, *node)
+	}
+	return nodes, nil
+}
+
+// pendingVolumes returns the volumes of the drivers the pod uses which are
+// not placed on a node yet: unbound claims, bound claims whose volume is
+// created lazily without node affinity, and inline ephemeral volumes.
+func (e *Extender) pendingVolumes(pod *v1.Pod) ([]volumeRequest, error) {
+	requests := []volumeRequest{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.CSI != nil {
+			if !isLocalDriver(volume.CSI.Driver) {
+				continue
+			}
+			parameters := driverParameters(volume.CSI.Driver, volume.CSI.VolumeAttributes)
+			size, err := ephemeralVolumeSize(parameters)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, volumeRequest{Name: volume.Name, Size: size, Parameters: parameters})
+			continue
+		}
+
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc, err := e.client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(context.Background(), volume.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		request, pending, err := e.claimRequest(volume.Name, &pvc.Spec)
+		if err != nil {
+			return nil, err
+		}
+		if pending {
+			requests = append(requests, request)
+		}
+	}
+	return requests, nil
+}
+
+// claimRequest returns the volume request of a claim of the drivers
+func (e *Extender) claimRequest(name string, spec *v1.PersistentVolumeClaimSpec) (volumeRequest, bool, error) {
+	if spec.VolumeName != "" {
+		pv, err := e.client.CoreV1().PersistentVolumes().Get(context.Background(), spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return volumeRequest{}, false, err
+		}
+		if pv.Spec.CSI == nil || !isLocalDriver(pv.Spec.CSI.Driver) || pvNodeName(pv) != "" {
+			return volumeRequest{}, false, nil
+		}
+		quantity := pv.Spec.Capacity[v1.ResourceStorage]
+		return volumeRequest{Name: name, Size: quantity.Value(), Parameters: pv.Spec.CSI.VolumeAttributes}, true, nil
+	}
+
+	if spec.StorageClassName == nil || *spec.StorageClassName == "" {
+		return volumeRequest{}, false, nil
+	}
+	class, err := e.client.StorageV1().StorageClasses().Get(context.Background(), *spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return volumeRequest{}, false, err
+	}
+	if !isLocalDriver(class.Provisioner) {
+		return volumeRequest{}, false, nil
+	}
+	quantity := spec.Resources.Requests[v1.ResourceStorage]
+	return volumeRequest{Name: name, Size: quantity.Value(), Parameters: driverParameters(class.Provisioner, class.Parameters)}, true, nil
+}
+
+// pvNodeName returns the node of the persistent volume node affinity
+func pvNodeName(pv *v1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	topologyKey := TopologyNodeKey
+	if pv.Spec.CSI != nil {
+		topologyKey = driverTopologyKey(pv.Spec.CSI.Driver)
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expression := range term.MatchExpressions {
+			if (expression.Key == topologyKey || expression.Key == v1.LabelHostname) && len(expression.Values) > 0 {
+				return expression.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// physicalSize returns the vg space a volume of size bytes takes
+func physicalSize(parameters map[string]string, size int64) int64 {
+	physical := size
+	switch lvmType := parameters[LvmTypeTag]; lvmType {
+	case VDOType:
+		if ratio, err := parseVDORatio(parameters); err == nil {
+			physical = vdoPoolSize(size, ratio)
+		}
+	case Raid1Type, Raid10Type:
+		mirrors, _ := parsePositiveInt(parameters, MirrorsTag)
+		if mirrors == 0 {
+			mirrors = 1
+		}
+		physical = size * int64(mirrors+1)
+	case Raid5Type:
+		// one parity stripe, at least 2 data stripes
+		stripes, _ := parsePositiveInt(parameters, StripesTag)
+		if stripes < 2 {
+			stripes = 2
+		}
+		physical = size * int64(stripes+1) / int64(stripes)
+	}
+	return physical
+}
+
+// fitVolumes places the volume requests on the vgs and free disks the node
+// advertises, it returns the free ratio of the used inventory left after.
+func fitVolumes(node *v1.Node, requests []volumeRequest) (float64, error) {
+	vgs := []volumeGroup{}
+	if value := node.Annotations[VGsAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &vgs); err != nil {
+			return 0, fmt.Errorf("invalid vg inventory: %v", err)
+		}
+	}
+	devices := []nodeDevice{}
+	if value := node.Annotations[DevicesAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &devices); err != nil {
+			return 0, fmt.Errorf("invalid device inventory: %v", err)
+		}
+	}
+
+	// place the largest volumes first
+	sorted := append([]volumeRequest{}, requests...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+
+	free := map[string]int64{}
+	for _, vg := range vgs {
+		free[vg.Name] = vg.Free
+	}
+	usedVGs := map[string]bool{}
+	usedDevices := map[string]bool{}
+	for _, request := range sorted {
+		switch request.Parameters[PvTypeTag] {
+		case QuotaPathType:
+			continue
+		case DeviceType:
+			device, err := pickFreeDevice(devices, usedDevices, request.Size)
+			if err != nil {
+				return 0, fmt.Errorf("volume %s: %v", request.Name, err)
+			}
+			usedDevices[device] = true
+		default:
+			candidates, err := matchVGs(vgs, request.Parameters)
+			if err != nil {
+				return 0, fmt.Errorf("volume %s: %v", request.Name, err)
+			}
+			for i := range candidates {
+				candidates[i].Free = free[candidates[i].Name]
+				usedVGs[candidates[i].Name] = true
+			}
+			size := physicalSize(request.Parameters, request.Size)
+			vgName, err := selectVG(candidates, map[string]int{}, request.Parameters[VGPolicyTag], size)
+			if err != nil {
+				return 0, fmt.Errorf("volume %s: %v", request.Name, err)
+			}
+			free[vgName] -= size
+			// the cache takes the space of the fast vg
+			if cacheVG := request.Parameters[CacheVGTag]; cacheVG != "" {
+				if _, ok := free[cacheVG]; !ok {
+					return 0, fmt.Errorf("volume %s: cache vg %s not found", request.Name, cacheVG)
+				}
+				free[cacheVG] -= cacheSpace(request.Parameters, request.Size)
+				if free[cacheVG] < 0 {
+					return 0, fmt.Errorf("volume %s: cache vg %s has no space for the cache", request.Name, cacheVG)
+				}
+				usedVGs[cacheVG] = true
+			}
+		}
+	}
+
+	var total, left int64
+	for _, vg := range vgs {
+		if usedVGs[vg.Name] {
+			total += vg.Size
+			left += free[vg.Name]
+		}
+	}
+	if len(usedDevices) > 0 {
+		for _, device := range devices {
+			total += device.Size
+			if !usedDevices[device.Path] {
+				left += device.Size
+			}
+		}
+	}
+	if total == 0 {
+		return 1, nil
+	}
+	return float64(left) / float64(total), nil
+}
+
+// pickFreeDevice returns the smallest unused disk of at least size bytes
+func pickFreeDevice(devices []nodeDevice, used map[string]bool, size int64) (string, error) {
+	best := -1
+	for i, device := range devices {
+		if used[device.Path] || device.Size < size {
+			continue
+		}
+		if best < 0 || device.Size < devices[best].Size {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", fmt.Errorf("no free disk has %d bytes", size)
+	}
+	return devices[best].Path, nil
+}
+
+// volumeIOPS returns the iops limits of a volume
+func volumeIOPS(parameters map[string]string) int64 {
+	var iops int64
+	for _, tag := range []string{"readIOPS", "writeIOPS"} {
+		if value, err := strconv.ParseInt(parameters[tag], 10, 64); err == nil && value > 0 {
+			iops += value
+		}
+	}
+	return iops
+}
+
+// committedIOPS returns the iops limits of the volumes on every node
+func (e *Extender) committedIOPS() (map[string]int64, error) {
+	pvs, err := e.client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	committed := map[string]int64{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || !isLocalDriver(pv.Spec.CSI.Driver) {
+			continue
+		}
+		if nodeName := pvNodeName(pv); nodeName != "" {
+			committed[nodeName] += volumeIOPS(pv.Spec.CSI.VolumeAttributes)
+		}
+	}
+	return committed, nil
+}
+
+// iopsHeadroom returns the ratio of the node iops capacity left, 1 when the
+// node does not advertise its capacity.
+func iopsHeadroom(node *v1.Node, iops int64) float64 {
+	capacity, err := strconv.ParseInt(node.Annotations[IOPSCapacityAnnotation], 10, 64)
+	if err != nil || capacity <= 0 {
+		return 1
+	}
+	if iops >= capacity {
+		return 0
+	}
+	return float64(capacity-iops) / float64(capacity)
+}
+
+// nodeScore weighs the free capacity and the iops headroom equally
+func nodeScore(freeRatio, headroom float64) int64 {
+	return int64(math.Round((freeRatio + headroom) / 2 * maxExtenderScore))
+}
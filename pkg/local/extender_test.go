@@ -0,0 +1,108 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func extenderNode(vgs, devices, iops string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{
+		VGsAnnotation:          vgs,
+		DevicesAnnotation:      devices,
+		IOPSCapacityAnnotation: iops,
+	}}}
+}
+
+func TestFitVolumes(t *testing.T) {
+	assert := assert.New(t)
+	node := extenderNode(`[{"name":"vg1","size":100,"free":60},{"name":"vg2","size":100,"free":40}]`, `[{"path":"/dev/sdb","size":50},{"path":"/dev/sdc","size":100}]`, "")
+
+	ratio, err := fitVolumes(node, []volumeRequest{
+		{Name: "data", Size: 50, Parameters: map[string]string{VgNameTag: "vg1,vg2", VGPolicyTag: VGPolicyMostFree}},
+		{Name: "log", Size: 40, Parameters: map[string]string{VgNameTag: "vg1,vg2"}},
+	})
+	assert.Nil(err)
+	assert.Equal(0.05, ratio)
+
+	_, err = fitVolumes(node, []volumeRequest{
+		{Name: "data", Size: 50, Parameters: map[string]string{VgNameTag: "vg1"}},
+		{Name: "log", Size: 20, Parameters: map[string]string{VgNameTag: "vg1"}},
+	})
+	assert.NotNil(err)
+
+	ratio, err = fitVolumes(node, []volumeRequest{{Name: "raw", Size: 40, Parameters: map[string]string{PvTypeTag: DeviceType}}})
+	assert.Nil(err)
+	assert.Equal(float64(100)/150, ratio)
+	_, err = fitVolumes(node, []volumeRequest{{Name: "raw", Size: 200, Parameters: map[string]string{PvTypeTag: DeviceType}}})
+	assert.NotNil(err)
+
+	ratio, err = fitVolumes(node, []volumeRequest{{Name: "dir", Size: 1000, Parameters: map[string]string{PvTypeTag: QuotaPathType}}})
+	assert.Nil(err)
+	assert.Equal(float64(1), ratio)
+
+	_, err = fitVolumes(extenderNode("", "", ""), []volumeRequest{{Name: "data", Size: 1, Parameters: map[string]string{VgNameTag: "vg1"}}})
+	assert.NotNil(err)
+
+	// the caches take the space of the fast vg
+	gi := int64(1024 * 1024 * 1024)
+	cacheNode := extenderNode(fmt.Sprintf(`[{"name":"vg-hdd","size":%d,"free":%d},{"name":"vg-nvme","size":%d,"free":%d}]`, 100*gi, 100*gi, 2*gi, 2*gi), "", "")
+	cached := map[string]string{VgNameTag: "vg-hdd", CacheVGTag: "vg-nvme"}
+	_, err = fitVolumes(cacheNode, []volumeRequest{{Name: "data", Size: 10 * gi, Parameters: cached}})
+	assert.Nil(err)
+	_, err = fitVolumes(cacheNode, []volumeRequest{{Name: "data", Size: 10 * gi, Parameters: cached}, {Name: "log", Size: 10 * gi, Parameters: cached}})
+	assert.NotNil(err)
+	_, err = fitVolumes(cacheNode, []volumeRequest{{Name: "data", Size: gi, Parameters: map[string]string{VgNameTag: "vg-hdd", CacheVGTag: "vg-ssd"}}})
+	assert.NotNil(err)
+}
+
+func TestPhysicalSize(t *testing.T) {
+	assert := assert.New(t)
+	gi := int64(1024 * 1024 * 1024)
+	assert.Equal(10*gi, physicalSize(map[string]string{}, 10*gi))
+	assert.Equal(30*gi, physicalSize(map[string]string{LvmTypeTag: Raid1Type, MirrorsTag: "2"}, 10*gi))
+	assert.Equal(15*gi, physicalSize(map[string]string{LvmTypeTag: Raid5Type}, 10*gi))
+	assert.Equal(10*gi, physicalSize(map[string]string{LvmTypeTag: VDOType, VDORatioTag: "10"}, 100*gi))
+	// the cache takes the space of its own vg
+	assert.Equal(10*gi, physicalSize(map[string]string{CacheVGTag: "vg-nvme", CacheSizeTag: "2Gi"}, 10*gi))
+}
+
+func TestPVNodeName(t *testing.T) {
+	assert := assert.New(t)
+	pv := &v1.PersistentVolume{}
+	assert.Equal("", pvNodeName(pv))
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+		MatchExpressions: []v1.NodeSelectorRequirement{{Key: TopologyNodeKey, Operator: v1.NodeSelectorOpIn, Values: []string{"node1"}}},
+	}}}}
+	assert.Equal("node1", pvNodeName(pv))
+}
+
+func TestNodeScore(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(3000), volumeIOPS(map[string]string{"readIOPS": "2000", "writeIOPS": "1000", "readBPS": "10000"}))
+	assert.Equal(float64(1), iopsHeadroom(extenderNode("", "", ""), 5000))
+	assert.Equal(0.75, iopsHeadroom(extenderNode("", "", "4000"), 1000))
+	assert.Equal(float64(0), iopsHeadroom(extenderNode("", "", "4000"), 5000))
+	assert.Equal(int64(10), nodeScore(1, 1))
+	assert.Equal(int64(5), nodeScore(0.25, 0.75))
+	assert.Equal(int64(0), nodeScore(0, 0))
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// FsCheckTag is the storageclass parameter to check the filesystem before mount
+	FsCheckTag = "fsCheck"
+	// FsRepairAnnotation is the pvc annotation requesting a full filesystem repair on the next mount
+	FsRepairAnnotation = "local.csi.ecloud.cmss.com/fsck-repair"
+
+	// FsCheckPassedReason event reason
+	FsCheckPassedReason = "FilesystemCheckPassed"
+	// FsRepairedReason event reason
+	FsRepairedReason = "FilesystemRepaired"
+	// FsCheckFailedReason event reason
+	FsCheckFailedReason = "FilesystemCheckFailed"
+
+	// fsckConditionSource is the volume condition source of filesystem checks
+	fsckConditionSource = "fsck"
+)
+
+// fsckResult is the result of a filesystem check
+type fsckResult struct {
+	// Clean is true when the filesystem has no errors left
+	Clean bool
+	// Repaired is true when errors were found and corrected
+	Repaired bool
+	Output   string
+}
+
+// checkFilesystem checks the filesystem on devicePath. Without repair only
+// safe fixes are applied (fsck -p) and xfs is checked read only
+// (xfs_repair -n); with repair the filesystem is fully repaired.
+func checkFilesystem(ctx context.Context, devicePath, fsType string, repair bool) (*fsckResult, error) {
+	var cmd *exec.Cmd
+	isXfs := fsType == "xfs"
+	switch {
+	case isXfs && repair:
+		cmd = exec.CommandContext(ctx, "xfs_repair", devicePath)
+	case isXfs:
+		cmd = exec.CommandContext(ctx, "xfs_repair", "-n", devicePath)
+	case repair:
+		cmd = exec.CommandContext(ctx, "fsck."+fsType, "-f", "-y", devicePath)
+	default:
+		cmd = exec.CommandContext(ctx, "fsck."+fsType, "-p", devicePath)
+	}
+	log.Infof("checkFilesystem: check %s with fsType %s, the command is %v", devicePath, fsType, cmd.Args)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("run %v: %v", cmd.Args, ctx.Err())
+	}
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("run %v failed: %v", cmd.Args, err)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	return parseFsckExitCode(isXfs, repair, exitCode, strings.TrimSpace(string(output)))
+}
+
+// parseFsckExitCode converts the exit code of fsck or xfs_repair to a result.
+func parseFsckExitCode(isXfs, repair bool, exitCode int, output string) (*fsckResult, error) {
+	if isXfs {
+		switch exitCode {
+		case 0:
+			return &fsckResult{Clean: true, Repaired: repair, Output: output}, nil
+		case 1:
+			// xfs_repair -n found corruptions
+			return &fsckResult{Clean: false, Output: output}, nil
+		case 2:
+			// dirty log, the mount replays it
+			if !repair {
+				return &fsckResult{Clean: true, Output: output}, nil
+			}
+		}
+		return nil, fmt.Errorf("xfs_repair exit with code %d: %s", exitCode, output)
+	}
+
+	// fsck exit code is the sum of: 1 errors corrected, 2 reboot required,
+	// 4 errors left uncorrected, 8 operational error, 16 usage error.
+	if exitCode >= 8 {
+		return nil, fmt.Errorf("fsck exit with code %d: %s", exitCode, output)
+	}
+	return &fsckResult{Clean: exitCode&4 == 0, Repaired: exitCode&3 != 0, Output: output}, nil
+}
+
+// checkVolumeFilesystem runs the filesystem check configured by the
+// storageclass or requested by the pvc annotation before the volume is
+// mounted, the results are reported as pvc events and volume condition.
+func (ns *nodeServer) checkVolumeFilesystem(ctx context.Context, claim *volumeClaim, devicePath, fsType string, volumeContext map[string]string) error {
+	volumeID := claim.volumeID
+	fsCheck, _ := strconv.ParseBool(volumeContext[FsCheckTag])
+	pvc := claim.get()
+	repair := false
+	if pvc != nil {
+		repair, _ = strconv.ParseBool(pvc.Annotations[FsRepairAnnotation])
+	}
+	if !fsCheck && !repair {
+		return nil
+	}
+	if ns.isDeviceMounted(devicePath) {
+		log.Warnf("checkVolumeFilesystem: skip check of volume %s, device %s is in use", volumeID, devicePath)
+		return nil
+	}
+
+	result, err := checkFilesystem(ctx, devicePath, fsType, repair)
+	if err != nil {
+		setVolumeCondition(volumeID, fsckConditionSource, true, err.Error())
+		ns.claimEvent(pvc, v1.EventTypeWarning, FsCheckFailedReason, err.Error())
+		return err
+	}
+	if !result.Clean {
+		message := fmt.Sprintf("filesystem %s on %s has uncorrected errors, annotate the pvc with %s=true to repair it: %s", fsType, devicePath, FsRepairAnnotation, result.Output)
+		setVolumeCondition(volumeID, fsckConditionSource, true, message)
+		ns.claimEvent(pvc, v1.EventTypeWarning, FsCheckFailedReason, message)
+		return errors.New(message)
+	}
+
+	if result.Repaired {
+		message := fmt.Sprintf("filesystem %s on %s repaired", fsType, devicePath)
+		setVolumeCondition(volumeID, fsckConditionSource, false, message)
+		ns.claimEvent(pvc, v1.EventTypeNormal, FsRepairedReason, message)
+	} else {
+		message := fmt.Sprintf("filesystem %s on %s is clean", fsType, devicePath)
+		setVolumeCondition(volumeID, fsckConditionSource, false, "")
+		ns.claimEvent(pvc, v1.EventTypeNormal, FsCheckPassedReason, message)
+	}
+	if repair {
+		ns.removeRepairAnnotation(pvc)
+	}
+	return nil
+}
+
+// isDeviceMounted checks whether the device is mounted on any path of the node
+func (ns *nodeServer) isDeviceMounted(devicePath string) bool {
+	mountPoints, err := utils.ListProcMounts()
+	if err != nil {
+		log.Errorf("isDeviceMounted: list mount points with error: %s", err.Error())
+		return true
+	}
+	for _, mp := range mountPoints {
+		if sameDevice(mp.Device, devicePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeClaim fetches the pvc of a volume at most once, the steps of one
+// request share it
+type volumeClaim struct {
+	ns       *nodeServer
+	volumeID string
+	fetched  bool
+	pvc      *v1.PersistentVolumeClaim
+}
+
+// get returns the pvc bound to the volume, nil if not found
+func (c *volumeClaim) get() *v1.PersistentVolumeClaim {
+	if !c.fetched {
+		c.pvc = c.ns.getVolumeClaim(c.volumeID)
+		c.fetched = true
+	}
+	return c.pvc
+}
+
+// getVolumeClaim returns the pvc bound to the persistent volume, nil if not found
+func (ns *nodeServer) getVolumeClaim(volumeID string) *v1.PersistentVolumeClaim {
+	pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), volumeID, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("getVolumeClaim: get pv %s with error: %s", volumeID, err.Error())
+		return nil
+	}
+	if pv.Spec.ClaimRef == nil {
+		return nil
+	}
+	pvc, err := ns.client.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(context.Background(), pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("getVolumeClaim: get pvc %s/%s with error: %s", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, err.Error())
+		return nil
+	}
+	return pvc
+}
+
+// removeRepairAnnotation removes the repair request once it is done
+func (ns *nodeServer) removeRepairAnnotation(pvc *v1.PersistentVolumeClaim) {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, FsRepairAnnotation)
+	_, err := ns.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(context.Background(), pvc.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		log.Errorf("removeRepairAnnotation: patch pvc %s/%s with error: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
+
+// claimEvent records an event on the pvc
+func (ns *nodeServer) claimEvent(pvc *v1.PersistentVolumeClaim, eventType, reason, message string) {
+	if pvc == nil {
+		log.Infof("claimEvent: %s %s: %s", eventType, reason, message)
+		return
+	}
+	objectRef := &v1.ObjectReference{Kind: "PersistentVolumeClaim", Name: pvc.Name, Namespace: pvc.Namespace, UID: pvc.UID}
+	utils.CreateEvent(ns.recorder, objectRef, eventType, reason, message)
+}
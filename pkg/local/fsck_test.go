@@ -0,0 +1,80 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFsckExitCode(t *testing.T) {
+	assert := assert.New(t)
+
+	result, err := parseFsckExitCode(false, false, 0, "")
+	assert.Nil(err)
+	assert.True(result.Clean)
+	assert.False(result.Repaired)
+
+	result, err = parseFsckExitCode(false, false, 1, "")
+	assert.Nil(err)
+	assert.True(result.Clean)
+	assert.True(result.Repaired)
+
+	result, err = parseFsckExitCode(false, false, 4, "")
+	assert.Nil(err)
+	assert.False(result.Clean)
+
+	_, err = parseFsckExitCode(false, true, 8, "")
+	assert.NotNil(err)
+
+	result, err = parseFsckExitCode(true, false, 1, "")
+	assert.Nil(err)
+	assert.False(result.Clean)
+
+	result, err = parseFsckExitCode(true, false, 2, "")
+	assert.Nil(err)
+	assert.True(result.Clean)
+
+	_, err = parseFsckExitCode(true, true, 2, "")
+	assert.NotNil(err)
+}
+
+func TestVolumeCondition(t *testing.T) {
+	assert := assert.New(t)
+	volumeID := "lvm-condition-test"
+
+	assert.False(getVolumeCondition(volumeID).Abnormal)
+
+	setVolumeCondition(volumeID, fsckConditionSource, true, "uncorrected errors")
+	condition := getVolumeCondition(volumeID)
+	assert.True(condition.Abnormal)
+	assert.Equal("fsck: uncorrected errors", condition.Message)
+
+	setVolumeCondition(volumeID, fsckConditionSource, false, "")
+	assert.False(getVolumeCondition(volumeID).Abnormal)
+}
+
+func TestCheckFilesystemDeadline(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := checkFilesystem(ctx, "/dev/null", "ext4", false)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), context.Canceled.Error())
+}
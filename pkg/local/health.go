@@ -0,0 +1,232 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// VGNames env, the comma separated vgs the node must have, checked by the readiness
+	VGNames = "VG_NAMES"
+
+	// csiSocketCheck is the name of the check dialing the csi endpoint
+	csiSocketCheck = "csi-socket"
+	// healthCheckTimeout bounds every health check
+	healthCheckTimeout = 10 * time.Second
+)
+
+// healthCheck is a check of the driver, liveness checks restart the
+// plugin when failing, the others only mark it not ready.
+type healthCheck struct {
+	name     string
+	liveness bool
+	check    func(ctx context.Context) error
+}
+
+// checkResult is the result of a health check
+type checkResult struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the body of /healthz and /readyz
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+var (
+	// healthChecks are the checks of all the driver instances
+	healthChecks      = []healthCheck{}
+	healthChecksMutex sync.Mutex
+)
+
+// registerHealthChecks adds the checks of a driver instance, the node
+// wide checks are added once for all the instances.
+func registerHealthChecks(checks ...healthCheck) {
+	healthChecksMutex.Lock()
+	defer healthChecksMutex.Unlock()
+	for _, check := range checks {
+		if check.name != csiSocketCheck && hasHealthCheck(check.name) {
+			continue
+		}
+		healthChecks = append(healthChecks, check)
+	}
+}
+
+func hasHealthCheck(name string) bool {
+	for _, check := range healthChecks {
+		if check.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// driverHealthChecks returns the checks of the driver, the lvm checks only run on the nodes
+func driverHealthChecks(endpoint string, client kubernetes.Interface, node bool) []healthCheck {
+	checks := []healthCheck{
+		{name: csiSocketCheck, liveness: true, check: func(ctx context.Context) error { return checkCSISocket(ctx, endpoint) }},
+		{name: "kube-apiserver", check: func(ctx context.Context) error { return checkAPIServer(ctx, client) }},
+	}
+	if node {
+		checks = append(checks,
+			healthCheck{name: "lvm", liveness: true, check: checkLvmCommands},
+			healthCheck{name: "vgs", check: checkVolumeGroups},
+		)
+	}
+	return checks
+}
+
+// runHealthChecks runs the liveness checks, or all the checks for the readiness
+func runHealthChecks(checks []healthCheck, readiness bool, skip string) (bool, []checkResult) {
+	healthy := true
+	results := []checkResult{}
+	for _, check := range checks {
+		if (!readiness && !check.liveness) || check.name == skip {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := check.check(ctx)
+		cancel()
+		result := checkResult{Name: check.name, OK: err == nil}
+		if err != nil {
+			healthy = false
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+	return healthy, results
+}
+
+// HealthHandler serves /healthz, or /readyz when readiness is set, with the detail of every check
+func HealthHandler(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		healthChecksMutex.Lock()
+		checks := append([]healthCheck{}, healthChecks...)
+		healthChecksMutex.Unlock()
+		healthy, results := runHealthChecks(checks, readiness, "")
+		report := healthReport{Status: "ok", Checks: results}
+		code := http.StatusOK
+		if !healthy {
+			report.Status = "failed"
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+// checkCSISocket checks that the csi endpoint answers
+func checkCSISocket(ctx context.Context, endpoint string) error {
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	target := addr
+	if proto == "unix" {
+		target = "unix:///" + strings.TrimPrefix(addr, "/")
+	}
+	conn, err := grpc.DialContext(ctx, target, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("dial %s: %v", endpoint, err)
+	}
+	defer conn.Close()
+	if _, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{}); err != nil {
+		return fmt.Errorf("GetPluginInfo: %v", err)
+	}
+	return nil
+}
+
+// checkAPIServer checks that the kube client reaches the api server
+func checkAPIServer(ctx context.Context, client kubernetes.Interface) error {
+	if client == nil {
+		return fmt.Errorf("no kube client")
+	}
+	return client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// checkLvmCommands checks that nsenter and the lvm binaries work
+func checkLvmCommands(ctx context.Context) error {
+	_, err := utils.RunContext(ctx, fmt.Sprintf("%s lvm version", NsenterCmd))
+	return err
+}
+
+// configuredVGs returns the vgs of VG_NAMES and of the storage pools of
+// the node annotation, the pools of STORAGE_POOLS are shared by all the
+// nodes and only advertised where a member exists.
+func configuredVGs() ([]string, error) {
+	vgNames := parseVGNames(os.Getenv(VGNames))
+	pools, annotated, err := nodeStoragePools()
+	if err != nil {
+		return nil, err
+	}
+	if !annotated {
+		return vgNames, nil
+	}
+	for _, members := range pools {
+		for _, member := range members {
+			vgName, _ := splitThinPool(member)
+			if !containsString(vgNames, vgName) {
+				vgNames = append(vgNames, vgName)
+			}
+		}
+	}
+	return vgNames, nil
+}
+
+// checkVolumeGroups checks that the configured vgs are visible and consistent
+func checkVolumeGroups(ctx context.Context) error {
+	vgNames, err := configuredVGs()
+	if err != nil {
+		return err
+	}
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s vgs --noheadings -o vg_name", NsenterCmd))
+	if err != nil {
+		return err
+	}
+	visible := map[string]bool{}
+	for _, vgName := range strings.Fields(out) {
+		visible[vgName] = true
+	}
+	for _, vgName := range vgNames {
+		if !visible[vgName] {
+			return fmt.Errorf("vg %s not found", vgName)
+		}
+		if _, err := utils.RunContext(ctx, fmt.Sprintf("%s vgck %s", NsenterCmd, utils.ShellQuote(vgName))); err != nil {
+			return fmt.Errorf("vgck %s: %v", vgName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	assert := assert.New(t)
+	checks := []healthCheck{
+		{name: "live", liveness: true, check: func(ctx context.Context) error { return nil }},
+		{name: "ready", check: func(ctx context.Context) error { return errors.New("api server unreachable") }},
+		{name: csiSocketCheck, liveness: true, check: func(ctx context.Context) error { return errors.New("no socket") }},
+	}
+
+	healthy, results := runHealthChecks(checks, false, csiSocketCheck)
+	assert.True(healthy)
+	assert.Equal([]checkResult{{Name: "live", OK: true}}, results)
+
+	healthy, results = runHealthChecks(checks, true, "")
+	assert.False(healthy)
+	assert.Equal(3, len(results))
+	assert.Equal(checkResult{Name: "ready", Message: "api server unreachable"}, results[1])
+
+	healthChecksMutex.Lock()
+	saved := healthChecks
+	healthChecks = checks[:2]
+	healthChecksMutex.Unlock()
+	defer func() { healthChecks = saved }()
+
+	recorder := httptest.NewRecorder()
+	HealthHandler(false)(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	HealthHandler(true)(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(http.StatusServiceUnavailable, recorder.Code)
+	report := healthReport{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal("failed", report.Status)
+	assert.Equal(2, len(report.Checks))
+}
+
+func TestConfiguredVGs(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv(VGNames, "vg1, vg-ssd1")
+	t.Setenv(StoragePools, "fast=vg-ssd1,vg-ssd2;bulk=vg-hdd/thinpool")
+	// the shared pools are not required on every node
+	vgNames, err := configuredVGs()
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"vg1", "vg-ssd1"}, vgNames)
+
+	defer setNodePoolsAnnotation("", false)
+	setNodePoolsAnnotation("fast=vg-ssd1,vg-ssd2;bulk=vg-hdd/thinpool", true)
+	vgNames, err = configuredVGs()
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"vg1", "vg-ssd1", "vg-ssd2", "vg-hdd"}, vgNames)
+
+	setNodePoolsAnnotation("fast", true)
+	_, err = configuredVGs()
+	assert.NotNil(err)
+}
+
+func TestCheckCSISocket(t *testing.T) {
+	assert := assert.New(t)
+	assert.NotNil(checkCSISocket(context.Background(), "tmp/csi.sock"))
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	assert.NotNil(checkCSISocket(ctx, "unix://tmp/missing/csi.sock"))
+}
+
+func TestCheckAPIServer(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major":"1","minor":"24"}`))
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.Nil(err)
+	assert.Nil(checkAPIServer(context.Background(), client))
+	assert.NotNil(checkAPIServer(context.Background(), nil))
+
+	// a hanging api server fails the check at the deadline
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	client, err = kubernetes.NewForConfig(&rest.Config{Host: hanging.URL})
+	assert.Nil(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.NotNil(checkAPIServer(ctx, client))
+	assert.Less(time.Since(start), 5*time.Second)
+}
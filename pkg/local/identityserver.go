@@ -18,6 +18,7 @@ package lvm
 
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
@@ -25,6 +26,8 @@ import (
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	// checks are the health checks of the driver, Probe reports their readiness
+	checks []healthCheck
 }
 
 // newIdentityServer create identity server
@@ -64,3 +67,15 @@ func (iden *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.
 	}
 	return resp, nil
 }
+
+// Probe reports the driver ready when its readiness checks pass
+func (iden *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	// the probe comes through the csi socket, no need to dial it
+	ready, results := runHealthChecks(iden.checks, true, csiSocketCheck)
+	for _, result := range results {
+		if !result.OK {
+			log.Warnf("Identity:Probe: check %s failed: %s", result.Name, result.Message)
+		}
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: ready}}, nil
+}
@@ -17,22 +17,29 @@ limitations under the License.
 package lvm
 
 import (
+	"os"
+	"sync"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
 	log "github.com/sirupsen/logrus"
 )
 
 // LVM the LVM struct
 type LVM struct {
+	name             string
 	driver           *csicommon.CSIDriver
 	endpoint         string
 	idServer         *identityServer
 	nodeServer       csi.NodeServer
 	controllerServer *controllerServer
+	server           *grpcServer
 }
 
 const (
-	driverName = "local.csi.ecloud.cmss.com"
 	csiVersion = "1.0.0"
 )
 
@@ -42,37 +49,93 @@ func initDriver() {
 }
 
 // NewDriver create the identity/node/controller server and disk driver
-func NewDriver(nodeID, endpoint string) *LVM {
+func NewDriver(nodeID string, opts *DriverOptions) *LVM {
 	initDriver()
+	registerDriver(opts)
+	if err := loadVDOMaxRatio(); err != nil {
+		log.Fatalf("NewDriver: %s", err.Error())
+	}
+	endpoint := opts.Endpoint
 	tmplvm := &LVM{}
+	tmplvm.name = opts.Name
 	tmplvm.endpoint = endpoint
+	tmplvm.server = newGRPCServer(opts.Name)
 
 	if nodeID == "" {
 		nodeID = GetMetaData(InstanceID)
 		log.Infof("Use node id : %s", nodeID)
 	}
-	csiDriver := csicommon.NewCSIDriver(driverName, csiVersion, nodeID)
+	metrics.Register(nodeID)
+	csiDriver := csicommon.NewCSIDriver(opts.Name, csiVersion, nodeID)
 	tmplvm.driver = csiDriver
 	tmplvm.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	})
 	tmplvm.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
 
 	// Create GRPC servers
 	tmplvm.idServer = newIdentityServer(tmplvm.driver)
-	tmplvm.nodeServer = NewNodeServer(tmplvm.driver, nodeID)
-	tmplvm.controllerServer = newControllerServer(tmplvm.driver)
+	tmplvm.nodeServer = NewNodeServer(tmplvm.driver, opts.Name, nodeID)
+	tmplvm.controllerServer = newControllerServer(tmplvm.driver, opts.Name)
+
+	// Check the csi socket, the kube api server and on the nodes lvm and the vgs
+	tmplvm.idServer.checks = driverHealthChecks(endpoint, tmplvm.controllerServer.client, os.Getenv(utils.ServiceType) != utils.ProvisionerService)
+	registerHealthChecks(tmplvm.idServer.checks...)
+
+	if ns, ok := tmplvm.nodeServer.(*nodeServer); ok && os.Getenv(utils.ServiceType) != utils.ProvisionerService {
+		registerNodeServer(ns)
+		// the node loops cover the volumes of all the driver instances, they run once
+		nodeLoopsOnce.Do(ns.startNodeLoops)
+	}
 
 	return tmplvm
 }
 
+// nodeLoopsOnce starts the node loops once for all the driver instances
+var nodeLoopsOnce sync.Once
+
+// startNodeLoops starts the background work of the node
+func (ns *nodeServer) startNodeLoops() {
+	// the storage pools of the node are advertised when it registers
+	if err := ns.refreshStoragePools(); err != nil {
+		log.Errorf("startNodeLoops: get storage pools of the node with error: %s", err.Error())
+	}
+	// Repair mounts and IO limits lost while the plugin was restarting
+	go ns.reconcileVolumes()
+	// Wipe and remove volumes whose persistent volume is deleted
+	go ns.reclaimVolumes()
+	// Advertise the free raw disks for device volumes
+	go ns.advertiseDevices()
+	// Report failed raid legs as volume condition and events
+	go ns.monitorRaidVolumes()
+	// Report the cache hit ratios of cached volumes
+	go ns.monitorCacheVolumes()
+	// Report the physical usage of vdo volumes
+	go ns.monitorVDOVolumes()
+	// Advertise the vg capacity for GetCapacity and the volume metrics
+	go ns.advertiseCapacity()
+	// Move the volumes whose claim requests another node
+	go ns.migrateVolumes()
+	// Back up the volumes to the s3 compatible object storage
+	go ns.backupVolumes()
+	// Receive the volumes migrated from other nodes
+	go ns.serveMigrationAgent()
+}
+
 // Run start a new server
 func (lvm *LVM) Run() {
-	log.Infof("Driver: %v ", driverName)
+	log.Infof("Driver: %v ", lvm.name)
+
+	lvm.server.Start(lvm.endpoint, lvm.idServer, lvm.controllerServer, lvm.nodeServer)
+	lvm.server.Wait()
+}
 
-	server := csicommon.NewNonBlockingGRPCServer()
-	server.Start(lvm.endpoint, lvm.idServer, lvm.controllerServer, lvm.nodeServer)
-	server.Wait()
+// Stop gracefully stops the csi services, waiting up to timeout for the
+// in-flight calls, and makes Run return.
+func (lvm *LVM) Stop(timeout time.Duration) {
+	log.Infof("Driver: %v stopping", lvm.name)
+	lvm.server.Stop(timeout)
 }
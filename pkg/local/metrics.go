@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ioLimitTags are the volume attributes of the io limits
+var ioLimitTags = []string{"readIOPS", "writeIOPS", "readBPS", "writeBPS"}
+
+// setVGMetrics sets the gauges of the volume groups of the node
+func setVGMetrics(vgs []volumeGroup) {
+	metrics.VGSizeBytes.Reset()
+	metrics.VGFreeBytes.Reset()
+	metrics.VGVolumes.Reset()
+	for _, vg := range vgs {
+		metrics.VGSizeBytes.WithLabelValues(vg.Name).Set(float64(vg.Size))
+		metrics.VGFreeBytes.WithLabelValues(vg.Name).Set(float64(vg.Free))
+		metrics.VGVolumes.WithLabelValues(vg.Name).Set(float64(len(vg.Volumes)))
+	}
+}
+
+// setVolumeMetrics sets the gauges of the volumes of the node, the driver
+// and the io limits come from their persistent volumes.
+func setVolumeMetrics(lvs []*logicalVolume, pvs []v1.PersistentVolume) {
+	attributes := map[string]map[string]string{}
+	drivers := map[string]string{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI != nil && isLocalDriver(pv.Spec.CSI.Driver) {
+			attributes[pv.Name] = pv.Spec.CSI.VolumeAttributes
+			drivers[pv.Name] = pv.Spec.CSI.Driver
+		}
+	}
+	metrics.VolumeCapacityBytes.Reset()
+	metrics.VolumeIOLimit.Reset()
+	for _, lv := range lvs {
+		if lv.IsVDOPool() || lv.IsSnapshot() {
+			continue
+		}
+		metrics.VolumeCapacityBytes.WithLabelValues(drivers[lv.Name], lv.Name, lv.VGName).Set(float64(lv.Size))
+		for _, tag := range ioLimitTags {
+			if limit, err := strconv.ParseFloat(attributes[lv.Name][tag], 64); err == nil {
+				metrics.VolumeIOLimit.WithLabelValues(drivers[lv.Name], lv.Name, tag).Set(limit)
+			}
+		}
+	}
+}
+
+// updateVolumeMetrics refreshes the volume gauges of the node
+func (ns *nodeServer) updateVolumeMetrics() error {
+	lvs, err := listLogicalVolumes(localDriverTags())
+	if err != nil {
+		return err
+	}
+	pvs, err := ns.client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list pvs: %v", err)
+	}
+	setVolumeMetrics(lvs, pvs.Items)
+	return nil
+}
+
+// setCacheMetrics sets the hit ratio gauges of the cached volumes, the
+// driver is the driver tag of their lvm volume.
+func setCacheMetrics(stats []cacheStats, lvs []*logicalVolume) {
+	drivers := map[string]string{}
+	for _, lv := range lvs {
+		for _, tag := range lv.Tags {
+			if isLocalDriver(tag) {
+				drivers[lv.Name] = tag
+			}
+		}
+	}
+	metrics.VolumeCacheHitRatio.Reset()
+	for _, volumeStats := range stats {
+		metrics.VolumeCacheHitRatio.WithLabelValues(drivers[volumeStats.Name], volumeStats.Name, "read").Set(hitRatio(volumeStats.ReadHits, volumeStats.ReadMisses) / 100)
+		metrics.VolumeCacheHitRatio.WithLabelValues(drivers[volumeStats.Name], volumeStats.Name, "write").Set(hitRatio(volumeStats.WriteHits, volumeStats.WriteMisses) / 100)
+	}
+}
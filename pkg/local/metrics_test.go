@@ -0,0 +1,62 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeMetrics(t *testing.T) {
+	assert := assert.New(t)
+	setVGMetrics([]volumeGroup{{Name: "vg1", Size: 100, Free: 40, Volumes: []string{"lvm-1", "lvm-2"}}})
+	lvs := []*logicalVolume{
+		{VGName: "vg1", Name: "lvm-1", Size: 10, Attr: "-wi-ao----"},
+		{VGName: "vg1", Name: "lvm-2_vpool", Size: 5, Attr: "dwi-------"},
+	}
+	pvs := []v1.PersistentVolume{{
+		ObjectMeta: metav1.ObjectMeta{Name: "lvm-1"},
+		Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{
+			Driver:           DefaultDriverName,
+			VolumeAttributes: map[string]string{"readIOPS": "2000", "writeBPS": "5000", "writeIOPS": "x"},
+		}}},
+	}}
+	setVolumeMetrics(lvs, pvs)
+
+	assert.Equal(40.0, testutil.ToFloat64(metrics.VGFreeBytes.WithLabelValues("vg1")))
+	assert.Equal(2.0, testutil.ToFloat64(metrics.VGVolumes.WithLabelValues("vg1")))
+	assert.Equal(10.0, testutil.ToFloat64(metrics.VolumeCapacityBytes.WithLabelValues(DefaultDriverName, "lvm-1", "vg1")))
+	assert.Equal(2000.0, testutil.ToFloat64(metrics.VolumeIOLimit.WithLabelValues(DefaultDriverName, "lvm-1", "readIOPS")))
+	assert.Equal(5000.0, testutil.ToFloat64(metrics.VolumeIOLimit.WithLabelValues(DefaultDriverName, "lvm-1", "writeBPS")))
+	// the invalid limit and the vdo pool are not set
+	assert.Equal(2, testutil.CollectAndCount(metrics.VolumeIOLimit))
+	assert.Equal(1, testutil.CollectAndCount(metrics.VolumeCapacityBytes))
+
+	// the cache hit ratio is labeled with the driver tag of the lvm volume
+	lvs[0].Tags = []string{DefaultDriverName, "wipe_none"}
+	setCacheMetrics([]cacheStats{{Name: "lvm-1", ReadHits: 90, ReadMisses: 10, WriteHits: 30, WriteMisses: 10}}, lvs)
+	assert.Equal(0.9, testutil.ToFloat64(metrics.VolumeCacheHitRatio.WithLabelValues(DefaultDriverName, "lvm-1", "read")))
+	assert.Equal(0.75, testutil.ToFloat64(metrics.VolumeCacheHitRatio.WithLabelValues(DefaultDriverName, "lvm-1", "write")))
+
+	assert.Equal("NodePublishVolume", rpcMethod("/csi.v1.Node/NodePublishVolume"))
+	assert.Equal("Probe", rpcMethod("Probe"))
+}
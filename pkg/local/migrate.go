@@ -0,0 +1,771 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// MigrateToAnnotation is the pvc annotation requesting to move the volume to the node
+	MigrateToAnnotation = "local.csi.ecloud.cmss.com/migrate-to"
+	// MigrationStatusAnnotation is the pvc annotation of the migration progress
+	MigrationStatusAnnotation = "local.csi.ecloud.cmss.com/migration-status"
+	// MigrationPort env, the port of the node agents receiving migrated volumes
+	MigrationPort = "MIGRATION_PORT"
+	// MigrationToken env, the token shared by the node agents, unset disables migration
+	MigrationToken = "MIGRATION_TOKEN"
+	// MigrationTLSCert env, the certificate file of the node agents, unset disables migration
+	MigrationTLSCert = "MIGRATION_TLS_CERT"
+	// MigrationTLSKey env, the private key file of the node agents, unset disables migration
+	MigrationTLSKey = "MIGRATION_TLS_KEY"
+	// MigrationTLSCA env, the ca file verifying the node agents, unset disables migration
+	MigrationTLSCA = "MIGRATION_TLS_CA"
+
+	// MigrationPending the volume waits for its pods to stop
+	MigrationPending = "Pending"
+	// MigrationRunning the volume is being copied
+	MigrationRunning = "Running"
+	// MigrationSucceeded the volume is on the target node
+	MigrationSucceeded = "Succeeded"
+	// MigrationFailed the migration is rolled back, remove the status to retry
+	MigrationFailed = "Failed"
+
+	// MigrationStartedReason event reason
+	MigrationStartedReason = "VolumeMigrationStarted"
+	// MigrationSucceededReason event reason
+	MigrationSucceededReason = "VolumeMigrationSucceeded"
+	// MigrationFailedReason event reason
+	MigrationFailedReason = "VolumeMigrationFailed"
+
+	// defaultMigrationPort is the node agent port when MIGRATION_PORT is not set
+	defaultMigrationPort = "11261"
+	// migrationServerName is the name the certificate of the node agents is
+	// issued for, the agents are reached by node address
+	migrationServerName = "csi-lvm-migration"
+	// migrationStateKind is the node state kind of the volumes migrating out
+	migrationStateKind = "migration"
+	// incomingStateKind is the node state kind of the volumes migrating in
+	incomingStateKind = "migration-in"
+	// migrationUIDHeader carries the uid of the persistent volume to the target node
+	migrationUIDHeader = "X-Volume-UID"
+	// migrationSnapshotSuffix is the name suffix of the snapshot copied to the target
+	migrationSnapshotSuffix = "_msnap"
+	// migrationInterval is the interval to look for migration requests
+	migrationInterval = time.Minute
+	// pvRecreateTimeout is how long to wait for the old persistent volume to go
+	pvRecreateTimeout = time.Minute
+	// incomingTimeout is how long an incoming volume waits for its persistent volume
+	incomingTimeout = time.Hour
+
+	// migration phases of the source node
+	phaseCopying   = "Copying"
+	phaseRebinding = "Rebinding"
+	phaseCompleted = "Completed"
+)
+
+// migrationState is a volume migrating out of the node
+type migrationState struct {
+	VolumeID string `json:"volumeID"`
+	VGName   string `json:"vgName"`
+	Target   string `json:"target"`
+	TargetVG string `json:"targetVG,omitempty"`
+	Phase    string `json:"phase"`
+	// PV is the original persistent volume, restored on rollback
+	PV        *v1.PersistentVolume `json:"pv"`
+	StartedAt time.Time            `json:"startedAt"`
+}
+
+// incomingState is a volume migrating into the node
+type incomingState struct {
+	VolumeID  string    `json:"volumeID"`
+	VGName    string    `json:"vgName"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// isVolumeMigrating checks whether the lvm volume is migrating in or out
+func isVolumeMigrating(volumeID string) bool {
+	return loadNodeState(migrationStateKind, volumeID, &migrationState{}) == nil ||
+		loadNodeState(incomingStateKind, volumeID, &incomingState{}) == nil
+}
+
+// setAgentToken authenticates the request to the node agent of another node
+func setAgentToken(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// agentAuthorized checks the token of a request to the node agent
+func agentAuthorized(r *http.Request) bool {
+	token := os.Getenv(MigrationToken)
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// agentPort returns the port of the node agents
+func agentPort() string {
+	if port := os.Getenv(MigrationPort); port != "" {
+		return port
+	}
+	return defaultMigrationPort
+}
+
+// migrationEnabled checks the token and the certificates of the node agents are set
+func migrationEnabled() error {
+	for _, env := range []string{MigrationToken, MigrationTLSCert, MigrationTLSKey, MigrationTLSCA} {
+		if os.Getenv(env) == "" {
+			return fmt.Errorf("%s is not set, migration is disabled", env)
+		}
+	}
+	return nil
+}
+
+// agentTLSConfig returns the mutual tls config of the node agents, they
+// share a certificate for migrationServerName issued by the ca, valid for
+// both server and client auth.
+func agentTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(os.Getenv(MigrationTLSCert), os.Getenv(MigrationTLSKey))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(os.Getenv(MigrationTLSCA))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", os.Getenv(MigrationTLSCA))
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ServerName:   migrationServerName,
+	}, nil
+}
+
+// agentClient returns the client of the node agents of other nodes
+func agentClient() (*http.Client, error) {
+	config, err := agentTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}, nil
+}
+
+// serveMigrationAgent serves the node agent receiving the volumes migrated
+// to the node, on its own mutual tls listener apart from the metrics.
+func (ns *nodeServer) serveMigrationAgent() {
+	if err := migrationEnabled(); err != nil {
+		log.Infof("serveMigrationAgent: %s", err.Error())
+		return
+	}
+	config, err := agentTLSConfig()
+	if err != nil {
+		log.Errorf("serveMigrationAgent: load the certificates with error: %s", err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/migrate/", ns.migrationHandler)
+	server := &http.Server{Addr: ":" + agentPort(), Handler: mux, TLSConfig: config}
+	log.Infof("serveMigrationAgent: listen on %s", server.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Errorf("serveMigrationAgent: serve with error: %s", err.Error())
+	}
+}
+
+// nodeAddress returns the internal address of the node
+func nodeAddress(node *v1.Node) (string, error) {
+	for _, addressType := range []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName} {
+		for _, address := range node.Status.Addresses {
+			if address.Type == addressType && address.Address != "" {
+				return address.Address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("node %s has no address", node.Name)
+}
+
+// migratedPV returns the persistent volume pinned to the target node, node
+// affinity is immutable so it replaces the original one.
+func migratedPV(pv *v1.PersistentVolume, target, targetVG string) *v1.PersistentVolume {
+	migrated := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+	for key, value := range pv.Annotations {
+		migrated.Annotations[key] = value
+	}
+	delete(migrated.Annotations, VGAnnotation)
+	if pv.Spec.CSI != nil && isMultiVG(pv.Spec.CSI.VolumeAttributes) {
+		migrated.Annotations[VGAnnotation] = targetVG
+	}
+	topologyKey := TopologyNodeKey
+	if pv.Spec.CSI != nil {
+		topologyKey = driverTopologyKey(pv.Spec.CSI.Driver)
+	}
+	migrated.Spec.NodeAffinity = &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+		MatchExpressions: []v1.NodeSelectorRequirement{{Key: topologyKey, Operator: v1.NodeSelectorOpIn, Values: []string{target}}},
+	}}}}
+	return migrated
+}
+
+// restoredPV returns the original persistent volume to create it again
+func restoredPV(pv *v1.PersistentVolume) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+}
+
+// migrationRequested returns the target node of the pvc, empty if it does not request a migration
+func migrationRequested(pvc *v1.PersistentVolumeClaim) string {
+	if strings.HasPrefix(pvc.Annotations[MigrationStatusAnnotation], MigrationFailed) {
+		return ""
+	}
+	return pvc.Annotations[MigrateToAnnotation]
+}
+
+// migrateVolumes moves the volumes of the node whose claim requests a
+// migration, and cleans up the volumes migrated in.
+func (ns *nodeServer) migrateVolumes() {
+	ns.resumeMigrations()
+	for {
+		ns.checkIncomingVolumes()
+		ns.startMigrations()
+		time.Sleep(migrationInterval)
+	}
+}
+
+// resumeMigrations completes or rolls back the migrations interrupted by a restart
+func (ns *nodeServer) resumeMigrations() {
+	names, err := listNodeStates(migrationStateKind)
+	if err != nil {
+		log.Errorf("resumeMigrations: list migration states with error: %s", err.Error())
+		return
+	}
+	for _, name := range names {
+		state := &migrationState{}
+		if err := loadNodeState(migrationStateKind, name, state); err != nil {
+			log.Errorf("resumeMigrations: load migration state %s with error: %s", name, err.Error())
+			continue
+		}
+		if state.Phase == phaseCompleted {
+			ns.finishMigration(state)
+		} else {
+			ns.rollbackMigration(state, "interrupted by a plugin restart")
+		}
+	}
+}
+
+func (ns *nodeServer) startMigrations() {
+	pvcs, err := ns.client.CoreV1().PersistentVolumeClaims("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("migrateVolumes: list pvcs with error: %s", err.Error())
+		return
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		target := migrationRequested(pvc)
+		if target == "" || target == ns.nodeID || pvc.Spec.VolumeName == "" {
+			continue
+		}
+		pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			log.Errorf("migrateVolumes: get pv %s with error: %s", pvc.Spec.VolumeName, err.Error())
+			continue
+		}
+		if pv.Spec.CSI == nil || !isLocalDriver(pv.Spec.CSI.Driver) || pvNodeName(pv) != ns.nodeID {
+			continue
+		}
+		ns.migrateVolume(pvc, pv, target)
+	}
+}
+
+// migrateVolume copies a snapshot of the offline volume to the target node,
+// recreates the persistent volume there and releases the source volume.
+func (ns *nodeServer) migrateVolume(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, target string) {
+	pvType := pv.Spec.CSI.VolumeAttributes[PvTypeTag]
+	if pvType == DeviceType || pvType == QuotaPathType {
+		ns.setMigrationStatus(pvc, MigrationFailed, fmt.Sprintf("pvType %s can not be migrated", pvType), false)
+		return
+	}
+	vgName, _ := splitThinPool(recordedVG(pv))
+	lvs, err := listLogicalVolumes(fmt.Sprintf("%s/%s", vgName, pv.Name))
+	if err != nil || len(lvs) == 0 {
+		ns.setMigrationStatus(pvc, MigrationFailed, fmt.Sprintf("lvm volume %s not found in vg %s", pv.Name, vgName), false)
+		return
+	}
+	lv := lvs[0]
+	if volumeInUse(lv) {
+		ns.setMigrationStatus(pvc, MigrationPending, "volume is in use, stop its pods to migrate it", false)
+		return
+	}
+	if err := migrationEnabled(); err != nil {
+		ns.setMigrationStatus(pvc, MigrationFailed, err.Error(), false)
+		return
+	}
+
+	state := &migrationState{
+		VolumeID:  pv.Name,
+		VGName:    vgName,
+		Target:    target,
+		Phase:     phaseCopying,
+		PV:        pv,
+		StartedAt: time.Now(),
+	}
+	if err := saveNodeState(migrationStateKind, state.VolumeID, state); err != nil {
+		log.Errorf("migrateVolume: save migration state of %s with error: %s", state.VolumeID, err.Error())
+		return
+	}
+	// NodePublishVolume refuses the volume from now on, a publish running
+	// meanwhile may have opened it since the first check.
+	if lvs, err := listLogicalVolumes(fmt.Sprintf("%s/%s", vgName, pv.Name)); err != nil || len(lvs) == 0 || volumeInUse(lvs[0]) {
+		if err := removeNodeState(migrationStateKind, state.VolumeID); err != nil {
+			log.Errorf("migrateVolume: remove migration state of %s with error: %s", state.VolumeID, err.Error())
+		}
+		ns.setMigrationStatus(pvc, MigrationPending, "volume is in use, stop its pods to migrate it", false)
+		return
+	}
+	message := fmt.Sprintf("migrating volume %s from node %s to node %s", pv.Name, ns.nodeID, target)
+	log.Infof("migrateVolume: %s", message)
+	ns.setMigrationStatus(pvc, MigrationRunning, message, false)
+	ns.claimEvent(pvc, v1.EventTypeNormal, MigrationStartedReason, message)
+
+	if err := ns.runMigration(state, lv); err != nil {
+		log.Errorf("migrateVolume: migrate volume %s to node %s with error: %s", state.VolumeID, target, err.Error())
+		ns.rollbackMigration(state, err.Error())
+		return
+	}
+	ns.finishMigration(state)
+}
+
+func (ns *nodeServer) runMigration(state *migrationState, lv *logicalVolume) error {
+	address, err := ns.targetAddress(state.Target)
+	if err != nil {
+		return err
+	}
+	snapshot := state.VolumeID + migrationSnapshotSuffix
+	if err := createSnapshot(lv, snapshot); err != nil {
+		return err
+	}
+	targetVG, err := sendVolume(address, state.PV, fmt.Sprintf("/dev/%s/%s", state.VGName, snapshot), lv.Size)
+	if err != nil {
+		return err
+	}
+
+	state.TargetVG = targetVG
+	state.Phase = phaseRebinding
+	if err := saveNodeState(migrationStateKind, state.VolumeID, state); err != nil {
+		return err
+	}
+	if err := ns.rebindVolume(state); err != nil {
+		return err
+	}
+	state.Phase = phaseCompleted
+	return saveNodeState(migrationStateKind, state.VolumeID, state)
+}
+
+// rebindVolume replaces the persistent volume by the one pinned to the
+// target node, the claim binds to it again by its claim reference.
+func (ns *nodeServer) rebindVolume(state *migrationState) error {
+	if err := ns.deletePV(state.VolumeID); err != nil {
+		return err
+	}
+	_, err := ns.client.CoreV1().PersistentVolumes().Create(context.Background(), migratedPV(state.PV, state.Target, state.TargetVG), metav1.CreateOptions{})
+	return err
+}
+
+// deletePV deletes the persistent volume bypassing its protection finalizer
+func (ns *nodeServer) deletePV(name string) error {
+	patch := []byte(`{"metadata":{"finalizers":null}}`)
+	if _, err := ns.client.CoreV1().PersistentVolumes().Patch(context.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := ns.client.CoreV1().PersistentVolumes().Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	for start := time.Now(); time.Since(start) < pvRecreateTimeout; time.Sleep(time.Second) {
+		_, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+	}
+	return fmt.Errorf("persistent volume %s is not deleted after %s", name, pvRecreateTimeout)
+}
+
+// finishMigration releases the source volume with its wipe policy
+func (ns *nodeServer) finishMigration(state *migrationState) {
+	removeMigrationSnapshot(state)
+	lvs, err := listLogicalVolumes(fmt.Sprintf("%s/%s", state.VGName, state.VolumeID))
+	if err != nil {
+		log.Errorf("finishMigration: list lvm volume %s with error: %s", state.VolumeID, err.Error())
+		return
+	}
+	for _, lv := range lvs {
+		if err := ns.releaseVolume(lv); err != nil {
+			log.Errorf("finishMigration: release lvm volume %s with error: %s", lv.DevicePath(), err.Error())
+			return
+		}
+	}
+	if err := removeNodeState(migrationStateKind, state.VolumeID); err != nil {
+		log.Errorf("finishMigration: remove migration state of %s with error: %s", state.VolumeID, err.Error())
+	}
+	message := fmt.Sprintf("volume %s migrated from node %s to node %s", state.VolumeID, ns.nodeID, state.Target)
+	log.Infof("finishMigration: %s", message)
+	pvc := ns.migrationClaim(state)
+	ns.setMigrationStatus(pvc, MigrationSucceeded, message, true)
+	ns.claimEvent(pvc, v1.EventTypeNormal, MigrationSucceededReason, message)
+}
+
+// rollbackMigration restores the persistent volume and removes the copy on the target
+func (ns *nodeServer) rollbackMigration(state *migrationState, reason string) {
+	if state.Phase == phaseRebinding {
+		pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), state.VolumeID, metav1.GetOptions{})
+		if err == nil && pvNodeName(pv) == state.Target {
+			// the persistent volume was recreated on the target before the failure
+			ns.finishMigration(state)
+			return
+		}
+		if apierrors.IsNotFound(err) {
+			if _, err := ns.client.CoreV1().PersistentVolumes().Create(context.Background(), restoredPV(state.PV), metav1.CreateOptions{}); err != nil {
+				log.Errorf("rollbackMigration: restore pv %s with error: %s, keep the migration state to retry", state.VolumeID, err.Error())
+				return
+			}
+		} else if err != nil {
+			log.Errorf("rollbackMigration: get pv %s with error: %s, keep the migration state to retry", state.VolumeID, err.Error())
+			return
+		}
+	}
+	if address, err := ns.targetAddress(state.Target); err == nil {
+		if err := dropRemoteVolume(address, state.PV); err != nil {
+			log.Errorf("rollbackMigration: remove the copy of %s on node %s with error: %s", state.VolumeID, state.Target, err.Error())
+		}
+	}
+	removeMigrationSnapshot(state)
+	if err := removeNodeState(migrationStateKind, state.VolumeID); err != nil {
+		log.Errorf("rollbackMigration: remove migration state of %s with error: %s", state.VolumeID, err.Error())
+	}
+	message := fmt.Sprintf("migration of volume %s to node %s rolled back: %s", state.VolumeID, state.Target, reason)
+	log.Warnf("rollbackMigration: %s", message)
+	pvc := ns.migrationClaim(state)
+	ns.setMigrationStatus(pvc, MigrationFailed, message, false)
+	ns.claimEvent(pvc, v1.EventTypeWarning, MigrationFailedReason, message)
+}
+
+func removeMigrationSnapshot(state *migrationState) {
+	if err := removeSnapshot(state.VGName, state.VolumeID+migrationSnapshotSuffix); err != nil {
+		log.Errorf("removeMigrationSnapshot: remove snapshot of %s with error: %s", state.VolumeID, err.Error())
+	}
+}
+
+// migrationClaim returns the claim of the migrated volume
+func (ns *nodeServer) migrationClaim(state *migrationState) *v1.PersistentVolumeClaim {
+	claimRef := state.PV.Spec.ClaimRef
+	if claimRef == nil {
+		return nil
+	}
+	pvc, err := ns.client.CoreV1().PersistentVolumeClaims(claimRef.Namespace).Get(context.Background(), claimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("migrationClaim: get pvc %s/%s with error: %s", claimRef.Namespace, claimRef.Name, err.Error())
+		return nil
+	}
+	return pvc
+}
+
+// setMigrationStatus records the migration status on the claim, the
+// request is removed once the migration succeeded.
+func (ns *nodeServer) setMigrationStatus(pvc *v1.PersistentVolumeClaim, phase, message string, done bool) {
+	if pvc == nil {
+		return
+	}
+	annotations := map[string]interface{}{MigrationStatusAnnotation: phase + ": " + message}
+	if done {
+		annotations[MigrateToAnnotation] = nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return
+	}
+	if _, err := ns.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(context.Background(), pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		log.Errorf("setMigrationStatus: patch pvc %s/%s with error: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
+
+func (ns *nodeServer) targetAddress(target string) (string, error) {
+	node, err := ns.client.CoreV1().Nodes().Get(context.Background(), target, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	address, err := nodeAddress(node)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(address, agentPort()), nil
+}
+
+// sendVolume streams the device to the node agent of the target, it returns
+// the vg the target created the volume in.
+func sendVolume(address string, pv *v1.PersistentVolume, devicePath string, size int64) (string, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	client, err := agentClient()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://%s/migrate/%s", address, pv.Name), io.LimitReader(f, size))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set(migrationUIDHeader, string(pv.UID))
+	setAgentToken(req, os.Getenv(MigrationToken))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("target node agent: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	result := &incomingState{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", err
+	}
+	return result.VGName, nil
+}
+
+// dropRemoteVolume asks the node agent of the target to remove its copy
+func dropRemoteVolume(address string, pv *v1.PersistentVolume) error {
+	client, err := agentClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("https://%s/migrate/%s", address, pv.Name), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(migrationUIDHeader, string(pv.UID))
+	setAgentToken(req, os.Getenv(MigrationToken))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("target node agent: %s", resp.Status)
+	}
+	return nil
+}
+
+// migrationHandler is the node agent receiving the volumes migrated to the node
+func (ns *nodeServer) migrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !agentAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	volumeID := strings.TrimPrefix(r.URL.Path, "/migrate/")
+	pv, err := ns.client.CoreV1().PersistentVolumes().Get(r.Context(), volumeID, metav1.GetOptions{})
+	if err != nil || string(pv.UID) != r.Header.Get(migrationUIDHeader) || pv.Spec.CSI == nil {
+		http.Error(w, fmt.Sprintf("unknown volume %s", volumeID), http.StatusForbidden)
+		return
+	}
+	// the handler is shared by the driver instances, the volume is created by its own
+	if ns = driverNodeServer(pv.Spec.CSI.Driver); ns == nil {
+		http.Error(w, fmt.Sprintf("unknown driver %s of volume %s", pv.Spec.CSI.Driver, volumeID), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		ns.receiveVolume(w, r, pv)
+	case http.MethodDelete:
+		ns.dropIncomingVolume(w, volumeID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// receiveVolume creates the volume on the node and writes the stream to it
+func (ns *nodeServer) receiveVolume(w http.ResponseWriter, r *http.Request, pv *v1.PersistentVolume) {
+	volumeID := pv.Name
+	pvc := ns.getVolumeClaim(volumeID)
+	if pvc == nil || migrationRequested(pvc) != ns.nodeID {
+		http.Error(w, fmt.Sprintf("volume %s is not migrating to node %s", volumeID, ns.nodeID), http.StatusForbidden)
+		return
+	}
+	if isVolumeMigrating(volumeID) {
+		http.Error(w, fmt.Sprintf("volume %s is already migrating", volumeID), http.StatusConflict)
+		return
+	}
+	if vgName, err := findVolumeVG(volumeID); err != nil || vgName != "" {
+		http.Error(w, fmt.Sprintf("volume %s already exists on node %s", volumeID, ns.nodeID), http.StatusConflict)
+		return
+	}
+
+	volumeContext := pv.Spec.CSI.VolumeAttributes
+	chosenVG := volumeContext[VgNameTag]
+	if isMultiVG(volumeContext) {
+		var err error
+		if chosenVG, err = ns.selectVolumeVG(volumeID, volumeContext); err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+	state := &incomingState{VolumeID: volumeID, VGName: chosenVG, StartedAt: time.Now()}
+	if err := saveNodeState(incomingStateKind, volumeID, state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ns.writeIncomingVolume(r, state, volumeContext); err != nil {
+		log.Errorf("receiveVolume: receive volume %s with error: %s", volumeID, err.Error())
+		if err := removeIncomingVolume(state); err != nil {
+			log.Errorf("receiveVolume: remove incomplete volume %s with error: %s", volumeID, err.Error())
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("receiveVolume: received volume %s into vg %s, %d bytes", volumeID, chosenVG, r.ContentLength)
+	writeExtenderResponse(w, state)
+}
+
+func (ns *nodeServer) writeIncomingVolume(r *http.Request, state *incomingState, volumeContext map[string]string) error {
+	vgName, thinPool := splitThinPool(state.VGName)
+	lvmType := volumeContext[LvmTypeTag]
+	if lvmType == "" {
+		lvmType = LinearType
+	}
+	if err := ns.createVolume(r.Context(), state.VolumeID, vgName, thinPool, volumeContext[PvTypeTag], lvmType, volumeContext); err != nil {
+		return err
+	}
+	lvs, err := listLogicalVolumes(fmt.Sprintf("%s/%s", vgName, state.VolumeID))
+	if err != nil || len(lvs) == 0 {
+		return fmt.Errorf("lvm volume %s/%s not found after create", vgName, state.VolumeID)
+	}
+	if r.ContentLength < 0 || r.ContentLength > lvs[0].Size {
+		return fmt.Errorf("volume of %d bytes does not fit lvm volume of %d bytes", r.ContentLength, lvs[0].Size)
+	}
+	f, err := os.OpenFile(lvs[0].DevicePath(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	written, err := io.Copy(f, r.Body)
+	if err != nil {
+		return err
+	}
+	if written != r.ContentLength {
+		return fmt.Errorf("received %d of %d bytes", written, r.ContentLength)
+	}
+	return f.Sync()
+}
+
+// dropIncomingVolume removes the copy of a rolled back migration
+func (ns *nodeServer) dropIncomingVolume(w http.ResponseWriter, volumeID string) {
+	state := &incomingState{}
+	if err := loadNodeState(incomingStateKind, volumeID, state); err != nil {
+		http.Error(w, fmt.Sprintf("volume %s is not migrating in", volumeID), http.StatusNotFound)
+		return
+	}
+	if err := removeIncomingVolume(state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("dropIncomingVolume: removed the copy of volume %s", volumeID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeIncomingVolume removes the volume migrating in and its state
+func removeIncomingVolume(state *incomingState) error {
+	vgName, _ := splitThinPool(state.VGName)
+	devicePath := fmt.Sprintf("/dev/%s/%s", vgName, state.VolumeID)
+	if _, err := utils.Run(fmt.Sprintf("%s lvs %s", NsenterCmd, devicePath)); err == nil {
+		if err := removeCache(state.VolumeID); err != nil {
+			return err
+		}
+		if _, err := utils.Run(fmt.Sprintf("%s lvremove -f %s", NsenterCmd, devicePath)); err != nil {
+			return err
+		}
+		if err := removeVDOPool(vgName, state.VolumeID); err != nil {
+			return err
+		}
+	}
+	clearVolumeCondition(state.VolumeID)
+	clearRaidHealth(state.VolumeID)
+	return removeNodeState(incomingStateKind, state.VolumeID)
+}
+
+// checkIncomingVolumes drops the incoming state once the persistent volume
+// is pinned to the node, and the copies left by a failed rollback.
+func (ns *nodeServer) checkIncomingVolumes() {
+	names, err := listNodeStates(incomingStateKind)
+	if err != nil {
+		log.Errorf("checkIncomingVolumes: list incoming states with error: %s", err.Error())
+		return
+	}
+	for _, name := range names {
+		state := &incomingState{}
+		if err := loadNodeState(incomingStateKind, name, state); err != nil {
+			continue
+		}
+		pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		switch {
+		case err == nil && pvNodeName(pv) == ns.nodeID:
+			log.Infof("checkIncomingVolumes: volume %s is migrated to the node", name)
+			_ = removeNodeState(incomingStateKind, name)
+		case err == nil:
+			if pvc := ns.getVolumeClaim(name); pvc == nil || migrationRequested(pvc) != ns.nodeID {
+				log.Warnf("checkIncomingVolumes: migration of volume %s is abandoned, remove its copy", name)
+				if err := removeIncomingVolume(state); err != nil {
+					log.Errorf("checkIncomingVolumes: remove volume %s with error: %s", name, err.Error())
+				}
+			}
+		case apierrors.IsNotFound(err) && time.Since(state.StartedAt) > incomingTimeout:
+			// the persistent volume is gone, the reclaimer removes the copy
+			_ = removeNodeState(incomingStateKind, name)
+		}
+	}
+}
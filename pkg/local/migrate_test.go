@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeAddress(t *testing.T) {
+	assert := assert.New(t)
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	_, err := nodeAddress(node)
+	assert.NotNil(err)
+
+	node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeHostName, Address: "node1"}}
+	address, err := nodeAddress(node)
+	assert.Nil(err)
+	assert.Equal("node1", address)
+
+	node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.1"})
+	address, _ = nodeAddress(node)
+	assert.Equal("10.0.0.1", address)
+}
+
+func TestAgentAuthorized(t *testing.T) {
+	assert := assert.New(t)
+	req := httptest.NewRequest(http.MethodPut, "/migrate/lvm-1", nil)
+	assert.False(agentAuthorized(req))
+
+	t.Setenv(MigrationToken, "secret")
+	assert.False(agentAuthorized(req))
+	setAgentToken(req, "guess")
+	assert.False(agentAuthorized(req))
+	setAgentToken(req, "secret")
+	assert.True(agentAuthorized(req))
+}
+
+func TestMigrationRequested(t *testing.T) {
+	assert := assert.New(t)
+	pvc := &v1.PersistentVolumeClaim{}
+	assert.Equal("", migrationRequested(pvc))
+	pvc.Annotations = map[string]string{MigrateToAnnotation: "node2"}
+	assert.Equal("node2", migrationRequested(pvc))
+	pvc.Annotations[MigrationStatusAnnotation] = MigrationPending + ": volume is in use"
+	assert.Equal("node2", migrationRequested(pvc))
+	pvc.Annotations[MigrationStatusAnnotation] = MigrationFailed + ": rolled back"
+	assert.Equal("", migrationRequested(pvc))
+}
+
+func TestMigratedPV(t *testing.T) {
+	assert := assert.New(t)
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "lvm-1",
+			UID:             "uid",
+			ResourceVersion: "10",
+			Finalizers:      []string{"kubernetes.io/pv-protection"},
+			Annotations:     map[string]string{VGAnnotation: "vg1", "pv.kubernetes.io/provisioned-by": DefaultDriverName},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "data"},
+			PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{
+				Driver:           DefaultDriverName,
+				VolumeHandle:     "lvm-1",
+				VolumeAttributes: map[string]string{VgNameTag: "vg1,vg2"},
+			}},
+			NodeAffinity: &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{Key: TopologyNodeKey, Operator: v1.NodeSelectorOpIn, Values: []string{"node1"}}},
+			}}}},
+		},
+	}
+
+	migrated := migratedPV(pv, "node2", "vg2")
+	assert.Equal("node2", pvNodeName(migrated))
+	assert.Equal("vg2", migrated.Annotations[VGAnnotation])
+	assert.Equal(DefaultDriverName, migrated.Annotations["pv.kubernetes.io/provisioned-by"])
+	assert.Equal("", string(migrated.UID))
+	assert.Equal("", migrated.ResourceVersion)
+	assert.Equal(0, len(migrated.Finalizers))
+	assert.Equal("data", migrated.Spec.ClaimRef.Name)
+	// the original is kept for the rollback
+	assert.Equal("node1", pvNodeName(pv))
+	assert.Equal("vg1", pv.Annotations[VGAnnotation])
+
+	pv.Spec.CSI.VolumeAttributes = map[string]string{VgNameTag: "vg1"}
+	migrated = migratedPV(pv, "node2", "vg1")
+	_, ok := migrated.Annotations[VGAnnotation]
+	assert.False(ok)
+
+	restored := restoredPV(pv)
+	assert.Equal("node1", pvNodeName(restored))
+	assert.Equal("", restored.ResourceVersion)
+}
+
+// writeAgentCerts writes a ca and an agent certificate issued by it
+func writeAgentCerts(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: migrationServerName},
+		DNSNames:              []string{migrationServerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	for name, data := range map[string][]byte{"ca.crt": certPEM, "tls.crt": certPEM, "tls.key": keyPEM} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAgentTLS(t *testing.T) {
+	assert := assert.New(t)
+	assert.NotNil(migrationEnabled())
+
+	dir := t.TempDir()
+	writeAgentCerts(t, dir)
+	t.Setenv(MigrationToken, "secret")
+	t.Setenv(MigrationTLSCert, filepath.Join(dir, "tls.crt"))
+	t.Setenv(MigrationTLSKey, filepath.Join(dir, "tls.key"))
+	t.Setenv(MigrationTLSCA, filepath.Join(dir, "ca.crt"))
+	assert.Nil(migrationEnabled())
+
+	config, err := agentTLSConfig()
+	assert.Nil(err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := agentClient()
+	assert.Nil(err)
+	resp, err := client.Get(server.URL)
+	if assert.Nil(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	// the agents refuse clients without a certificate of the ca
+	client = server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.RootCAs = config.RootCAs
+	client.Transport.(*http.Transport).TLSClientConfig.ServerName = migrationServerName
+	_, err = client.Get(server.URL)
+	assert.NotNil(err)
+}
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	volume "github.com/kata-containers/kata-containers/src/runtime/pkg/direct-volume"
@@ -35,10 +36,9 @@ import (
 	"google.golang.org/grpc/status"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/util/resizefs"
 	utilexec "k8s.io/utils/exec"
 	k8smount "k8s.io/utils/mount"
@@ -70,16 +70,18 @@ const (
 	// DefaultNA default NodeAffinity
 	DirectTag = "direct"
 	DefaultNA = "true"
-	// TopologyNodeKey tag
+	// TopologyNodeKey is the node topology key of the default driver
 	TopologyNodeKey = "topology.local.csi.ecloud.cmss.com/hostname"
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	driverName string
 	nodeID     string
 	mounter    utils.Mounter
 	client     kubernetes.Interface
 	k8smounter k8smount.Interface
+	recorder   record.EventRecorder
 	isDirect   bool
 }
 
@@ -89,7 +91,7 @@ var (
 )
 
 // NewNodeServer create a NodeServer object
-func NewNodeServer(d *csicommon.CSIDriver, nodeID string) csi.NodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, driverName, nodeID string) csi.NodeServer {
 	cfg, err := clientcmd.BuildConfigFromFlags(options.MasterURL, options.Kubeconfig)
 	if err != nil {
 		log.Fatalf("Error building kubeconfig: %s", err.Error())
@@ -102,14 +104,29 @@ func NewNodeServer(d *csicommon.CSIDriver, nodeID string) csi.NodeServer {
 
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		driverName:        driverName,
 		nodeID:            nodeID,
 		mounter:           utils.NewMounter(),
 		k8smounter:        k8smount.New(""),
 		client:            kubeClient,
+		recorder:          utils.NewEventRecorder(),
 		isDirect:          false,
 	}
 }
 
+// topologySegments returns the node segment and the segments of the
+// storage pools with a member on the node.
+func (ns *nodeServer) topologySegments() map[string]string {
+	segments := map[string]string{}
+	if vgs, err := listVolumeGroups(); err != nil {
+		log.Errorf("topologySegments: list vgs with error: %s", err.Error())
+	} else {
+		segments = poolTopology(availablePools(vgs))
+	}
+	segments[driverTopologyKey(ns.driverName)] = ns.nodeID
+	return segments
+}
+
 func (ns *nodeServer) GetNodeID() string {
 	return ns.nodeID
 }
@@ -135,8 +152,37 @@ func (ns *nodeServer) addDirectVolume(volumePath, device, fsType string) error {
 	return nil
 }
 
+// publishBlockVolume bind mounts the device at the target path file
+func (ns *nodeServer) publishBlockVolume(req *csi.NodePublishVolumeRequest, claim *volumeClaim, devicePath string) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	isMnt, err := ns.mounter.IsMounted(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if isMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if err := ns.mounter.EnsureBlock(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if err := ns.mounter.MountBlock(devicePath, targetPath, options...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := utils.SetVolumeIOLimit(devicePath, req); err != nil {
+		log.Errorf("NodePublishVolume: Set Block Volume(%s), req(%v) IO Limit with Error: %s", req.VolumeId, req.GetVolumeContext(), err.Error())
+		ns.volumeEvent(claim, req.GetVolumeContext(), v1.EventTypeWarning, IOLimitFailedReason, err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Infof("NodePublishVolume:: block mount successful devicePath: %s, targetPath: %s, options: %v", devicePath, targetPath, options)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	log.Infof("NodePublishVolume:: req, %v", req)
+	requestLog(ctx).Infof("NodePublishVolume:: volume %s, target %s", req.GetVolumeId(), req.GetTargetPath())
 	// Step 1: check
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
@@ -147,17 +193,37 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if targetPath == "" {
 		return nil, status.Error(codes.Internal, "targetPath is empty")
 	}
-	vgName := ""
-	if _, ok := req.VolumeContext[VgNameTag]; ok {
-		vgName = req.VolumeContext[VgNameTag]
+	// the volume is being copied to or from another node
+	if isVolumeMigrating(volumeID) {
+		return nil, status.Errorf(codes.Unavailable, "NodePublishVolume: volume %s is migrating", volumeID)
 	}
-	if vgName == "" {
-		return nil, status.Error(codes.Internal, "error with input vgName is empty")
+	// inline ephemeral volumes have no storage class, the driver defaults apply here
+	if isEphemeral(req.VolumeContext) {
+		if err := validateEphemeralVolume(ns.driverName, req.VolumeContext); err != nil {
+			log.Errorf("NodePublishVolume: invalid ephemeral volume %s: %s", volumeID, err.Error())
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		req.VolumeContext = driverParameters(ns.driverName, req.VolumeContext)
 	}
 	pvType := CloudDisk
 	if _, ok := req.VolumeContext[PvTypeTag]; ok {
 		pvType = req.VolumeContext[PvTypeTag]
 	}
+	// directory volumes limited by project quota
+	if pvType == QuotaPathType {
+		volumeContext := req.VolumeContext
+		if isEphemeral(volumeContext) {
+			volumeContext = ephemeralVolumeContext(volumeContext, targetPath)
+		}
+		return ns.publishQuotaPath(ctx, req, volumeContext)
+	}
+	vgName := ""
+	if _, ok := req.VolumeContext[VgNameTag]; ok {
+		vgName = req.VolumeContext[VgNameTag]
+	}
+	if vgName == "" && req.VolumeContext[VGSelectorTag] == "" && req.VolumeContext[PoolTag] == "" && pvType != DeviceType {
+		return nil, status.Error(codes.Internal, "error with input vgName is empty")
+	}
 	lvmType := LinearType
 	if _, ok := req.VolumeContext[LvmTypeTag]; ok {
 		lvmType = req.VolumeContext[LvmTypeTag]
@@ -166,11 +232,26 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if _, ok := req.VolumeContext[FsTypeTag]; ok {
 		fsType = req.VolumeContext[FsTypeTag]
 	}
-	nodeAffinity := DefaultNA
-	if _, ok := req.VolumeContext[NodeAffinity]; ok {
-		nodeAffinity = req.VolumeContext[NodeAffinity]
+	volumeContext := req.VolumeContext
+	ephemeral := isEphemeral(volumeContext)
+	if ephemeral {
+		volumeContext = ephemeralVolumeContext(volumeContext, targetPath)
+	}
+	// the events and the filesystem check share one lookup of the pvc
+	claim := &volumeClaim{ns: ns, volumeID: volumeID}
+	// the node chooses the vg among the candidates of the storageclass
+	vgRecorded := true
+	chosenVG, thinPool := "", ""
+	if pvType != DeviceType && isMultiVG(volumeContext) {
+		var err error
+		if chosenVG, vgRecorded, err = ns.chooseVG(req.GetVolumeId(), volumeContext); err != nil {
+			log.Errorf("NodePublishVolume: choose vg for volume %s with error: %s", req.GetVolumeId(), err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// storage pools may map to a thin pool of the vg
+		vgName, thinPool = splitThinPool(chosenVG)
 	}
-	log.Infof("NodePublishVolume: Starting to mount lvm at: %s, with vg: %s, with volume: %s, PV type: %s, LVM type: %s", targetPath, vgName, req.GetVolumeId(), pvType, lvmType)
+	log.Infof("NodePublishVolume: Starting to mount lvm at: %s, with vg: %s, with volume: %s, PV type: %s, LVM type: %s, ephemeral: %t", targetPath, vgName, req.GetVolumeId(), pvType, lvmType, ephemeral)
 
 	// check if the volume is a direct-assigned volume, direct volume will be used as virtio-blk
 	ns.isDirect = false
@@ -185,13 +266,77 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	volumeNewCreated := false
 	volumeID = req.GetVolumeId()
 	devicePath := filepath.Join("/dev/", vgName, volumeID)
-	if _, err := os.Stat(devicePath); os.IsNotExist(err) {
+	if pvType == DeviceType {
+		// the controller allocated a whole disk of this node, found by its
+		// stable identity as its kernel name may have changed
+		deviceID := volumeContext[DeviceIDTag]
+		if deviceID == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %s not provided for pvType %s", DeviceIDTag, DeviceType)
+		}
+		blockDevices, err := listBlockDevices()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if devicePath, err = claimDevice(volumeID, deviceID, volumeContext[WipePolicyTag], blockDevices); err != nil {
+			log.Errorf("NodePublishVolume: claim device %s for volume %s with error: %s", deviceID, volumeID, err.Error())
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	} else if _, err := os.Stat(devicePath); os.IsNotExist(err) {
 		volumeNewCreated = true
-		err := ns.createVolume(ctx, volumeID, vgName, pvType, lvmType)
+		if ephemeral {
+			state := &ephemeralState{
+				VolumeID:      volumeID,
+				VGName:        vgName,
+				VolumeContext: volumeContext,
+				ReadOnly:      req.GetReadonly(),
+				MountFlags:    req.GetVolumeCapability().GetMount().GetMountFlags(),
+			}
+			if err := saveNodeState(ephemeralStateKind, volumeID, state); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		err := ns.createVolume(ctx, volumeID, vgName, thinPool, pvType, lvmType, volumeContext)
 		if err != nil {
+			ns.volumeEvent(claim, volumeContext, v1.EventTypeWarning, createFailedReason(err), err.Error())
+			// report the failure so the controller releases its reservation
+			if !ephemeral {
+				recordCreateFailure(volumeID, volumeContext[ReservationTokenTag], time.Now())
+				if err := ns.updateCapacity(); err != nil {
+					log.Errorf("NodePublishVolume: update vg capacity with error: %s", err.Error())
+				}
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		clearCreateFailure(volumeID)
+		// report the new volume so the controller releases its reservation
+		if err := ns.updateCapacity(); err != nil {
+			log.Errorf("NodePublishVolume: update vg capacity with error: %s", err.Error())
+		}
+	}
+	if !vgRecorded && !ephemeral {
+		if err := ns.recordVG(volumeID, chosenVG); err != nil {
+			log.Errorf("NodePublishVolume: record vg %s of volume %s with error: %s", chosenVG, volumeID, err.Error())
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
+	// serve the lvm volume through its cache on the fast vg
+	if pvType != DeviceType && volumeContext[CacheVGTag] != "" {
+		cachedPath, err := activateCache(ctx, vgName, volumeID, volumeContext)
+		if err != nil {
+			log.Errorf("NodePublishVolume: activate cache of volume %s with error: %s", volumeID, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		devicePath = cachedPath
+	}
+	// populate the new volume from the backup its claim requests
+	restored := false
+	if (volumeNewCreated && !ephemeral) || isVolumeRestoring(volumeID) {
+		var err error
+		if restored, err = ns.restoreVolume(volumeID, devicePath); err != nil {
+			log.Infof("NodePublishVolume: %s", err.Error())
+			return nil, err
+		}
+	}
 
 	// Step 4: direct
 	if ns.isDirect {
@@ -204,6 +349,11 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	// raw block volumes expose the device itself
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return ns.publishBlockVolume(req, claim, devicePath)
+	}
+
 	isMnt, err := ns.mounter.IsMounted(targetPath)
 	if err != nil {
 		if _, err := os.Stat(targetPath); os.IsNotExist(err) {
@@ -216,15 +366,20 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
-	exitFSType, err := checkFSType(devicePath)
+	exitFSType, err := checkFSType(ctx, devicePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "check fs type err: %v", err)
 	}
 	if exitFSType == "" {
 		log.Printf("The device %v has no filesystem, starting format: %v", devicePath, fsType)
-		if err := formatDevice(devicePath, fsType); err != nil {
+		if err := formatDevice(ctx, devicePath, fsType); err != nil {
+			ns.volumeEvent(claim, volumeContext, v1.EventTypeWarning, FormatFailedReason, fmt.Sprintf("format %s as %s: %v", devicePath, fsType, err))
 			return nil, status.Errorf(codes.Internal, "format fstype failed: err=%v", err)
 		}
+	} else if !isMnt && !ephemeral {
+		if err := ns.checkVolumeFilesystem(ctx, claim, devicePath, exitFSType, req.VolumeContext); err != nil {
+			return nil, status.Errorf(codes.Internal, "check filesystem failed: err=%v", err)
+		}
 	}
 
 	if !isMnt {
@@ -246,60 +401,32 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		err = utils.SetVolumeIOLimit(devicePath, req)
 		if err != nil {
 			log.Errorf("NodePublishVolume: Set Disk Volume(%s), req(%v) IO Limit with Error: %s", req.VolumeId, req.GetVolumeContext(), err.Error())
+			ns.volumeEvent(claim, volumeContext, v1.EventTypeWarning, IOLimitFailedReason, err.Error())
 			return nil, status.Error(codes.Internal, err.Error())
 
 		}
 		log.Infof("NodePublishVolume:: mount successful devicePath: %s, targetPath: %s, options: %v", devicePath, targetPath, options)
 	}
 
-	// xfs filesystem works on targetpath.
-	if !volumeNewCreated {
-		if err := ns.resizeVolume(ctx, volumeID, vgName, targetPath); err != nil {
+	// the restored filesystem may be smaller than the new volume
+	if restored {
+		if err := ns.growFilesystem(ctx, devicePath, targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := finishRestore(volumeID); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
-	// upgrade PV with NodeAffinity
-	if nodeAffinity == "true" {
-		oldPv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), volumeID, metav1.GetOptions{})
+	// xfs filesystem works on targetpath.
+	if !volumeNewCreated && !ephemeral && pvType != DeviceType {
+		resized, err := ns.resizeVolume(ctx, volumeID, vgName, targetPath)
 		if err != nil {
-			log.Errorf("NodePublishVolume: Get Persistent Volume(%s) Error: %s", volumeID, err.Error())
+			ns.volumeEvent(claim, volumeContext, v1.EventTypeWarning, VolumeResizeFailedReason, err.Error())
 			return nil, status.Error(codes.Internal, err.Error())
 		}
-		if oldPv.Spec.NodeAffinity == nil {
-			oldData, err := json.Marshal(oldPv)
-			if err != nil {
-				log.Errorf("NodePublishVolume: Marshal Persistent Volume(%s) Error: %s", volumeID, err.Error())
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			pvClone := oldPv.DeepCopy()
-
-			// construct new persistent volume data
-			values := []string{ns.nodeID}
-			nSR := v1.NodeSelectorRequirement{Key: "kubernetes.io/hostname", Operator: v1.NodeSelectorOpIn, Values: values}
-			matchExpress := []v1.NodeSelectorRequirement{nSR}
-			nodeSelectorTerm := v1.NodeSelectorTerm{MatchExpressions: matchExpress}
-			nodeSelectorTerms := []v1.NodeSelectorTerm{nodeSelectorTerm}
-			required := v1.NodeSelector{NodeSelectorTerms: nodeSelectorTerms}
-			pvClone.Spec.NodeAffinity = &v1.VolumeNodeAffinity{Required: &required}
-			newData, err := json.Marshal(pvClone)
-			if err != nil {
-				log.Errorf("NodePublishVolume: Marshal New Persistent Volume(%s) Error: %s", volumeID, err.Error())
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, pvClone)
-			if err != nil {
-				log.Errorf("NodePublishVolume: CreateTwoWayMergePatch Volume(%s) Error: %s", volumeID, err.Error())
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-
-			// Upgrade PersistentVolume with NodeAffinity
-			_, err = ns.client.CoreV1().PersistentVolumes().Patch(context.Background(), volumeID, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{})
-			if err != nil {
-				log.Errorf("NodePublishVolume: Patch Volume(%s) Error: %s", volumeID, err.Error())
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			log.Infof("NodePublishVolume: upgrade Persistent Volume(%s) with nodeAffinity: %s", volumeID, ns.nodeID)
+		if resized {
+			ns.volumeEvent(claim, volumeContext, v1.EventTypeNormal, VolumeResizedReason, "lvm volume and filesystem expanded")
 		}
 	}
 
@@ -332,12 +459,20 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	if !isMnt {
-		return &csi.NodeUnpublishVolumeResponse{}, nil
+	if isMnt {
+		err = ns.mounter.Unmount(req.GetTargetPath())
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
-	err = ns.mounter.Unmount(req.GetTargetPath())
-	if err != nil {
+	// Step 3: ephemeral inline volumes live as long as the pod
+	if err := ns.removeEphemeralVolume(volumeID); err != nil {
+		log.Errorf("NodeUnpublishVolume: remove ephemeral volume %s with error: %s", volumeID, err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := removeEphemeralQuotaPath(volumeID); err != nil {
+		log.Errorf("NodeUnpublishVolume: remove ephemeral quota path %s with error: %s", volumeID, err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -368,16 +503,75 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 			},
 		},
 	}
+	nscap3 := &csi.NodeServiceCapability{
+		Type: &csi.NodeServiceCapability_Rpc{
+			Rpc: &csi.NodeServiceCapability_RPC{
+				Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+			},
+		},
+	}
+	nscap4 := &csi.NodeServiceCapability{
+		Type: &csi.NodeServiceCapability_Rpc{
+			Rpc: &csi.NodeServiceCapability_RPC{
+				Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+			},
+		},
+	}
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
-			nscap, nscap2,
+			nscap, nscap2, nscap3, nscap4,
 		},
 	}, nil
 }
 
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: Volume ID not provided")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: Volume Path not provided")
+	}
+	if !utils.IsFileExisting(volumePath) {
+		return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: Volume Path %s not found", volumePath)
+	}
+
+	// raw block volumes report the device size only
+	if fi, err := os.Stat(volumePath); err == nil && fi.Mode()&os.ModeDevice != 0 {
+		size, err := getBlockDeviceSize(volumePath)
+		if err != nil {
+			log.Errorf("NodeGetVolumeStats: Get Block Volume(%s) size at %s with error: %s", volumeID, volumePath, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage:           []*csi.VolumeUsage{{Total: size, Unit: csi.VolumeUsage_BYTES}},
+			VolumeCondition: getVolumeCondition(volumeID),
+		}, nil
+	}
+
+	response, err := utils.GetMetrics(volumePath)
+	if err != nil {
+		log.Errorf("NodeGetVolumeStats: Get Volume(%s) metrics at %s with error: %s", volumeID, volumePath, err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	response.VolumeCondition = getVolumeCondition(volumeID)
+	return response, nil
+}
+
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (
 	*csi.NodeExpandVolumeResponse, error) {
-	log.Infof("NodeExpandVolume: lvm node expand volume: %v", req)
+	requestLog(ctx).Infof("NodeExpandVolume:: volume %s to %d bytes", req.GetVolumeId(), req.GetCapacityRange().GetRequiredBytes())
+	// lvm volumes are extended on publish, quotapath volumes raise the quota online
+	sizeByte := req.GetCapacityRange().GetRequiredBytes()
+	isQuotaPath, err := expandQuotaPath(ctx, req.GetVolumeId(), sizeByte)
+	if err != nil {
+		log.Errorf("NodeExpandVolume: expand quota path %s with error: %s", req.GetVolumeId(), err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if isQuotaPath {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: sizeByte}, nil
+	}
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
@@ -386,57 +580,94 @@ func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 		NodeId: ns.nodeID,
 		// make sure that the driver works on this particular node only
 		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				TopologyNodeKey: ns.nodeID,
-			},
+			Segments: ns.topologySegments(),
 		},
 	}, nil
 }
 
-func (ns *nodeServer) resizeVolume(ctx context.Context, volumeID, vgName, targetPath string) error {
+// contextExec runs the commands of the mount utilities, e.g. the
+// filesystem resizers, until the context of the csi call is done.
+type contextExec struct {
+	utilexec.Interface
+	ctx context.Context
+}
+
+// Command returns the command bounded by the context
+func (e contextExec) Command(cmd string, args ...string) utilexec.Cmd {
+	return e.CommandContext(e.ctx, cmd, args...)
+}
+
+// resizeVolume extends the lvm volume and its filesystem to the persistent
+// volume size, it returns whether the volume was expanded.
+func (ns *nodeServer) resizeVolume(ctx context.Context, volumeID, vgName, targetPath string) (bool, error) {
 	pvSize, pvSizeByte, unit := ns.getPvSize(volumeID)
 	devicePath := filepath.Join("/dev", vgName, volumeID)
 	sizeCmd := fmt.Sprintf("%s lvdisplay --units B %s 2>&1 | grep 'LV Size' | awk '{print $3}'", NsenterCmd, devicePath)
-	sizeStr, err := utils.Run(sizeCmd)
+	sizeStr, err := utils.RunContext(ctx, sizeCmd)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if sizeStr == "" {
-		return status.Error(codes.Internal, "Get lvm size error")
+		return false, status.Error(codes.Internal, "Get lvm size error")
 	}
 	sizeStr = strings.Split(sizeStr, ".")[0]
 	sizeInt, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 10, 64)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// if lvmsize equal/bigger than pv size, no do expand.
 	if sizeInt >= pvSizeByte {
-		return nil
+		return false, nil
 	}
 	log.Infof("NodeExpandVolume:: volumeId: %s, devicePath: %s, from size: %d, to Size: %d%s", volumeID, devicePath, sizeInt, pvSize, unit)
 
+	// grow the vdo pool with the volume
+	isVDO, err := isVDOVolume(ctx, devicePath)
+	if err != nil {
+		return false, err
+	}
+	if isVDO {
+		if err := extendVDOPool(ctx, vgName, volumeID, sizeInt, pvSizeByte); err != nil {
+			return false, err
+		}
+	}
+
+	// keep the stripe geometry of striped volumes
+	stripeArgs, err := getStripeExtendArgs(ctx, devicePath)
+	if err != nil {
+		return false, err
+	}
+
 	// resize lvm volume
 	// lvextend -L3G /dev/vgtest/lvm-5db74864-ea6b-11e9-a442-00163e07fb69
-	resizeCmd := fmt.Sprintf("%s lvextend -L%d%s %s", NsenterCmd, pvSize, unit, devicePath)
-	_, err = utils.Run(resizeCmd)
+	resizeCmd := fmt.Sprintf("%s lvextend %s -L%d%s %s", NsenterCmd, stripeArgs, pvSize, unit, devicePath)
+	_, err = utils.RunContext(ctx, resizeCmd)
 	if err != nil {
-		return err
+		return false, err
+	}
+	// the cache device of a cached volume grows with its origin and holds the filesystem
+	cached, err := resizeCache(ctx, vgName, volumeID)
+	if err != nil {
+		return false, err
+	}
+	if cached {
+		devicePath = cachedDevicePath(volumeID)
 	}
 
 	// use resizer to expand volume filesystem
-	resizer := resizefs.NewResizeFs(&k8smount.SafeFormatAndMount{Interface: ns.k8smounter, Exec: utilexec.New()})
+	resizer := resizefs.NewResizeFs(&k8smount.SafeFormatAndMount{Interface: ns.k8smounter, Exec: contextExec{Interface: utilexec.New(), ctx: ctx}})
 	ok, err := resizer.Resize(devicePath, targetPath)
 	if err != nil {
 		log.Errorf("NodeExpandVolume:: Resize Error, volumeId: %s, devicePath: %s, volumePath: %s, err: %s", volumeID, devicePath, targetPath, err.Error())
-		return err
+		return false, err
 	}
 	if !ok {
 		log.Errorf("NodeExpandVolume:: Resize failed, volumeId: %s, devicePath: %s, volumePath: %s", volumeID, devicePath, targetPath)
-		return status.Error(codes.Internal, "Fail to resize volume fs")
+		return false, status.Error(codes.Internal, "Fail to resize volume fs")
 	}
 	log.Infof("NodeExpandVolume:: resizefs successful volumeId: %s, devicePath: %s, volumePath: %s", volumeID, devicePath, targetPath)
-	return nil
+	return true, nil
 }
 
 func (ns *nodeServer) getPvSize(volumeID string) (int64, int64, string) {
@@ -447,52 +678,146 @@ func (ns *nodeServer) getPvSize(volumeID string) (int64, int64, string) {
 	}
 	pvQuantity := pv.Spec.Capacity["storage"]
 	pvSizeByte := pvQuantity.Value()
-	pvSize := pvSizeByte
-	pvSizeGB := pvSize / (1024 * 1024 * 1024)
+	pvSize, unit := convertSize(pvSizeByte)
+	return pvSize, pvSizeByte, unit
+}
 
-	if pvSizeGB == 0 {
-		pvSizeMB := pvSize / (1024 * 1024)
-		return pvSizeMB, pvSizeByte, "m"
+// convertSize converts bytes to the lvm size and unit
+func convertSize(sizeByte int64) (int64, string) {
+	sizeGB := sizeByte / (1024 * 1024 * 1024)
+	if sizeGB == 0 {
+		return sizeByte / (1024 * 1024), "m"
 	}
-	return pvSizeGB, pvSizeByte, "g"
+	return sizeGB, "g"
 }
 
-// create lvm volume
-func (ns *nodeServer) createVolume(ctx context.Context, volumeID, vgName, pvType, lvmType string) error {
+// getVolumeSize returns the size of the volume to create, from the size
+// attribute of ephemeral inline volumes or from the persistent volume.
+func (ns *nodeServer) getVolumeSize(volumeID string, volumeContext map[string]string) (int64, string, error) {
+	if isEphemeral(volumeContext) {
+		sizeByte, err := ephemeralVolumeSize(volumeContext)
+		if err != nil {
+			return 0, "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		size, unit := convertSize(sizeByte)
+		return size, unit, nil
+	}
 	pvSize, _, unit := ns.getPvSize(volumeID)
+	return pvSize, unit, nil
+}
+
+// create lvm volume
+func (ns *nodeServer) createVolume(ctx context.Context, volumeID, vgName, thinPool, pvType, lvmType string, volumeContext map[string]string) error {
+	pvSize, unit, err := ns.getVolumeSize(volumeID, volumeContext)
+	if err != nil {
+		return err
+	}
+	// the names and tags reach the shell of the lvm commands
+	for _, name := range []string{volumeID, vgName, thinPool, volumeContext[PodUIDTag]} {
+		if name != "" && !lvmNamePattern.MatchString(name) {
+			return status.Errorf(codes.InvalidArgument, "invalid lvm name %q", name)
+		}
+	}
+	if err := validateWipePolicy(volumeContext[WipePolicyTag]); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	pvNumber := 0
-	var err error
 	// Create VG if vg not exist,
 	if pvType == LocalDisk {
-		if pvNumber, err = createVG(vgName); err != nil {
+		if _, err = createVG(ctx, vgName); err != nil {
 			return err
 		}
 	}
 
 	// check vg exist
 	ckCmd := fmt.Sprintf("%s vgck %s", NsenterCmd, vgName)
-	_, err = utils.Run(ckCmd)
+	_, err = utils.RunContext(ctx, ckCmd)
 	if err != nil {
 		log.Errorf("createVolume:: VG is not exist: %s", vgName)
 		return err
 	}
 
+	// tag the volume to reclaim it after the persistent volume is deleted
+	tags := volumeTags(ns.driverName, volumeContext)
+
 	// Create lvm volume
-	if lvmType == StripingType {
-		cmd := fmt.Sprintf("%s lvcreate -i %d -n %s -L %d%s %s", NsenterCmd, pvNumber, volumeID, pvSize, unit, vgName)
-		_, err = utils.Run(cmd)
+	if thinPool != "" {
+		// thin volumes of a storage pool, only linear and without cache
+		if lvmType != LinearType || volumeContext[CacheVGTag] != "" {
+			return status.Errorf(codes.InvalidArgument, "thin pool %s/%s only serves %s volumes without %s", vgName, thinPool, LinearType, CacheVGTag)
+		}
+		cmd := fmt.Sprintf("%s lvcreate -T %s/%s -n %s -V %d%s %s", NsenterCmd, vgName, thinPool, volumeID, pvSize, unit, tags)
+		_, err = utils.RunContext(ctx, cmd)
 		if err != nil {
 			return err
 		}
-		log.Infof("Successful Create Striping LVM volume: %s, Size: %d%s, vgName: %s, striped number: %d", volumeID, pvSize, unit, vgName, pvNumber)
+		log.Infof("Successful Create Thin LVM volume: %s, Size: %d%s, thin pool: %s/%s", volumeID, pvSize, unit, vgName, thinPool)
+	} else if lvmType == StripingType {
+		pvFree, err := listPVFree(ctx, vgName)
+		if err != nil {
+			return err
+		}
+		stripeArgs, err := stripeCreateArgs(volumeContext, pvFree, sizeToBytes(pvSize, unit))
+		if err != nil {
+			log.Errorf("createVolume:: invalid stripe geometry for vg %s: %s", vgName, err.Error())
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		cmd := fmt.Sprintf("%s lvcreate %s -n %s -L %d%s %s %s", NsenterCmd, stripeArgs, volumeID, pvSize, unit, tags, vgName)
+		_, err = utils.RunContext(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		log.Infof("Successful Create Striping LVM volume: %s, Size: %d%s, vgName: %s, stripes: %s", volumeID, pvSize, unit, vgName, stripeArgs)
 	} else if lvmType == LinearType {
-		cmd := fmt.Sprintf("%s lvcreate -n %s -L %d%s %s", NsenterCmd, volumeID, pvSize, unit, vgName)
-		_, err = utils.Run(cmd)
+		cmd := fmt.Sprintf("%s lvcreate -n %s -L %d%s %s %s", NsenterCmd, volumeID, pvSize, unit, tags, vgName)
+		_, err = utils.RunContext(ctx, cmd)
 		if err != nil {
 			return err
 		}
 		log.Infof("Successful Create Linear LVM volume: %s, Size: %d%s, vgName: %s", volumeID, pvSize, unit, vgName)
+	} else if isRaidType(lvmType) {
+		pvCount, err := getVGPVCount(ctx, vgName)
+		if err != nil {
+			return err
+		}
+		raidArgs, err := raidCreateArgs(lvmType, volumeContext, pvCount)
+		if err != nil {
+			log.Errorf("createVolume:: invalid raid geometry for vg %s: %s", vgName, err.Error())
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		cmd := fmt.Sprintf("%s lvcreate %s -n %s -L %d%s %s %s", NsenterCmd, raidArgs, volumeID, pvSize, unit, tags, vgName)
+		_, err = utils.RunContext(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		log.Infof("Successful Create Raid LVM volume: %s, Size: %d%s, vgName: %s, raid: %s", volumeID, pvSize, unit, vgName, raidArgs)
+	} else if lvmType == VDOType {
+		cmd, err := vdoCreateCmd(vgName, volumeID, pvSize, unit, tags, volumeContext)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		_, err = utils.RunContext(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		log.Infof("Successful Create VDO LVM volume: %s, Size: %d%s, vgName: %s", volumeID, pvSize, unit, vgName)
+	} else {
+		return status.Errorf(codes.InvalidArgument, "unknown %s %q", LvmTypeTag, lvmType)
 	}
 	return nil
 }
+
+// volumeTags returns the lvcreate tag arguments of a volume of the driver
+func volumeTags(driverName string, volumeContext map[string]string) string {
+	wipePolicy := volumeContext[WipePolicyTag]
+	if wipePolicy == "" {
+		wipePolicy = WipePolicyNone
+	}
+	tags := fmt.Sprintf("--addtag %s --addtag %s%s", driverName, wipeTagPrefix, wipePolicy)
+	if isEphemeral(volumeContext) {
+		for _, tag := range utils.EphemeralLVTags(volumeContext[PodUIDTag]) {
+			tags = fmt.Sprintf("%s --addtag %s", tags, tag)
+		}
+	}
+	return tags
+}
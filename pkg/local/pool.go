@@ -0,0 +1,209 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PoolTag is the storageclass parameter of the storage pool, used
+	// instead of vgName so nodes may name their vgs differently
+	PoolTag = "pool"
+	// StoragePools env of the node plugin, the vgs or thin pools of every
+	// storage pool, e.g. "fast=vg-ssd1,vg-ssd2;bulk=vg-hdd/thinpool"
+	StoragePools = "STORAGE_POOLS"
+	// StoragePoolsAnnotation is the node annotation of the storage pools of
+	// the node, in the format of STORAGE_POOLS which it overrides
+	StoragePoolsAnnotation = "local.csi.ecloud.cmss.com/storage-pools"
+	// PoolTopologyKeyPrefix is the prefix of the topology segment advertising a storage pool of the node
+	PoolTopologyKeyPrefix = "pool.local.csi.ecloud.cmss.com/"
+)
+
+// parseStoragePools parses the storage pools of the node, every member is
+// a vg or a vg/thinpool.
+func parseStoragePools(value string) (map[string][]string, error) {
+	pools := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, members, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("storage pool %q must be name=vg[,vg/thinpool...]", entry)
+		}
+		if _, exists := pools[name]; exists {
+			return nil, fmt.Errorf("storage pool %q is declared twice", name)
+		}
+		for _, member := range parseVGNames(members) {
+			if parts := strings.Split(member, "/"); len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+				return nil, fmt.Errorf("storage pool %q member %q must be vg or vg/thinpool", name, member)
+			}
+			pools[name] = append(pools[name], member)
+		}
+		if len(pools[name]) == 0 {
+			return nil, fmt.Errorf("storage pool %q has no vg", name)
+		}
+	}
+	return pools, nil
+}
+
+var (
+	// nodePoolsAnnotation the storage pools annotation of the node
+	nodePoolsAnnotation string
+	// nodePoolsAnnotated whether the node has the storage pools annotation
+	nodePoolsAnnotated bool
+	// nodePoolsMutex Mutex for the storage pools annotation
+	nodePoolsMutex sync.RWMutex
+)
+
+// setNodePoolsAnnotation records the storage pools annotation of the node
+func setNodePoolsAnnotation(value string, annotated bool) {
+	nodePoolsMutex.Lock()
+	defer nodePoolsMutex.Unlock()
+	nodePoolsAnnotation, nodePoolsAnnotated = value, annotated
+}
+
+// refreshStoragePools reads the storage pools annotation of the node
+func (ns *nodeServer) refreshStoragePools() error {
+	node, err := ns.client.CoreV1().Nodes().Get(context.Background(), ns.nodeID, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	value, annotated := node.Annotations[StoragePoolsAnnotation]
+	setNodePoolsAnnotation(value, annotated)
+	return nil
+}
+
+// nodeStoragePools returns the storage pools configured for the node by
+// its annotation, or else by STORAGE_POOLS shared by all the nodes, and
+// whether the annotation configured them.
+func nodeStoragePools() (map[string][]string, bool, error) {
+	nodePoolsMutex.RLock()
+	value, annotated := nodePoolsAnnotation, nodePoolsAnnotated
+	nodePoolsMutex.RUnlock()
+	source := StoragePoolsAnnotation
+	if !annotated {
+		value, source = os.Getenv(StoragePools), StoragePools
+	}
+	pools, err := parseStoragePools(value)
+	if err != nil {
+		return map[string][]string{}, annotated, fmt.Errorf("invalid %s: %v", source, err)
+	}
+	return pools, annotated, nil
+}
+
+// availablePools returns the storage pools with a member on the node
+func availablePools(vgs []volumeGroup) map[string][]string {
+	pools := map[string][]string{}
+	for _, vg := range vgs {
+		for _, name := range vg.Pools {
+			pools[name] = append(pools[name], vg.Name)
+		}
+	}
+	return pools
+}
+
+// poolTopology returns the topology segments of the storage pools of the node
+func poolTopology(pools map[string][]string) map[string]string {
+	segments := map[string]string{}
+	for name := range pools {
+		segments[PoolTopologyKeyPrefix+name] = "true"
+	}
+	return segments
+}
+
+// splitThinPool splits a vg/thinpool pool member, thinpool is empty for a vg
+func splitThinPool(member string) (string, string) {
+	vgName, thinPool, _ := strings.Cut(member, "/")
+	return vgName, thinPool
+}
+
+// applyStoragePools marks the vgs with their storage pools and adds an
+// entry for every thin pool member, thin pools only serve pool volumes.
+func applyStoragePools(vgs []volumeGroup, pools map[string][]string, thinFree func(member string) (int64, int64, error)) []volumeGroup {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, member := range pools[name] {
+			found := false
+			for i := range vgs {
+				if vgs[i].Name == member {
+					vgs[i].Pools = append(vgs[i].Pools, name)
+					found = true
+				}
+			}
+			vgName, thinPool := splitThinPool(member)
+			if found || thinPool == "" {
+				continue
+			}
+			size, free, err := thinFree(member)
+			if err != nil {
+				log.Errorf("applyStoragePools: get thin pool %s of storage pool %s with error: %s", member, name, err.Error())
+				continue
+			}
+			thin := volumeGroup{Name: member, Size: size, Free: free, Pools: []string{name}}
+			for _, vg := range vgs {
+				if vg.Name == vgName {
+					thin.Tags = vg.Tags
+					thin.Volumes = vg.Volumes
+				}
+			}
+			vgs = append(vgs, thin)
+		}
+	}
+	return vgs
+}
+
+// getThinPoolFree returns the size and free bytes of the thin pool
+func getThinPoolFree(member string) (int64, int64, error) {
+	out, err := utils.Run(fmt.Sprintf("%s lvs --noheadings --units b --nosuffix --separator '|' -o lv_size,data_percent %s", NsenterCmd, member))
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseThinPoolFree(out)
+}
+
+// parseThinPoolFree parses the output of lvs -o lv_size,data_percent
+func parseThinPoolFree(out string) (int64, int64, error) {
+	fields := strings.Split(strings.TrimSpace(out), "|")
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("unexpected thin pool output %q", out)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	dataPercent, _ := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	return size, int64(float64(size) * (100 - dataPercent) / 100), nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStoragePools(t *testing.T) {
+	assert := assert.New(t)
+	pools, err := parseStoragePools(" fast=vg-ssd1, vg-ssd2; bulk=vg-hdd/thinpool ;")
+	assert.Nil(err)
+	assert.Equal(map[string][]string{"fast": {"vg-ssd1", "vg-ssd2"}, "bulk": {"vg-hdd/thinpool"}}, pools)
+	pools, err = parseStoragePools("")
+	assert.Nil(err)
+	assert.Equal(0, len(pools))
+
+	for _, value := range []string{"fast", "=vg1", "fast=", "fast=vg1;fast=vg2", "fast=vg1/a/b", "fast=/thin", "fast=vg1/"} {
+		_, err = parseStoragePools(value)
+		assert.NotNil(err, value)
+	}
+
+	assert.Equal(map[string]string{PoolTopologyKeyPrefix + "fast": "true"}, poolTopology(map[string][]string{"fast": {"vg1"}}))
+	vgName, thinPool := splitThinPool("vg-hdd/thinpool")
+	assert.Equal("vg-hdd", vgName)
+	assert.Equal("thinpool", thinPool)
+	vgName, thinPool = splitThinPool("vg-hdd")
+	assert.Equal("vg-hdd", vgName)
+	assert.Equal("", thinPool)
+}
+
+func TestApplyStoragePools(t *testing.T) {
+	assert := assert.New(t)
+	thinFree := func(member string) (int64, int64, error) {
+		if member == "vg-hdd/missing" {
+			return 0, 0, fmt.Errorf("not found")
+		}
+		return 100, 40, nil
+	}
+	vgs := []volumeGroup{{Name: "vg-ssd1", Size: 100, Free: 50}, {Name: "vg-hdd", Size: 500, Free: 10, Tags: []string{"tier=hdd"}}}
+	pools := map[string][]string{"fast": {"vg-ssd1"}, "bulk": {"vg-hdd/thinpool", "vg-hdd/missing"}}
+	vgs = applyStoragePools(vgs, pools, thinFree)
+	assert.Equal(3, len(vgs))
+	assert.Equal([]string{"fast"}, vgs[0].Pools)
+	assert.Equal(volumeGroup{Name: "vg-hdd/thinpool", Size: 100, Free: 40, Tags: []string{"tier=hdd"}, Pools: []string{"bulk"}}, vgs[2])
+
+	// the missing thin pool is not advertised
+	assert.Equal(map[string][]string{"fast": {"vg-ssd1"}, "bulk": {"vg-hdd/thinpool"}}, availablePools(vgs))
+	assert.Equal(map[string][]string{}, availablePools(vgs[:1][:0]))
+
+	matched, err := matchVGs(vgs, map[string]string{PoolTag: "bulk"})
+	assert.Nil(err)
+	assert.Equal(1, len(matched))
+	assert.Equal("vg-hdd/thinpool", matched[0].Name)
+	// thin pools only serve their storage pool
+	matched, err = matchVGs(vgs, map[string]string{VGSelectorTag: "tier=hdd"})
+	assert.Nil(err)
+	assert.Equal(1, len(matched))
+	assert.Equal("vg-hdd", matched[0].Name)
+
+	assert.NotNil(validateVGSelection(map[string]string{PoolTag: "fast", VgNameTag: "vg1"}))
+	assert.True(isMultiVG(map[string]string{PoolTag: "fast"}))
+}
+
+func TestParseThinPoolFree(t *testing.T) {
+	assert := assert.New(t)
+	size, free, err := parseThinPoolFree("  1073741824|25.00\n")
+	assert.Nil(err)
+	assert.Equal(int64(1073741824), size)
+	assert.Equal(int64(805306368), free)
+	_, _, err = parseThinPoolFree("")
+	assert.NotNil(err)
+}
+
+func TestNodeStoragePools(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv(StoragePools, "fast=vg-ssd1")
+	pools, annotated, err := nodeStoragePools()
+	assert.Nil(err)
+	assert.False(annotated)
+	assert.Equal(map[string][]string{"fast": {"vg-ssd1"}}, pools)
+
+	// the node annotation overrides the shared pools
+	defer setNodePoolsAnnotation("", false)
+	setNodePoolsAnnotation("fast=vg-nvme", true)
+	pools, annotated, err = nodeStoragePools()
+	assert.Nil(err)
+	assert.True(annotated)
+	assert.Equal(map[string][]string{"fast": {"vg-nvme"}}, pools)
+	setNodePoolsAnnotation("", true)
+	pools, _, err = nodeStoragePools()
+	assert.Nil(err)
+	assert.Equal(0, len(pools))
+
+	setNodePoolsAnnotation("fast=", true)
+	_, _, err = nodeStoragePools()
+	assert.NotNil(err)
+}
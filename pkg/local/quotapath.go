@@ -0,0 +1,315 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// QuotaPathType is the pv type of directory volumes limited by project quota
+	QuotaPathType = "quotapath"
+	// RootPathTag is the storageclass parameter of the quotapath base directory
+	RootPathTag = "rootPath"
+
+	// quotaPathStateKind is the node state kind of quotapath volumes
+	quotaPathStateKind = "quotapath"
+	// quotaProjectIDBase is the first project id handed out to volumes
+	quotaProjectIDBase = 10000
+)
+
+// quotaPathState records a quotapath volume, so the project id is kept
+// across plugin restarts and the directory is removed after the pv.
+type quotaPathState struct {
+	RootPath  string `json:"rootPath"`
+	Path      string `json:"path"`
+	ProjectID int    `json:"projectID"`
+	Size      int64  `json:"size"`
+	Ephemeral bool   `json:"ephemeral,omitempty"`
+}
+
+var (
+	// quotaPathMutex serializes project id allocation
+	quotaPathMutex sync.Mutex
+	// rootPathPattern matches the root paths passed to the quota commands
+	rootPathPattern = regexp.MustCompile(`^/[A-Za-z0-9_./+-]+$`)
+)
+
+// validateRootPath checks the rootPath storageclass parameter
+func validateRootPath(rootPath string) error {
+	if filepath.Clean(rootPath) != rootPath || !rootPathPattern.MatchString(rootPath) {
+		return fmt.Errorf("%s %q must be a clean absolute path other than / for pvType %s", RootPathTag, rootPath, QuotaPathType)
+	}
+	return nil
+}
+
+// publishQuotaPath creates the volume directory under the root path with a
+// project quota of the volume size and bind mounts it at the target path.
+func (ns *nodeServer) publishQuotaPath(ctx context.Context, req *csi.NodePublishVolumeRequest, volumeContext map[string]string) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	rootPath := volumeContext[RootPathTag]
+	if err := validateRootPath(rootPath); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %s", err.Error())
+	}
+	if !lvmNamePattern.MatchString(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: invalid volume id %q for pvType %s", volumeID, QuotaPathType)
+	}
+	ephemeral := isEphemeral(volumeContext)
+	volumePath := filepath.Join(rootPath, volumeID)
+	if !ephemeral {
+		if err := utils.CheckQuotaPathValidate(ns.client, volumePath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	var sizeByte int64
+	var err error
+	if ephemeral {
+		if sizeByte, err = ephemeralVolumeSize(volumeContext); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	} else {
+		_, sizeByte, _ = ns.getPvSize(volumeID)
+		if sizeByte == 0 {
+			return nil, status.Errorf(codes.Internal, "NodePublishVolume: get size of persistent volume %s failed", volumeID)
+		}
+	}
+
+	state, err := ensureQuotaPath(ctx, volumeID, rootPath, sizeByte, ephemeral)
+	if err != nil {
+		log.Errorf("NodePublishVolume: create quota path %s with error: %s", volumePath, err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	isMnt, err := ns.mounter.IsMounted(targetPath)
+	if err != nil {
+		if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := ns.mounter.EnsureFolder(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		isMnt = false
+	}
+	if !isMnt {
+		options := "rw"
+		if req.GetReadonly() {
+			options = "ro"
+		}
+		mntCmd := fmt.Sprintf("%s mount --bind -o %s %s %s", NsenterCmd, options, utils.ShellQuote(state.Path), utils.ShellQuote(targetPath))
+		if _, err := utils.Run(mntCmd); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		log.Infof("NodePublishVolume:: bind mount successful quota path: %s, projectID: %d, targetPath: %s", state.Path, state.ProjectID, targetPath)
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// ensureQuotaPath creates the volume directory and sets its project quota,
+// raising the quota when the volume was expanded.
+func ensureQuotaPath(ctx context.Context, volumeID, rootPath string, sizeByte int64, ephemeral bool) (*quotaPathState, error) {
+	quotaPathMutex.Lock()
+	defer quotaPathMutex.Unlock()
+
+	state := &quotaPathState{}
+	if err := loadNodeState(quotaPathStateKind, volumeID, state); err != nil {
+		projectID, err := nextQuotaProjectID()
+		if err != nil {
+			return nil, err
+		}
+		state = &quotaPathState{
+			RootPath:  rootPath,
+			Path:      filepath.Join(rootPath, volumeID),
+			ProjectID: projectID,
+			Ephemeral: ephemeral,
+		}
+	}
+	if state.Size >= sizeByte && utils.IsHostFileExist(state.Path) {
+		return state, nil
+	}
+
+	if _, err := utils.RunContext(ctx, fmt.Sprintf("%s mkdir -p %s", NsenterCmd, utils.ShellQuote(state.Path))); err != nil {
+		return nil, err
+	}
+	if err := setProjectQuota(ctx, state.Path, state.ProjectID, sizeByte); err != nil {
+		return nil, err
+	}
+	state.Size = sizeByte
+	if err := saveNodeState(quotaPathStateKind, volumeID, state); err != nil {
+		return nil, err
+	}
+	log.Infof("ensureQuotaPath: set project quota of %s, projectID: %d, size: %d", state.Path, state.ProjectID, sizeByte)
+	return state, nil
+}
+
+// nextQuotaProjectID returns a project id not used by any quotapath volume
+func nextQuotaProjectID() (int, error) {
+	names, err := listNodeStates(quotaPathStateKind)
+	if err != nil {
+		return 0, err
+	}
+	used := map[int]bool{}
+	for _, name := range names {
+		state := &quotaPathState{}
+		if err := loadNodeState(quotaPathStateKind, name, state); err == nil {
+			used[state.ProjectID] = true
+		}
+	}
+	projectID := quotaProjectIDBase
+	for used[projectID] {
+		projectID++
+	}
+	return projectID, nil
+}
+
+// getFsMountPoint returns the filesystem type and mount point of the host path
+func getFsMountPoint(ctx context.Context, path string) (string, string, error) {
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s df --output=fstype,target %s", NsenterCmd, utils.ShellQuote(path)))
+	if err != nil {
+		return "", "", err
+	}
+	return parseDfOutput(out)
+}
+
+// parseDfOutput parses the output of df --output=fstype,target
+func parseDfOutput(out string) (string, string, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("unexpected df output: %q", out)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected df output: %q", out)
+	}
+	return fields[0], fields[1], nil
+}
+
+// projectQuotaCmds returns the commands to set the project quota of path,
+// xfs uses xfs_quota and ext4 uses chattr and setquota.
+func projectQuotaCmds(fsType, mountPoint, path string, projectID int, sizeByte int64) ([]string, error) {
+	switch fsType {
+	case "xfs":
+		return []string{
+			fmt.Sprintf("xfs_quota -x -c 'project -s -p %s %d' %s", path, projectID, mountPoint),
+			fmt.Sprintf("xfs_quota -x -c 'limit -p bhard=%d %d' %s", sizeByte, projectID, mountPoint),
+		}, nil
+	case "ext4":
+		// setquota takes the block limit in KiB
+		return []string{
+			fmt.Sprintf("chattr -R +P -p %d %s", projectID, path),
+			fmt.Sprintf("setquota -P %d 0 %d 0 0 %s", projectID, (sizeByte+1023)/1024, mountPoint),
+		}, nil
+	}
+	return nil, fmt.Errorf("filesystem %s of %s does not support project quota, supported: xfs, ext4", fsType, path)
+}
+
+// setProjectQuota limits the directory to sizeByte with a project quota
+func setProjectQuota(ctx context.Context, path string, projectID int, sizeByte int64) error {
+	fsType, mountPoint, err := getFsMountPoint(ctx, path)
+	if err != nil {
+		return err
+	}
+	cmds, err := projectQuotaCmds(fsType, mountPoint, path, projectID, sizeByte)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if _, err := utils.RunContext(ctx, fmt.Sprintf("%s %s", NsenterCmd, cmd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandQuotaPath raises the project quota of a quotapath volume, it
+// returns false for other volumes.
+func expandQuotaPath(ctx context.Context, volumeID string, sizeByte int64) (bool, error) {
+	state := &quotaPathState{}
+	if err := loadNodeState(quotaPathStateKind, volumeID, state); err != nil {
+		return false, nil
+	}
+	_, err := ensureQuotaPath(ctx, volumeID, state.RootPath, sizeByte, state.Ephemeral)
+	return true, err
+}
+
+// removeQuotaPath removes the directory and the project quota of a
+// quotapath volume.
+func removeQuotaPath(volumeID string, state *quotaPathState) error {
+	// never remove anything but the volume directory under the root path
+	if validateRootPath(state.RootPath) != nil || state.Path != filepath.Join(state.RootPath, volumeID) {
+		return fmt.Errorf("quota path %s of volume %s is not under root path %s", state.Path, volumeID, state.RootPath)
+	}
+	if utils.IsHostFileExist(state.Path) {
+		if err := setProjectQuota(context.Background(), state.Path, state.ProjectID, 0); err != nil {
+			log.Warnf("removeQuotaPath: clear project quota of %s with error: %s", state.Path, err.Error())
+		}
+		if _, err := utils.Run(fmt.Sprintf("%s rm -rf %s", NsenterCmd, utils.ShellQuote(state.Path))); err != nil {
+			return err
+		}
+	}
+	clearVolumeCondition(volumeID)
+	log.Infof("removeQuotaPath: quota path %s of volume %s removed", state.Path, volumeID)
+	return removeNodeState(quotaPathStateKind, volumeID)
+}
+
+// removeEphemeralQuotaPath removes the quotapath of an ephemeral inline
+// volume, it does nothing for other volumes.
+func removeEphemeralQuotaPath(volumeID string) error {
+	state := &quotaPathState{}
+	if err := loadNodeState(quotaPathStateKind, volumeID, state); err != nil || !state.Ephemeral {
+		return nil
+	}
+	return removeQuotaPath(volumeID, state)
+}
+
+// reclaimQuotaPaths removes the quotapath volumes whose persistent volume is deleted
+func (ns *nodeServer) reclaimQuotaPaths() {
+	names, err := listNodeStates(quotaPathStateKind)
+	if err != nil {
+		log.Errorf("reclaimVolumes: list quota path states with error: %s", err.Error())
+		return
+	}
+	for _, name := range names {
+		state := &quotaPathState{}
+		if err := loadNodeState(quotaPathStateKind, name, state); err != nil || state.Ephemeral {
+			continue
+		}
+		_, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		if err == nil || !apierrors.IsNotFound(err) {
+			continue
+		}
+		log.Infof("reclaimVolumes: persistent volume %s is deleted, reclaim quota path %s", name, state.Path)
+		if err := removeQuotaPath(name, state); err != nil {
+			log.Errorf("reclaimVolumes: remove quota path %s with error: %s", state.Path, err.Error())
+		}
+	}
+}
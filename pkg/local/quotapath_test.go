@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDfOutput(t *testing.T) {
+	assert := assert.New(t)
+	fsType, mountPoint, err := parseDfOutput("Type Mounted on\nxfs  /mnt/data\n")
+	assert.Nil(err)
+	assert.Equal("xfs", fsType)
+	assert.Equal("/mnt/data", mountPoint)
+
+	_, _, err = parseDfOutput("Type Mounted on\n")
+	assert.NotNil(err)
+}
+
+func TestProjectQuotaCmds(t *testing.T) {
+	assert := assert.New(t)
+	cmds, err := projectQuotaCmds("xfs", "/mnt/data", "/mnt/data/pv-1", 10000, 1024*1024*1024)
+	assert.Nil(err)
+	assert.Equal([]string{
+		"xfs_quota -x -c 'project -s -p /mnt/data/pv-1 10000' /mnt/data",
+		"xfs_quota -x -c 'limit -p bhard=1073741824 10000' /mnt/data",
+	}, cmds)
+
+	cmds, err = projectQuotaCmds("ext4", "/mnt/data", "/mnt/data/pv-1", 10001, 1024*1024*1024)
+	assert.Nil(err)
+	assert.Equal("setquota -P 10001 0 1048576 0 0 /mnt/data", cmds[1])
+
+	_, err = projectQuotaCmds("ext2/ext3", "/mnt/data", "/mnt/data/pv-1", 10000, 1024)
+	assert.NotNil(err)
+}
+
+func TestValidateRootPath(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateRootPath("/mnt/data"))
+	assert.NotNil(validateRootPath(""))
+	assert.NotNil(validateRootPath("/"))
+	assert.NotNil(validateRootPath("mnt/data"))
+	assert.NotNil(validateRootPath("/mnt/../etc"))
+	assert.NotNil(validateRootPath("/mnt/data; reboot"))
+}
+
+func TestNextQuotaProjectID(t *testing.T) {
+	assert := assert.New(t)
+	kubeletRootDir := utils.KubeletRootDir
+	utils.KubeletRootDir = t.TempDir()
+	defer func() { utils.KubeletRootDir = kubeletRootDir }()
+
+	projectID, err := nextQuotaProjectID()
+	assert.Nil(err)
+	assert.Equal(quotaProjectIDBase, projectID)
+
+	assert.Nil(saveNodeState(quotaPathStateKind, "pv-1", &quotaPathState{ProjectID: quotaProjectIDBase}))
+	projectID, err = nextQuotaProjectID()
+	assert.Nil(err)
+	assert.Equal(quotaProjectIDBase+1, projectID)
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// Raid1Type raid1 type, mirrored
+	Raid1Type = "raid1"
+	// Raid5Type raid5 type, striped with parity
+	Raid5Type = "raid5"
+	// Raid10Type raid10 type, striped mirrors
+	Raid10Type = "raid10"
+	// MirrorsTag is the storageclass parameter of the raid1/raid10 mirror count
+	MirrorsTag = "mirrors"
+	// StripesTag is the storageclass parameter of the stripe count
+	StripesTag = "stripes"
+
+	// RaidDegradedReason event reason
+	RaidDegradedReason = "RaidVolumeDegraded"
+	// RaidRecoveredReason event reason
+	RaidRecoveredReason = "RaidVolumeRecovered"
+
+	// raidConditionSource is the volume condition source of raid health
+	raidConditionSource = "raid"
+	// raidMonitorInterval is the interval to check the raid volumes health
+	raidMonitorInterval = time.Minute
+)
+
+// raidVolume is the health of a raid lvm volume
+type raidVolume struct {
+	VGName      string
+	Name        string
+	SyncPercent string
+	Health      string
+}
+
+var (
+	// raidHealth map volumeID to the last seen raid health
+	raidHealth = map[string]string{}
+	// raidHealthMutex Mutex for raidHealth map
+	raidHealthMutex sync.Mutex
+)
+
+// isRaidType checks whether the lvm type is a raid type
+func isRaidType(lvmType string) bool {
+	return lvmType == Raid1Type || lvmType == Raid5Type || lvmType == Raid10Type
+}
+
+// validateLvmType checks the lvm type and its geometry storageclass parameters
+func validateLvmType(parameters map[string]string) error {
+	switch lvmType := parameters[LvmTypeTag]; lvmType {
+	case "", LinearType, StripingType, Raid1Type, Raid5Type, Raid10Type, VDOType:
+	default:
+		return fmt.Errorf("unknown %s %q, supported: %s, %s, %s, %s, %s, %s", LvmTypeTag, lvmType, LinearType, StripingType, Raid1Type, Raid5Type, Raid10Type, VDOType)
+	}
+	if _, err := parseVDORatio(parameters); err != nil {
+		return err
+	}
+	for _, tag := range []string{MirrorsTag, StripesTag} {
+		if _, err := parsePositiveInt(parameters, tag); err != nil {
+			return err
+		}
+	}
+	_, err := parseStripeSize(parameters)
+	return err
+}
+
+// parsePositiveInt parses an optional positive integer parameter, 0 if not set
+func parsePositiveInt(parameters map[string]string, tag string) (int, error) {
+	value, ok := parameters[tag]
+	if !ok || value == "" {
+		return 0, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("%s %q must be a positive integer", tag, value)
+	}
+	return number, nil
+}
+
+// raidCreateArgs returns the lvcreate arguments of a raid volume, the mirror
+// and stripe counts are validated against the physical volumes of the vg.
+func raidCreateArgs(lvmType string, parameters map[string]string, pvCount int) (string, error) {
+	mirrors, err := parsePositiveInt(parameters, MirrorsTag)
+	if err != nil {
+		return "", err
+	}
+	stripes, err := parsePositiveInt(parameters, StripesTag)
+	if err != nil {
+		return "", err
+	}
+
+	switch lvmType {
+	case Raid1Type:
+		if mirrors == 0 {
+			mirrors = 1
+		}
+		if pvCount < mirrors+1 {
+			return "", fmt.Errorf("%s with %d mirrors needs %d physical volumes, vg has %d", lvmType, mirrors, mirrors+1, pvCount)
+		}
+		return fmt.Sprintf("--type %s -m %d", lvmType, mirrors), nil
+	case Raid5Type:
+		if stripes == 0 {
+			stripes = pvCount - 1
+		}
+		if stripes < 2 || pvCount < stripes+1 {
+			return "", fmt.Errorf("%s with %d stripes needs at least 2 stripes and %d physical volumes, vg has %d", lvmType, stripes, stripes+1, pvCount)
+		}
+		return fmt.Sprintf("--type %s -i %d", lvmType, stripes), nil
+	case Raid10Type:
+		if mirrors == 0 {
+			mirrors = 1
+		}
+		if stripes == 0 {
+			stripes = pvCount / (mirrors + 1)
+		}
+		if stripes < 2 || pvCount < stripes*(mirrors+1) {
+			return "", fmt.Errorf("%s with %d stripes and %d mirrors needs at least 2 stripes and %d physical volumes, vg has %d", lvmType, stripes, mirrors, stripes*(mirrors+1), pvCount)
+		}
+		return fmt.Sprintf("--type %s -m %d -i %d", lvmType, mirrors, stripes), nil
+	}
+	return "", fmt.Errorf("%s is not a raid type", lvmType)
+}
+
+// getVGPVCount returns the number of physical volumes of the vg
+func getVGPVCount(ctx context.Context, vgName string) (int, error) {
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s vgs --noheadings -o pv_count %s", NsenterCmd, vgName))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// parseRaidVolumes parses the output of lvs -o vg_name,lv_name,sync_percent,lv_health_status
+func parseRaidVolumes(out string) []raidVolume {
+	volumes := []raidVolume{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 4 {
+			continue
+		}
+		volumes = append(volumes, raidVolume{
+			VGName:      strings.TrimSpace(fields[0]),
+			Name:        strings.TrimSpace(fields[1]),
+			SyncPercent: strings.TrimSpace(fields[2]),
+			Health:      strings.TrimSpace(fields[3]),
+		})
+	}
+	return volumes
+}
+
+// raidCondition converts the raid health to a volume condition, a failed
+// leg is abnormal while a resync in progress is only reported.
+func raidCondition(volume raidVolume) (bool, string) {
+	if volume.Health != "" {
+		return true, fmt.Sprintf("raid volume %s/%s is %s, sync %s%%", volume.VGName, volume.Name, volume.Health, volume.SyncPercent)
+	}
+	if volume.SyncPercent != "" && volume.SyncPercent != "100.00" {
+		return false, fmt.Sprintf("raid volume %s/%s is resyncing, sync %s%%", volume.VGName, volume.Name, volume.SyncPercent)
+	}
+	return false, ""
+}
+
+// monitorRaidVolumes periodically checks the health of the raid volumes
+func (ns *nodeServer) monitorRaidVolumes() {
+	for {
+		ns.checkRaidVolumes()
+		time.Sleep(raidMonitorInterval)
+	}
+}
+
+func (ns *nodeServer) checkRaidVolumes() {
+	cmd := fmt.Sprintf("%s lvs --noheadings --separator '|' -o vg_name,lv_name,sync_percent,lv_health_status -S 'segtype=~raid' %s", NsenterCmd, localDriverTags())
+	out, err := utils.Run(cmd)
+	if err != nil {
+		log.Errorf("monitorRaidVolumes: list raid volumes with error: %s", err.Error())
+		return
+	}
+
+	volumes := parseRaidVolumes(out)
+	raidHealthMutex.Lock()
+	defer raidHealthMutex.Unlock()
+	pruneRaidHealth(volumes)
+	for _, volume := range volumes {
+		abnormal, message := raidCondition(volume)
+		setVolumeCondition(volume.Name, raidConditionSource, abnormal, message)
+
+		lastHealth, seen := raidHealth[volume.Name]
+		raidHealth[volume.Name] = volume.Health
+		if lastHealth == volume.Health || (!seen && volume.Health == "") {
+			continue
+		}
+		if volume.Health != "" {
+			log.Warnf("monitorRaidVolumes: %s", message)
+			ns.claimEvent(ns.getVolumeClaim(volume.Name), v1.EventTypeWarning, RaidDegradedReason, message)
+		} else {
+			message = fmt.Sprintf("raid volume %s/%s recovered from %s", volume.VGName, volume.Name, lastHealth)
+			log.Infof("monitorRaidVolumes: %s", message)
+			ns.claimEvent(ns.getVolumeClaim(volume.Name), v1.EventTypeNormal, RaidRecoveredReason, message)
+		}
+	}
+}
+
+// pruneRaidHealth forgets the raid volumes no longer listed, the caller
+// holds raidHealthMutex.
+func pruneRaidHealth(volumes []raidVolume) {
+	listed := map[string]bool{}
+	for _, volume := range volumes {
+		listed[volume.Name] = true
+	}
+	for volumeID := range raidHealth {
+		if !listed[volumeID] {
+			delete(raidHealth, volumeID)
+		}
+	}
+}
+
+// clearRaidHealth forgets the raid health of a removed volume
+func clearRaidHealth(volumeID string) {
+	raidHealthMutex.Lock()
+	delete(raidHealth, volumeID)
+	raidHealthMutex.Unlock()
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLvmType(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateLvmType(map[string]string{}))
+	assert.Nil(validateLvmType(map[string]string{LvmTypeTag: Raid10Type, MirrorsTag: "1", StripesTag: "2"}))
+	assert.NotNil(validateLvmType(map[string]string{LvmTypeTag: "raid6"}))
+	assert.NotNil(validateLvmType(map[string]string{LvmTypeTag: Raid1Type, MirrorsTag: "0"}))
+}
+
+func TestRaidCreateArgs(t *testing.T) {
+	assert := assert.New(t)
+	args, err := raidCreateArgs(Raid1Type, map[string]string{}, 2)
+	assert.Nil(err)
+	assert.Equal("--type raid1 -m 1", args)
+	_, err = raidCreateArgs(Raid1Type, map[string]string{MirrorsTag: "2"}, 2)
+	assert.NotNil(err)
+
+	args, err = raidCreateArgs(Raid5Type, map[string]string{}, 4)
+	assert.Nil(err)
+	assert.Equal("--type raid5 -i 3", args)
+	_, err = raidCreateArgs(Raid5Type, map[string]string{}, 2)
+	assert.NotNil(err)
+
+	args, err = raidCreateArgs(Raid10Type, map[string]string{}, 4)
+	assert.Nil(err)
+	assert.Equal("--type raid10 -m 1 -i 2", args)
+	_, err = raidCreateArgs(Raid10Type, map[string]string{StripesTag: "3"}, 4)
+	assert.NotNil(err)
+}
+
+func TestRaidCondition(t *testing.T) {
+	assert := assert.New(t)
+	volumes := parseRaidVolumes("  vg1|pv-1|100.00|\n  vg1|pv-2|45.10|\n  vg1|pv-3|100.00|partial\n")
+	assert.Len(volumes, 3)
+
+	abnormal, message := raidCondition(volumes[0])
+	assert.False(abnormal)
+	assert.Equal("", message)
+	abnormal, message = raidCondition(volumes[1])
+	assert.False(abnormal)
+	assert.Equal("raid volume vg1/pv-2 is resyncing, sync 45.10%", message)
+	abnormal, message = raidCondition(volumes[2])
+	assert.True(abnormal)
+	assert.Equal("raid volume vg1/pv-3 is partial, sync 100.00%", message)
+}
+
+func TestPruneRaidHealth(t *testing.T) {
+	assert := assert.New(t)
+	raidHealth = map[string]string{"lvm-1": "partial", "lvm-2": "", "lvm-3": "refresh needed"}
+	defer func() { raidHealth = map[string]string{} }()
+	pruneRaidHealth([]raidVolume{{VGName: "vg1", Name: "lvm-1", Health: "partial"}})
+	assert.Equal(map[string]string{"lvm-1": "partial"}, raidHealth)
+	clearRaidHealth("lvm-1")
+	assert.Equal(0, len(raidHealth))
+}
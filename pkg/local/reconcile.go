@@ -0,0 +1,296 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ReconcileFailedReason is the event reason of volumes the startup reconcile cannot repair
+	ReconcileFailedReason = "VolumeReconcileFailed"
+	// ReconcileRepairedReason is the event reason of volumes repaired by the startup reconcile
+	ReconcileRepairedReason = "VolumeReconcileRepaired"
+
+	// volumeLifecycleModeKey is the key of the volume lifecycle mode kubelet saves in vol_data.json
+	volumeLifecycleModeKey = "volumeLifecycleMode"
+)
+
+// reconcileVolumes walks the volumes this driver published on the node and
+// repairs the state lost when the plugin restarted: broken or missing mounts
+// are mounted again and IO limits are reapplied to the pod cgroups.
+func (ns *nodeServer) reconcileVolumes() {
+	pattern := filepath.Join(utils.KubeletRootDir, "pods", "*", "volumes", "kubernetes.io~csi", "*")
+	volumeDirs, err := filepath.Glob(pattern)
+	if err != nil {
+		log.Errorf("Reconcile: list volume paths %s with error: %s", pattern, err.Error())
+		return
+	}
+	if len(volumeDirs) == 0 {
+		return
+	}
+
+	mountPoints, err := utils.ListProcMounts()
+	if err != nil {
+		log.Errorf("Reconcile: list mount points with error: %s", err.Error())
+		return
+	}
+	pods := ns.listNodePods()
+
+	// lvm volumes per vg, filled lazily
+	vgLVs := map[string]map[string]bool{}
+	for _, volumeDir := range volumeDirs {
+		ns.reconcileVolume(volumeDir, mountPoints, vgLVs, pods)
+	}
+	log.Infof("Reconcile: finished checking %d volume paths", len(volumeDirs))
+}
+
+// publishedVolume is how a volume was published on the node
+type publishedVolume struct {
+	volumeContext map[string]string
+	vgName        string
+	fsType        string
+	readOnly      bool
+	mountOptions  []string
+}
+
+// publishedVolumeOf returns how the volume was published, from its
+// persistent volume or, for an ephemeral inline volume, from its node state.
+// It returns nil for the volumes to skip.
+func (ns *nodeServer) publishedVolumeOf(volumeID string, volData map[string]string) (*publishedVolume, error) {
+	if volData[volumeLifecycleModeKey] == string(storagev1.VolumeLifecycleEphemeral) {
+		state := &ephemeralState{}
+		if err := loadNodeState(ephemeralStateKind, volumeID, state); err != nil {
+			// ephemeral quotapath volumes are directories, no lvm volume
+			if loadNodeState(quotaPathStateKind, volumeID, &quotaPathState{}) == nil {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("ephemeral volume %s is not recorded on the node: %v", volumeID, err)
+		}
+		volume := &publishedVolume{
+			volumeContext: state.VolumeContext,
+			vgName:        state.VGName,
+			fsType:        DefaultFs,
+			readOnly:      state.ReadOnly,
+			mountOptions:  state.MountFlags,
+		}
+		if value, ok := state.VolumeContext[FsTypeTag]; ok {
+			volume.fsType = value
+		}
+		return volume, nil
+	}
+
+	pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), volumeID, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get persistent volume %s failed: %v", volumeID, err)
+	}
+	if pv.Spec.CSI == nil {
+		return nil, nil
+	}
+	vgName, _ := splitThinPool(recordedVG(pv))
+	volume := &publishedVolume{
+		volumeContext: pv.Spec.CSI.VolumeAttributes,
+		vgName:        vgName,
+		fsType:        DefaultFs,
+		readOnly:      pv.Spec.CSI.ReadOnly,
+		mountOptions:  pv.Spec.MountOptions,
+	}
+	if value, ok := pv.Spec.CSI.VolumeAttributes[FsTypeTag]; ok {
+		volume.fsType = value
+	} else if pv.Spec.CSI.FSType != "" {
+		volume.fsType = pv.Spec.CSI.FSType
+	}
+	return volume, nil
+}
+
+func (ns *nodeServer) reconcileVolume(volumeDir string, mountPoints []utils.MountPoint, vgLVs map[string]map[string]bool, pods map[string]*v1.Pod) {
+	volData, err := utils.LoadJSONData(filepath.Join(volumeDir, utils.VolDataFileName))
+	if err != nil {
+		log.Debugf("Reconcile: skip volume path %s: %s", volumeDir, err.Error())
+		return
+	}
+	if !isLocalDriver(volData["driverName"]) {
+		return
+	}
+	volumeID := volData["volumeHandle"]
+	targetPath := filepath.Join(volumeDir, "mount")
+	podUID := utils.GetPodUIDFromTargetPath(targetPath)
+	pod := pods[podUID]
+
+	volume, err := ns.publishedVolumeOf(volumeID, volData)
+	if err != nil {
+		ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, err.Error())
+		return
+	}
+	if volume == nil {
+		return
+	}
+	volumeContext := volume.volumeContext
+	if isDirect, err := strconv.ParseBool(volumeContext[DirectTag]); err == nil && isDirect {
+		return
+	}
+	// quotapath volumes are bind mounts of a directory, no lvm volume
+	if volumeContext[PvTypeTag] == QuotaPathType {
+		return
+	}
+	var devicePath string
+	if volumeContext[PvTypeTag] == DeviceType {
+		if devicePath, err = devicePathByID(volumeContext[DeviceIDTag]); err != nil {
+			ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, err.Error())
+			return
+		}
+	} else {
+		vgName := volume.vgName
+		if vgName == "" {
+			ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, "volume has no vgName attribute")
+			return
+		}
+
+		lvNames, ok := vgLVs[vgName]
+		if !ok {
+			if lvNames, err = listLVNames(vgName); err != nil {
+				log.Errorf("Reconcile: list lvm volumes in vg %s with error: %s", vgName, err.Error())
+				lvNames = map[string]bool{}
+			}
+			vgLVs[vgName] = lvNames
+		}
+		if !lvNames[volumeID] {
+			ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, fmt.Sprintf("lvm volume %s not found in vg %s", volumeID, vgName))
+			return
+		}
+		devicePath = filepath.Join("/dev", vgName, volumeID)
+		// never mount the origin of a cached volume, its cache would go stale
+		if volumeContext[CacheVGTag] != "" {
+			if devicePath, err = activateCache(context.Background(), vgName, volumeID, volumeContext); err != nil {
+				ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, fmt.Sprintf("activate cache of volume %s failed: %s", volumeID, err.Error()))
+				return
+			}
+		}
+	}
+	mounted, healthy := checkMountPoint(mountPoints, targetPath, devicePath)
+	if !mounted || !healthy {
+		if err := ns.repairMount(volumeID, volume, devicePath, targetPath, mounted); err != nil {
+			ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, fmt.Sprintf("repair mount %s failed: %s", targetPath, err.Error()))
+			return
+		}
+		ns.reconcileEvent(pod, volumeID, v1.EventTypeNormal, ReconcileRepairedReason, fmt.Sprintf("mount %s repaired", targetPath))
+	}
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:      volumeID,
+		TargetPath:    targetPath,
+		VolumeContext: volumeContext,
+	}
+	if err := utils.SetVolumeIOLimit(devicePath, req); err != nil {
+		ns.reconcileEvent(pod, volumeID, v1.EventTypeWarning, ReconcileFailedReason, fmt.Sprintf("reapply io limit failed: %s", err.Error()))
+	}
+}
+
+// repairMount mounts devicePath at targetPath again, unmounting the broken
+// mount first if there is one.
+func (ns *nodeServer) repairMount(volumeID string, volume *publishedVolume, devicePath, targetPath string, mounted bool) error {
+	if mounted {
+		if err := ns.mounter.Unmount(targetPath); err != nil {
+			return err
+		}
+	}
+	options := []string{"rw"}
+	if volume.readOnly {
+		options = []string{"ro"}
+	}
+	options = append(options, volume.mountOptions...)
+
+	log.Infof("Reconcile: mount volume %s again, devicePath: %s, targetPath: %s", volumeID, devicePath, targetPath)
+	return ns.mounter.Mount(devicePath, targetPath, volume.fsType, options...)
+}
+
+// checkMountPoint reports whether targetPath is mounted and whether the
+// mount is backed by devicePath and still accessible.
+func checkMountPoint(mountPoints []utils.MountPoint, targetPath, devicePath string) (bool, bool) {
+	for _, mp := range mountPoints {
+		if !isMountPointMatch(mp, targetPath) {
+			continue
+		}
+		if _, err := os.Stat(targetPath); err != nil {
+			return true, false
+		}
+		return true, sameDevice(mp.Device, devicePath)
+	}
+	return false, false
+}
+
+// isMountPointMatch returns true if the path in mp is the same as dir.
+func isMountPointMatch(mp utils.MountPoint, dir string) bool {
+	return mp.Path == dir || mp.Path == dir+"\\040(deleted)"
+}
+
+// sameDevice compares two device paths after resolving symlinks,
+// e.g. /dev/vg/lv and /dev/mapper/vg-lv both resolve to /dev/dm-N.
+func sameDevice(device, other string) bool {
+	if device == other {
+		return true
+	}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false
+	}
+	otherResolved, err := filepath.EvalSymlinks(other)
+	if err != nil {
+		return false
+	}
+	return resolved == otherResolved
+}
+
+// listNodePods returns the pods of this node indexed by uid
+func (ns *nodeServer) listNodePods() map[string]*v1.Pod {
+	pods := map[string]*v1.Pod{}
+	podList, err := ns.client.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{FieldSelector: "spec.nodeName=" + ns.nodeID})
+	if err != nil {
+		log.Warnf("Reconcile: list pods of node %s with error: %s", ns.nodeID, err.Error())
+		return pods
+	}
+	for i := range podList.Items {
+		pods[string(podList.Items[i].UID)] = &podList.Items[i]
+	}
+	return pods
+}
+
+// reconcileEvent records the reconcile result on the pod using the volume,
+// or on the persistent volume when the pod is unknown.
+func (ns *nodeServer) reconcileEvent(pod *v1.Pod, volumeID, eventType, reason, message string) {
+	if eventType == v1.EventTypeWarning {
+		log.Errorf("Reconcile: volume %s: %s", volumeID, message)
+	} else {
+		log.Infof("Reconcile: volume %s: %s", volumeID, message)
+	}
+	objectRef := &v1.ObjectReference{Kind: "PersistentVolume", Name: volumeID}
+	if pod != nil {
+		objectRef = &v1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: pod.Namespace, UID: pod.UID}
+	}
+	utils.CreateEvent(ns.recorder, objectRef, eventType, reason, fmt.Sprintf("volume %s: %s", volumeID, message))
+}
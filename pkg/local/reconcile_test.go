@@ -0,0 +1,76 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMountPoint(t *testing.T) {
+	assert := assert.New(t)
+	targetPath := t.TempDir()
+	mountPoints := []utils.MountPoint{
+		{Device: "/dev/vg1/lvm-a", Path: "/var/lib/kubelet/pods/other/mount"},
+		{Device: "/dev/vg1/lvm-b", Path: targetPath},
+	}
+
+	mounted, healthy := checkMountPoint(mountPoints, targetPath, "/dev/vg1/lvm-b")
+	assert.True(mounted)
+	assert.True(healthy)
+
+	mounted, healthy = checkMountPoint(mountPoints, targetPath, "/dev/vg1/lvm-c")
+	assert.True(mounted)
+	assert.False(healthy)
+
+	mounted, _ = checkMountPoint(mountPoints, "/not/mounted", "/dev/vg1/lvm-b")
+	assert.False(mounted)
+}
+
+func TestPublishedVolumeOfEphemeral(t *testing.T) {
+	assert := assert.New(t)
+	kubeletRootDir := utils.KubeletRootDir
+	utils.KubeletRootDir = t.TempDir()
+	defer func() { utils.KubeletRootDir = kubeletRootDir }()
+
+	ns := &nodeServer{}
+	volData := map[string]string{volumeLifecycleModeKey: "Ephemeral"}
+	_, err := ns.publishedVolumeOf("csi-a", volData)
+	assert.Error(err)
+
+	assert.Nil(saveNodeState(quotaPathStateKind, "csi-q", &quotaPathState{Ephemeral: true}))
+	volume, err := ns.publishedVolumeOf("csi-q", volData)
+	assert.Nil(err)
+	assert.Nil(volume)
+
+	state := &ephemeralState{
+		VolumeID:      "csi-a",
+		VGName:        "vg1",
+		VolumeContext: map[string]string{FsTypeTag: "xfs"},
+		ReadOnly:      true,
+		MountFlags:    []string{"noatime"},
+	}
+	assert.Nil(saveNodeState(ephemeralStateKind, "csi-a", state))
+	volume, err = ns.publishedVolumeOf("csi-a", volData)
+	assert.Nil(err)
+	assert.Equal("vg1", volume.vgName)
+	assert.Equal("xfs", volume.fsType)
+	assert.True(volume.readOnly)
+	assert.Equal([]string{"noatime"}, volume.mountOptions)
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	// ReservationTimeout env, how long the controller holds the capacity of
+	// a volume placed on a node until the node reports the lvm volume
+	ReservationTimeout = "RESERVATION_TIMEOUT"
+
+	// defaultReservationTimeout is the reservation timeout when RESERVATION_TIMEOUT is not set
+	defaultReservationTimeout = 10 * time.Minute
+
+	// FailedVolumesAnnotation is the node annotation reporting the volumes
+	// the node failed to create, volumeID to the token of their reservation
+	FailedVolumesAnnotation = "local.csi.ecloud.cmss.com/failed-volumes"
+
+	// ReservationTokenTag is the volume context key of the token the
+	// controller generated for the reservation of the volume
+	ReservationTokenTag = "reservationToken"
+)
+
+// capacityReservation is the capacity held for a volume not created yet
+type capacityReservation struct {
+	volumeID   string
+	nodeID     string
+	size       int64
+	parameters map[string]string
+	token      string
+	expires    time.Time
+}
+
+// createFailure is a volume the node failed to create
+type createFailure struct {
+	token    string
+	failedAt time.Time
+}
+
+var (
+	// reservations map volumeID to the capacity held on its node
+	reservations = map[string]capacityReservation{}
+	// reservationsMutex Mutex for reservations map
+	reservationsMutex sync.Mutex
+
+	// createFailures map volumeID to the failure of the node to create it
+	createFailures = map[string]createFailure{}
+	// createFailuresMutex Mutex for createFailures map
+	createFailuresMutex sync.Mutex
+)
+
+// reservationTimeout returns the configured reservation timeout
+func reservationTimeout() time.Duration {
+	if value := os.Getenv(ReservationTimeout); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			return timeout
+		}
+		log.Warnf("reservationTimeout: invalid %s %q, use %s", ReservationTimeout, value, defaultReservationTimeout)
+	}
+	return defaultReservationTimeout
+}
+
+// pruneReservations releases the expired reservations and the ones of the
+// node whose lvm volume the node reports in its vgs or failed to create
+// under the same reservation token, the caller holds reservationsMutex.
+func pruneReservations(nodeID string, vgs []volumeGroup, failed map[string]string, now time.Time) {
+	created := map[string]bool{}
+	for _, vg := range vgs {
+		for _, volumeID := range vg.Volumes {
+			created[volumeID] = true
+		}
+	}
+	for volumeID, reservation := range reservations {
+		if now.After(reservation.expires) {
+			log.Infof("pruneReservations: reservation of volume %s on node %s timed out", volumeID, reservation.nodeID)
+			delete(reservations, volumeID)
+		} else if reservation.nodeID == nodeID && created[volumeID] {
+			log.Infof("pruneReservations: volume %s is created on node %s, release its reservation", volumeID, nodeID)
+			delete(reservations, volumeID)
+		} else if reservation.nodeID == nodeID && failed[volumeID] != "" && failed[volumeID] == reservation.token {
+			log.Infof("pruneReservations: node %s failed to create volume %s, release its reservation", nodeID, volumeID)
+			delete(reservations, volumeID)
+		}
+	}
+}
+
+// applyReservations subtracts the reservations of the node from the free
+// space of its vgs, each one from the vg the node would choose, the caller
+// holds reservationsMutex.
+func applyReservations(nodeID string, vgs []volumeGroup) []volumeGroup {
+	reserved := append([]volumeGroup{}, vgs...)
+	for _, reservation := range reservations {
+		if reservation.nodeID != nodeID {
+			continue
+		}
+		candidates, err := matchVGs(reserved, reservation.parameters)
+		if err != nil {
+			continue
+		}
+		size := physicalSize(reservation.parameters, reservation.size)
+		vgName, err := selectVG(candidates, map[string]int{}, reservation.parameters[VGPolicyTag], size)
+		if err != nil {
+			// more reserved than free, the node may choose any candidate
+			if len(candidates) == 0 {
+				continue
+			}
+			vgName = candidates[0].Name
+		}
+		for i := range reserved {
+			if reserved[i].Name == vgName {
+				reserved[i].Free -= size
+				if reserved[i].Free < 0 {
+					reserved[i].Free = 0
+				}
+			}
+		}
+	}
+	return reserved
+}
+
+// reservedVGs returns the vgs of the node with the reserved capacity subtracted
+func reservedVGs(nodeID string, vgs []volumeGroup, failed map[string]string) []volumeGroup {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+	pruneReservations(nodeID, vgs, failed, time.Now())
+	return applyReservations(nodeID, vgs)
+}
+
+// reserveCapacity holds the capacity of a volume placed on the node until
+// the node creates it, concurrent volumes of the node no longer pass the
+// check on the same free space. The node reports its failures to create the
+// volume with the token set in the parameters, stale failures of an earlier
+// reservation do not match.
+func (cs *controllerServer) reserveCapacity(volumeID, nodeID string, parameters map[string]string, size int64) error {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+	if reservation, ok := reservations[volumeID]; ok && reservation.nodeID == nodeID {
+		parameters[ReservationTokenTag] = reservation.token
+		return nil
+	}
+
+	node, err := cs.client.CoreV1().Nodes().Get(context.Background(), nodeID, metav1.GetOptions{})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	vgs, err := nodeVGs(node)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	// no vg inventory advertised, nothing to check
+	if vgs == nil {
+		return nil
+	}
+	pruneReservations(nodeID, vgs, nodeCreateFailures(node), time.Now())
+	candidates, err := matchVGs(applyReservations(nodeID, vgs), parameters)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := selectVG(candidates, map[string]int{}, parameters[VGPolicyTag], physicalSize(parameters, size)); err != nil {
+		return status.Errorf(codes.ResourceExhausted, "node %s has not enough capacity for volume %s: %s", nodeID, volumeID, err.Error())
+	}
+	reservation := capacityReservation{
+		volumeID:   volumeID,
+		nodeID:     nodeID,
+		size:       size,
+		parameters: parameters,
+		token:      string(uuid.NewUUID()),
+		expires:    time.Now().Add(reservationTimeout()),
+	}
+	reservations[volumeID] = reservation
+	parameters[ReservationTokenTag] = reservation.token
+	log.Infof("reserveCapacity: reserve %d bytes on node %s for volume %s", size, nodeID, volumeID)
+	return nil
+}
+
+// releaseCapacity releases the reservation of the volume
+func releaseCapacity(volumeID string) {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+	if _, ok := reservations[volumeID]; ok {
+		log.Infof("releaseCapacity: release the reservation of volume %s", volumeID)
+		delete(reservations, volumeID)
+	}
+}
+
+// nodeVGs returns the vgs advertised by the node, nil if not advertised
+func nodeVGs(node *v1.Node) ([]volumeGroup, error) {
+	value := node.Annotations[VGsAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	vgs := []volumeGroup{}
+	if err := json.Unmarshal([]byte(value), &vgs); err != nil {
+		return nil, err
+	}
+	return vgs, nil
+}
+
+// nodeCreateFailures returns the volumes the node reports it failed to create
+func nodeCreateFailures(node *v1.Node) map[string]string {
+	value := node.Annotations[FailedVolumesAnnotation]
+	if value == "" {
+		return nil
+	}
+	failed := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &failed); err != nil {
+		log.Warnf("nodeCreateFailures: invalid %s of node %s: %s", FailedVolumesAnnotation, node.Name, err.Error())
+		return nil
+	}
+	return failed
+}
+
+// recordCreateFailure records the node failed to create the volume, the
+// next capacity update reports it to release the reservation of the token
+func recordCreateFailure(volumeID, token string, now time.Time) {
+	if token == "" {
+		return
+	}
+	createFailuresMutex.Lock()
+	defer createFailuresMutex.Unlock()
+	createFailures[volumeID] = createFailure{token: token, failedAt: now}
+}
+
+// clearCreateFailure forgets the failure of a volume created at last
+func clearCreateFailure(volumeID string) {
+	createFailuresMutex.Lock()
+	defer createFailuresMutex.Unlock()
+	delete(createFailures, volumeID)
+}
+
+// reportedCreateFailures returns the failures to report, the ones older
+// than the reservation timeout are dropped as their reservation expired
+func reportedCreateFailures(now time.Time) map[string]string {
+	createFailuresMutex.Lock()
+	defer createFailuresMutex.Unlock()
+	failed := map[string]string{}
+	for volumeID, failure := range createFailures {
+		if now.Sub(failure.failedAt) > reservationTimeout() {
+			delete(createFailures, volumeID)
+			continue
+		}
+		failed[volumeID] = failure.token
+	}
+	return failed
+}
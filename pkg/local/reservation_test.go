@@ -0,0 +1,123 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReservationTimeout(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(defaultReservationTimeout, reservationTimeout())
+	os.Setenv(ReservationTimeout, "90s")
+	defer os.Unsetenv(ReservationTimeout)
+	assert.Equal(90*time.Second, reservationTimeout())
+	os.Setenv(ReservationTimeout, "soon")
+	assert.Equal(defaultReservationTimeout, reservationTimeout())
+}
+
+func TestParseVGVolumes(t *testing.T) {
+	assert := assert.New(t)
+	volumes := parseVGVolumes("  vg1|lvm-1\n  vg1|lvm-2\n  vg2|lvm-3\n")
+	assert.Equal([]string{"lvm-1", "lvm-2"}, volumes["vg1"])
+	assert.Equal([]string{"lvm-3"}, volumes["vg2"])
+}
+
+func TestWipeSpace(t *testing.T) {
+	assert := assert.New(t)
+	out := "  vg1|lvm-1|thinpool|1000|25.00\n  vg1|lvm-2|thinpool|1000|0.00\n  vg1|lvm-3||1000|\n"
+	held := parseWipeSpace(out, map[string]bool{"lvm-1": true, "lvm-3": true})
+	assert.Equal(map[string]int64{"vg1/thinpool": 750}, held)
+
+	vgs := holdWipeSpace([]volumeGroup{{Name: "vg1", Free: 2000}, {Name: "vg1/thinpool", Free: 500}}, held)
+	assert.Equal(int64(2000), vgs[0].Free)
+	assert.Equal(int64(0), vgs[1].Free)
+}
+
+func TestReservations(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	reservations = map[string]capacityReservation{
+		"lvm-1": {volumeID: "lvm-1", nodeID: "node1", size: 30, parameters: map[string]string{VgNameTag: "vg1"}, expires: now.Add(time.Minute)},
+		"lvm-2": {volumeID: "lvm-2", nodeID: "node1", size: 20, parameters: map[string]string{VgNameTag: "vg1,vg2", VGPolicyTag: VGPolicyMostFree}, expires: now.Add(time.Minute)},
+		"lvm-3": {volumeID: "lvm-3", nodeID: "node2", size: 20, parameters: map[string]string{VgNameTag: "vg1"}, expires: now.Add(time.Minute)},
+		"lvm-4": {volumeID: "lvm-4", nodeID: "node1", size: 20, parameters: map[string]string{VgNameTag: "vg1"}, expires: now.Add(-time.Second)},
+	}
+	defer func() { reservations = map[string]capacityReservation{} }()
+
+	vgs := []volumeGroup{{Name: "vg1", Size: 100, Free: 50}, {Name: "vg2", Size: 100, Free: 40}}
+	reserved := reservedVGs("node1", vgs, nil)
+	assert.Equal(3, len(reservations))
+	assert.Equal(int64(50), vgs[0].Free)
+	free := reserved[0].Free + reserved[1].Free
+	assert.Equal(int64(40), free)
+
+	// lvm-1 is created, its space is already out of the vg free space
+	vgs[0].Volumes = []string{"lvm-1"}
+	reservedVGs("node1", vgs, nil)
+	_, ok := reservations["lvm-1"]
+	assert.False(ok)
+	_, ok = reservations["lvm-3"]
+	assert.True(ok)
+
+	releaseCapacity("lvm-2")
+	assert.Equal(1, len(reservations))
+}
+
+func TestReleaseFailedReservation(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	reservations = map[string]capacityReservation{
+		"lvm-1": {volumeID: "lvm-1", nodeID: "node1", size: 30, parameters: map[string]string{VgNameTag: "vg1"}, token: "a", expires: now.Add(time.Minute)},
+		"lvm-2": {volumeID: "lvm-2", nodeID: "node1", size: 20, parameters: map[string]string{VgNameTag: "vg1"}, token: "b", expires: now.Add(time.Minute)},
+	}
+	defer func() { reservations = map[string]capacityReservation{} }()
+
+	// lvm-2 failed under an earlier reservation, its reservation stands
+	failed := map[string]string{"lvm-1": "a", "lvm-2": "c"}
+	vgs := reservedVGs("node1", []volumeGroup{{Name: "vg1", Size: 100, Free: 50}}, failed)
+	_, ok := reservations["lvm-1"]
+	assert.False(ok)
+	_, ok = reservations["lvm-2"]
+	assert.True(ok)
+	assert.Equal(int64(30), vgs[0].Free)
+}
+
+func TestCreateFailures(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { createFailures = map[string]createFailure{} }()
+	now := time.Now()
+	recordCreateFailure("lvm-1", "a", now)
+	recordCreateFailure("lvm-2", "b", now.Add(-defaultReservationTimeout-time.Second))
+	recordCreateFailure("lvm-3", "c", now)
+	recordCreateFailure("lvm-4", "", now)
+	clearCreateFailure("lvm-3")
+	failed := reportedCreateFailures(now)
+	assert.Equal(map[string]string{"lvm-1": "a"}, failed)
+	assert.Equal(1, len(createFailures))
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{FailedVolumesAnnotation: `{"lvm-1":"a"}`}}}
+	assert.Equal("a", nodeCreateFailures(node)["lvm-1"])
+	node.Annotations[FailedVolumesAnnotation] = "bad"
+	assert.Nil(nodeCreateFailures(node))
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an in-process s3 endpoint checking the request signatures
+type fakeS3 struct {
+	sync.Mutex
+	client  *s3Client
+	objects map[string][]byte
+	puts    int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	now, err := time.Parse(s3TimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	verify := r.Clone(context.Background())
+	verify.URL.Host = r.Host
+	f.client.sign(verify, body, now)
+	if verify.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = body
+		f.puts++
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// newFakeS3 starts a fake s3 endpoint and returns a client of it
+func newFakeS3(t *testing.T) (*fakeS3, *s3Client) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	endpoint, _ := url.Parse(server.URL)
+	client := &s3Client{endpoint: endpoint, bucket: "backups", region: defaultS3Region, accessKey: "access", secretKey: "secret", prefix: "cluster1", client: server.Client()}
+	fake.client = &s3Client{region: defaultS3Region, accessKey: "access", secretKey: "secret"}
+	return fake, client
+}
+
+func TestS3Client(t *testing.T) {
+	assert := assert.New(t)
+	fake, client := newFakeS3(t)
+	ctx := context.Background()
+
+	assert.Nil(client.PutObject(ctx, "backups/lvm-1 a.json", []byte("manifest")))
+	_, ok := fake.objects["/backups/cluster1/backups/lvm-1 a.json"]
+	assert.True(ok)
+	data, err := client.GetObject(ctx, "backups/lvm-1 a.json")
+	assert.Nil(err)
+	assert.Equal("manifest", string(data))
+	_, err = client.GetObject(ctx, "backups/missing.json")
+	assert.Equal(errObjectNotFound, err)
+
+	// a wrong secret is rejected
+	client.secretKey = "wrong"
+	assert.NotNil(client.PutObject(ctx, "backups/lvm-2.json", []byte("manifest")))
+}
+
+func TestNewS3Client(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv(BackupS3Endpoint, "")
+	client, err := newS3Client()
+	assert.Nil(err)
+	assert.Nil(client)
+
+	t.Setenv(BackupS3Endpoint, "minio:9000")
+	_, err = newS3Client()
+	assert.NotNil(err)
+
+	t.Setenv(BackupS3Endpoint, "http://minio:9000")
+	_, err = newS3Client()
+	assert.NotNil(err)
+
+	t.Setenv(BackupS3Bucket, "backups")
+	t.Setenv(BackupS3Prefix, "/cluster1/")
+	client, err = newS3Client()
+	assert.Nil(err)
+	assert.Equal(defaultS3Region, client.region)
+	assert.Equal("http://minio:9000/backups/cluster1/chunks/ab/abc", client.objectURL("chunks/ab/abc").String())
+}
+
+func TestS3EscapePath(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("/backups/lvm-1_a.json~", s3EscapePath("/backups/lvm-1_a.json~"))
+	assert.Equal("/backups/a%20b%2Bc", s3EscapePath("/backups/a b+c"))
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// GRPCTimeouts env, the timeouts of the csi methods, e.g. NodePublishVolume=5m,CreateVolume=2m
+	GRPCTimeouts = "GRPC_TIMEOUTS"
+
+	// requestIDMetadata is the grpc metadata key of the request id set by the caller
+	requestIDMetadata = "x-request-id"
+	// defaultMethodTimeout is the timeout of the csi methods not in defaultMethodTimeouts
+	defaultMethodTimeout = 10 * time.Minute
+)
+
+var (
+	// defaultMethodTimeouts are the timeouts of the quick csi methods
+	defaultMethodTimeouts = map[string]time.Duration{
+		"Probe":                     30 * time.Second,
+		"GetPluginInfo":             30 * time.Second,
+		"GetPluginCapabilities":     30 * time.Second,
+		"ControllerGetCapabilities": 30 * time.Second,
+		"NodeGetCapabilities":       30 * time.Second,
+		"NodeGetInfo":               30 * time.Second,
+		"GetCapacity":               time.Minute,
+		"NodeGetVolumeStats":        time.Minute,
+	}
+	// quietMethods are the frequently polled csi methods whose requests are logged at debug level
+	quietMethods = map[string]bool{
+		"Probe":               true,
+		"GetCapacity":         true,
+		"NodeGetCapabilities": true,
+		"NodeGetVolumeStats":  true,
+	}
+)
+
+// grpcServer serves the csi services with the driver interceptors
+type grpcServer struct {
+	wg     sync.WaitGroup
+	server *grpc.Server
+	// socket is the path of the unix socket served, if any
+	socket string
+}
+
+// newGRPCServer returns the csi grpc server of the driver instance, the
+// interceptors log the calls, record their metrics, bound them by a
+// deadline and recover panics.
+func newGRPCServer(driverName string) *grpcServer {
+	timeouts, err := parseMethodTimeouts(os.Getenv(GRPCTimeouts))
+	if err != nil {
+		log.Errorf("newGRPCServer: %s, use the default timeouts", err.Error())
+		timeouts = map[string]time.Duration{}
+	}
+	return &grpcServer{
+		server: grpc.NewServer(grpc.ChainUnaryInterceptor(logGRPC, metricsInterceptor(driverName), deadlineInterceptor(timeouts), recoverGRPC)),
+	}
+}
+
+// Start serves the csi services at the endpoint
+func (s *grpcServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	if ids != nil {
+		csi.RegisterIdentityServer(s.server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(s.server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.server, ns)
+	}
+
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
+		}
+		s.socket = addr
+	}
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	log.Infof("Listening for connections on address: %#v", listener.Addr())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.Serve(listener); err != nil {
+			log.Errorf("grpcServer: serve with error: %s", err.Error())
+		}
+	}()
+}
+
+// Wait waits for the server to stop
+func (s *grpcServer) Wait() {
+	s.wg.Wait()
+}
+
+// Stop stops accepting new calls and waits up to timeout for the in-flight
+// calls to finish before cancelling them, then removes the unix socket.
+func (s *grpcServer) Stop(timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Warnf("grpcServer: in-flight calls not finished after %s, stop them", timeout)
+		s.server.Stop()
+		<-stopped
+	}
+	if s.socket != "" {
+		if err := os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+			log.Errorf("grpcServer: remove socket %s with error: %s", s.socket, err.Error())
+		}
+	}
+}
+
+// requestLogKey is the context key of the logger with the request id
+type requestLogKey struct{}
+
+// newRequestID returns a random request id
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// incomingRequestID returns the request id set by the caller, or a new one
+func incomingRequestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDMetadata); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	return newRequestID()
+}
+
+// requestLog returns the logger of the csi call with its request id and method
+func requestLog(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(requestLogKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// logGRPC logs the csi calls with their secrets stripped and a request id
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := rpcMethod(info.FullMethod)
+	entry := log.WithFields(log.Fields{"requestID": incomingRequestID(ctx), "method": method})
+	ctx = context.WithValue(ctx, requestLogKey{}, entry)
+	logRequest := entry.Infof
+	if quietMethods[method] {
+		logRequest = entry.Debugf
+	}
+	logRequest("GRPC request: %s", protosanitizer.StripSecrets(req))
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	entry = entry.WithField("duration", time.Since(start).String())
+	if err != nil {
+		entry.WithField("code", status.Code(err).String()).Errorf("GRPC error: %v", err)
+	} else {
+		entry.Debugf("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
+
+// recoverGRPC turns a panic of the csi call into an internal error
+func recoverGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			requestLog(ctx).Errorf("GRPC panic: %v\n%s", r, debug.Stack())
+			resp, err = nil, status.Errorf(codes.Internal, "panic in %s: %v", rpcMethod(info.FullMethod), r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// deadlineInterceptor bounds the csi call by the timeout of its method,
+// the deadline of the caller is kept when it is earlier.
+func deadlineInterceptor(timeouts map[string]time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, methodTimeout(timeouts, rpcMethod(info.FullMethod)))
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// methodTimeout returns the timeout of the csi method
+func methodTimeout(timeouts map[string]time.Duration, method string) time.Duration {
+	if timeout, ok := timeouts[method]; ok {
+		return timeout
+	}
+	if timeout, ok := defaultMethodTimeouts[method]; ok {
+		return timeout
+	}
+	return defaultMethodTimeout
+}
+
+// parseMethodTimeouts parses the GRPC_TIMEOUTS env, e.g. NodePublishVolume=5m,CreateVolume=2m
+func parseMethodTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid %s item %q", GRPCTimeouts, item)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s timeout %q", GRPCTimeouts, item)
+		}
+		timeouts[strings.TrimSpace(parts[0])] = timeout
+	}
+	return timeouts, nil
+}
+
+// metricsInterceptor records the latency and the errors of the csi calls
+// served by the driver instance
+func metricsInterceptor(driverName string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		method := rpcMethod(info.FullMethod)
+		metrics.RPCDuration.WithLabelValues(driverName, method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.RPCErrors.WithLabelValues(driverName, method, status.Code(err).String()).Inc()
+		}
+		return resp, err
+	}
+}
+
+// rpcMethod returns the method name of the full grpc method, e.g. NodePublishVolume
+func rpcMethod(fullMethod string) string {
+	for i := len(fullMethod) - 1; i >= 0; i-- {
+		if fullMethod[i] == '/' {
+			return fullMethod[i+1:]
+		}
+	}
+	return fullMethod
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// panicIdentityServer panics in Probe
+type panicIdentityServer struct {
+	csi.UnimplementedIdentityServer
+}
+
+func (s *panicIdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: DefaultDriverName, VendorVersion: csiVersion}, nil
+}
+
+func (s *panicIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	panic("probe failed")
+}
+
+func TestGRPCServer(t *testing.T) {
+	assert := assert.New(t)
+	endpoint := "unix://" + strings.TrimPrefix(t.TempDir(), "/") + "/csi.sock"
+	server := newGRPCServer(DefaultDriverName)
+	server.Start(endpoint, &panicIdentityServer{}, nil, nil)
+	defer server.server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(checkCSISocket(ctx, endpoint))
+
+	// the panic is an internal error and the server keeps serving
+	conn, err := grpc.DialContext(ctx, "unix:///"+strings.TrimPrefix(endpoint, "unix://"), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	assert.Nil(err)
+	defer conn.Close()
+	_, err = csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+	assert.Equal(codes.Internal, status.Code(err))
+	assert.Contains(err.Error(), "probe failed")
+	assert.Nil(checkCSISocket(ctx, endpoint))
+}
+
+// slowIdentityServer blocks GetPluginInfo until released or cancelled
+type slowIdentityServer struct {
+	csi.UnimplementedIdentityServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowIdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	close(s.started)
+	select {
+	case <-s.release:
+		return &csi.GetPluginInfoResponse{Name: DefaultDriverName, VendorVersion: csiVersion}, nil
+	case <-ctx.Done():
+		return nil, status.Error(codes.Canceled, ctx.Err().Error())
+	}
+}
+
+func TestGRPCServerStop(t *testing.T) {
+	assert := assert.New(t)
+	for _, finish := range []bool{true, false} {
+		socket := t.TempDir() + "/csi.sock"
+		ids := &slowIdentityServer{started: make(chan struct{}), release: make(chan struct{})}
+		server := newGRPCServer(DefaultDriverName)
+		server.Start("unix:/"+socket, ids, nil, nil)
+		assert.FileExists(socket)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := grpc.DialContext(ctx, "unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+		assert.Nil(err)
+		result := make(chan error, 1)
+		go func() {
+			_, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+			result <- err
+		}()
+		<-ids.started
+
+		stopped := make(chan struct{})
+		go func() {
+			server.Stop(time.Second)
+			close(stopped)
+		}()
+		if finish {
+			// the in-flight call completes before the server stops
+			time.Sleep(100 * time.Millisecond)
+			close(ids.release)
+			assert.Nil(<-result)
+		} else {
+			// the call still running at the timeout is cancelled
+			assert.NotNil(<-result)
+		}
+		<-stopped
+		server.Wait()
+		assert.NoFileExists(socket)
+		conn.Close()
+		cancel()
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	assert := assert.New(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeGetInfo"}
+
+	// the request id of the caller is kept
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadata, "req-1"))
+	_, err := logGRPC(ctx, &csi.NodeGetInfoRequest{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Equal("req-1", requestLog(ctx).Data["requestID"])
+		assert.Equal("NodeGetInfo", requestLog(ctx).Data["method"])
+		return nil, nil
+	})
+	assert.Nil(err)
+	_, _ = logGRPC(context.Background(), &csi.NodeGetInfoRequest{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Len(requestLog(ctx).Data["requestID"], 16)
+		return nil, nil
+	})
+
+	// the method timeout applies unless the caller deadline is earlier
+	interceptor := deadlineInterceptor(map[string]time.Duration{"NodeGetInfo": time.Hour})
+	_, _ = interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		deadline, ok := ctx.Deadline()
+		assert.True(ok)
+		assert.True(time.Until(deadline) > 59*time.Minute)
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, _ = interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		deadline, _ := ctx.Deadline()
+		assert.True(time.Until(deadline) <= time.Second)
+		return nil, nil
+	})
+
+	_, err = recoverGRPC(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		var volumes map[string]string
+		volumes["lvm-1"] = "vg1"
+		return nil, nil
+	})
+	assert.Equal(codes.Internal, status.Code(err))
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	timeouts, err := parseMethodTimeouts(" NodePublishVolume=5m, CreateVolume=90s ,")
+	assert.Nil(err)
+	assert.Equal(5*time.Minute, methodTimeout(timeouts, "NodePublishVolume"))
+	assert.Equal(90*time.Second, methodTimeout(timeouts, "CreateVolume"))
+	assert.Equal(30*time.Second, methodTimeout(timeouts, "Probe"))
+	assert.Equal(defaultMethodTimeout, methodTimeout(timeouts, "DeleteVolume"))
+
+	for _, value := range []string{"NodePublishVolume", "=5m", "NodePublishVolume=soon", "NodePublishVolume=-1s"} {
+		_, err = parseMethodTimeouts(value)
+		assert.NotNil(err, value)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+)
+
+// nodeStatePath returns the directory of kind states in the node
+// persistent storage, which survives plugin restarts. The states are
+// keyed by volume, they are shared by all the driver instances.
+func nodeStatePath(kind string) string {
+	return filepath.Join(utils.KubeletRootDir, "/csi-plugins", DefaultDriverName, "node", kind)
+}
+
+// saveNodeState saves obj as json to the node persistent storage
+func saveNodeState(kind, name string, obj interface{}) error {
+	if err := os.MkdirAll(nodeStatePath(kind), os.FileMode(0755)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return utils.WriteAndSyncFile(filepath.Join(nodeStatePath(kind), name+".json"), data, os.FileMode(0644))
+}
+
+// loadNodeState loads the json saved by saveNodeState into obj
+func loadNodeState(kind, name string, obj interface{}) error {
+	data, err := os.ReadFile(filepath.Join(nodeStatePath(kind), name+".json"))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// removeNodeState removes the state saved by saveNodeState
+func removeNodeState(kind, name string) error {
+	err := os.Remove(filepath.Join(nodeStatePath(kind), name+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// listNodeStates returns the names of the saved kind states
+func listNodeStates(kind string) ([]string, error) {
+	entries, err := os.ReadDir(nodeStatePath(kind))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// StripeSizeTag is the storageclass parameter of the stripe size, e.g. 64Ki
+	StripeSizeTag = "stripeSize"
+)
+
+// parseStripeSize parses the optional stripe size parameter to KiB, it must
+// be a power of 2 of at least 4Ki.
+func parseStripeSize(parameters map[string]string) (int64, error) {
+	value := parameters[StripeSizeTag]
+	if value == "" {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q is invalid: %v", StripeSizeTag, value, err)
+	}
+	size := quantity.Value()
+	if size < 4*1024 || size%1024 != 0 || size&(size-1) != 0 {
+		return 0, fmt.Errorf("%s %q must be a power of 2 of at least 4Ki", StripeSizeTag, value)
+	}
+	return size / 1024, nil
+}
+
+// stripeCreateArgs returns the lvcreate arguments of a striped volume of
+// sizeBytes, stripes defaults to the number of physical volumes of the vg
+// and enough physical volumes must have free space for a stripe.
+func stripeCreateArgs(parameters map[string]string, pvFree []int64, sizeBytes int64) (string, error) {
+	stripes, err := parsePositiveInt(parameters, StripesTag)
+	if err != nil {
+		return "", err
+	}
+	if stripes == 0 {
+		stripes = len(pvFree)
+	}
+	if stripes < 2 {
+		return "", fmt.Errorf("%s needs at least 2 stripes, vg has %d physical volumes", StripingType, len(pvFree))
+	}
+	stripeSize, err := parseStripeSize(parameters)
+	if err != nil {
+		return "", err
+	}
+
+	perStripe := (sizeBytes + int64(stripes) - 1) / int64(stripes)
+	available := 0
+	for _, free := range pvFree {
+		if free >= perStripe {
+			available++
+		}
+	}
+	if available < stripes {
+		return "", fmt.Errorf("%s with %d stripes needs %d physical volumes with %d bytes free, vg has %d", StripingType, stripes, stripes, perStripe, available)
+	}
+
+	args := fmt.Sprintf("-i %d", stripes)
+	if stripeSize > 0 {
+		args = fmt.Sprintf("%s -I %dk", args, stripeSize)
+	}
+	return args, nil
+}
+
+// listPVFree returns the free bytes of every physical volume of the vg
+func listPVFree(ctx context.Context, vgName string) ([]int64, error) {
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s pvs --noheadings --units b --nosuffix -o pv_free -S vg_name=%s", NsenterCmd, vgName))
+	if err != nil {
+		return nil, err
+	}
+	pvFree := []int64{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		free, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse pv free %q: %v", line, err)
+		}
+		pvFree = append(pvFree, free)
+	}
+	return pvFree, nil
+}
+
+// stripeExtendArgs returns the lvextend arguments keeping the stripe
+// geometry of the last segment, from lvs -o segtype,stripes,stripe_size.
+func stripeExtendArgs(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Split(strings.TrimSpace(lines[len(lines)-1]), "|")
+	if len(fields) < 3 || strings.TrimSpace(fields[0]) != "striped" {
+		return ""
+	}
+	stripes, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil || stripes < 2 {
+		return ""
+	}
+	args := fmt.Sprintf("-i %d", stripes)
+	if stripeSize, err := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64); err == nil && stripeSize > 0 {
+		args = fmt.Sprintf("%s -I %dk", args, stripeSize/1024)
+	}
+	return args
+}
+
+// getStripeExtendArgs returns the lvextend stripe arguments of the lvm volume
+func getStripeExtendArgs(ctx context.Context, devicePath string) (string, error) {
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s lvs --noheadings --units b --nosuffix --separator '|' -o segtype,stripes,stripe_size %s", NsenterCmd, devicePath))
+	if err != nil {
+		return "", err
+	}
+	return stripeExtendArgs(out), nil
+}
+
+// sizeToBytes converts the lvm size and unit of convertSize back to bytes
+func sizeToBytes(size int64, unit string) int64 {
+	if unit == "g" {
+		return size * 1024 * 1024 * 1024
+	}
+	return size * 1024 * 1024
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStripeSize(t *testing.T) {
+	assert := assert.New(t)
+	size, err := parseStripeSize(map[string]string{StripeSizeTag: "64Ki"})
+	assert.Nil(err)
+	assert.Equal(int64(64), size)
+	size, err = parseStripeSize(map[string]string{})
+	assert.Nil(err)
+	assert.Equal(int64(0), size)
+	_, err = parseStripeSize(map[string]string{StripeSizeTag: "48Ki"})
+	assert.NotNil(err)
+	_, err = parseStripeSize(map[string]string{StripeSizeTag: "2Ki"})
+	assert.NotNil(err)
+}
+
+func TestStripeCreateArgs(t *testing.T) {
+	assert := assert.New(t)
+	gi := int64(1024 * 1024 * 1024)
+	pvFree := []int64{10 * gi, 10 * gi, 2 * gi}
+
+	args, err := stripeCreateArgs(map[string]string{}, pvFree, 6*gi)
+	assert.Nil(err)
+	assert.Equal("-i 3", args)
+	args, err = stripeCreateArgs(map[string]string{StripesTag: "2", StripeSizeTag: "128Ki"}, pvFree, 12*gi)
+	assert.Nil(err)
+	assert.Equal("-i 2 -I 128k", args)
+
+	// the third pv has no room for a 3Gi stripe
+	_, err = stripeCreateArgs(map[string]string{}, pvFree, 9*gi)
+	assert.NotNil(err)
+	_, err = stripeCreateArgs(map[string]string{}, []int64{10 * gi}, gi)
+	assert.NotNil(err)
+}
+
+func TestStripeExtendArgs(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("-i 3 -I 64k", stripeExtendArgs("  striped|3|65536\n"))
+	assert.Equal("-i 2 -I 64k", stripeExtendArgs("  striped|2|65536\n  striped|2|65536\n"))
+	assert.Equal("", stripeExtendArgs("  linear|1|0\n"))
+	assert.Equal("", stripeExtendArgs("  raid1|2|0\n"))
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodeFree is the free space of the candidate vgs of a node for a volume
+type nodeFree struct {
+	name string
+	free int64
+}
+
+// requisiteNodes returns the nodes of the requisite topology, nil when any node is accessible
+func requisiteNodes(requirement *csi.TopologyRequirement, topologyKey string) map[string]bool {
+	if requirement == nil || len(requirement.GetRequisite()) == 0 {
+		return nil
+	}
+	nodes := map[string]bool{}
+	for _, topology := range requirement.GetRequisite() {
+		if nodeID, exists := topology.GetSegments()[topologyKey]; exists {
+			nodes[nodeID] = true
+		}
+	}
+	return nodes
+}
+
+// rankNodes returns the nodes with a vg that fits the volume, the most free first
+func rankNodes(nodes []v1.Node, requisite map[string]bool, parameters map[string]string, size int64) []nodeFree {
+	physical := physicalSize(parameters, size)
+	ranked := []nodeFree{}
+	for i := range nodes {
+		if requisite != nil && !requisite[nodes[i].Name] {
+			continue
+		}
+		vgs, err := nodeVGs(&nodes[i])
+		if err != nil || vgs == nil {
+			continue
+		}
+		candidates, err := matchVGs(reservedVGs(nodes[i].Name, vgs, nodeCreateFailures(&nodes[i])), parameters)
+		if err != nil {
+			continue
+		}
+		if _, err := selectVG(candidates, map[string]int{}, parameters[VGPolicyTag], physical); err != nil {
+			continue
+		}
+		var free int64
+		for _, vg := range candidates {
+			free += vg.Free
+		}
+		ranked = append(ranked, nodeFree{name: nodes[i].Name, free: free})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].free != ranked[j].free {
+			return ranked[i].free > ranked[j].free
+		}
+		return ranked[i].name < ranked[j].name
+	})
+	return ranked
+}
+
+// chooseNode places a volume with Immediate binding on the node with the
+// most free space in its vgs and reserves the capacity there.
+func (cs *controllerServer) chooseNode(volumeID string, requirement *csi.TopologyRequirement, parameters map[string]string, size int64) (string, error) {
+	nodes, err := cs.client.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	for _, node := range rankNodes(nodes.Items, requisiteNodes(requirement, driverTopologyKey(cs.driverName)), parameters, size) {
+		// another volume may have taken the space meanwhile
+		if err := cs.reserveCapacity(volumeID, node.name, parameters, size); err != nil {
+			log.Warnf("chooseNode: reserve capacity for volume %s on node %s with error: %s", volumeID, node.name, err.Error())
+			continue
+		}
+		log.Infof("chooseNode: choose node %s for volume %s", node.name, volumeID)
+		return node.name, nil
+	}
+	return "", status.Errorf(codes.ResourceExhausted, "no node has a vg with %d bytes free for volume %s", size, volumeID)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRequisiteNodes(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(requisiteNodes(nil, TopologyNodeKey))
+	assert.Nil(requisiteNodes(&csi.TopologyRequirement{}, TopologyNodeKey))
+	requirement := &csi.TopologyRequirement{Requisite: []*csi.Topology{
+		{Segments: map[string]string{TopologyNodeKey: "node1"}},
+		{Segments: map[string]string{"zone": "a"}},
+		{Segments: map[string]string{"topology.ssd.local.csi.ecloud.cmss.com/hostname": "node2"}},
+	}}
+	assert.Equal(map[string]bool{"node1": true}, requisiteNodes(requirement, TopologyNodeKey))
+	assert.Equal(map[string]bool{"node2": true}, requisiteNodes(requirement, "topology.ssd.local.csi.ecloud.cmss.com/hostname"))
+}
+
+func TestRankNodes(t *testing.T) {
+	assert := assert.New(t)
+	node := func(name, vgs string) v1.Node {
+		return v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{VGsAnnotation: vgs}}}
+	}
+	nodes := []v1.Node{
+		node("node1", `[{"name":"vg1","size":100,"free":30}]`),
+		node("node2", `[{"name":"vg1","size":100,"free":80}]`),
+		node("node3", `[{"name":"vg2","size":100,"free":90}]`),
+		node("node4", `[{"name":"vg1","size":100,"free":10}]`),
+		{ObjectMeta: metav1.ObjectMeta{Name: "node5"}},
+	}
+	parameters := map[string]string{VgNameTag: "vg1"}
+
+	ranked := rankNodes(nodes, nil, parameters, 20)
+	assert.Equal([]nodeFree{{name: "node2", free: 80}, {name: "node1", free: 30}}, ranked)
+	ranked = rankNodes(nodes, map[string]bool{"node1": true}, parameters, 20)
+	assert.Equal([]nodeFree{{name: "node1", free: 30}}, ranked)
+	assert.Equal(0, len(rankNodes(nodes, nil, parameters, 90)))
+}
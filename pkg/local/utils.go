@@ -17,6 +17,7 @@ limitations under the License.
 package lvm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -39,6 +40,9 @@ const (
 	InstanceID = "instance-id"
 	// RegionIDTag is the region id tag
 	RegionIDTag = "region-id"
+
+	// minSnapshotSize is the minimum cow size of the snapshots
+	minSnapshotSize = 256 * 1024 * 1024
 )
 
 // ErrParse is an error that is returned when parse operation fails
@@ -58,29 +62,29 @@ func GetMetaData(resource string) string {
 	return string(body)
 }
 
-func formatDevice(devicePath, fstype string) error {
-	output, err := exec.Command("mkfs", "-t", fstype, devicePath).CombinedOutput()
+func formatDevice(ctx context.Context, devicePath, fstype string) error {
+	output, err := exec.CommandContext(ctx, "mkfs", "-t", fstype, devicePath).CombinedOutput()
 	if err != nil {
 		return errors.New("FormatDevice error: " + string(output))
 	}
 	return nil
 }
 
-func checkFSType(devicePath string) (string, error) {
+func checkFSType(ctx context.Context, devicePath string) (string, error) {
 	// We use `file -bsL` to determine whether any filesystem type is detected.
 	// If a filesystem is detected (ie., the output is not "data", we use
 	// `blkid` to determine what the filesystem is. We use `blkid` as `file`
 	// has inconvenient output.
 	// We do *not* use `lsblk` as that requires udev to be up-to-date which
 	// is often not the case when a device is erased using `dd`.
-	output, err := exec.Command("file", "-bsL", devicePath).CombinedOutput()
+	output, err := exec.CommandContext(ctx, "file", "-bsL", devicePath).CombinedOutput()
 	if err != nil {
 		return "", err
 	}
 	if strings.TrimSpace(string(output)) == "data" {
 		return "", nil
 	}
-	output, err = exec.Command("blkid", "-c", "/dev/null", "-o", "export", devicePath).CombinedOutput()
+	output, err = exec.CommandContext(ctx, "blkid", "-c", "/dev/null", "-o", "export", devicePath).CombinedOutput()
 	if err != nil {
 		return "", err
 	}
@@ -103,18 +107,18 @@ func getLocalDeviceNum() (int, error) {
 }
 
 // create vg if not exist
-func createVG(vgName string) (int, error) {
+func createVG(ctx context.Context, vgName string) (int, error) {
 	pvNum := 0
 
 	// step1: check vg is created or not
 	vgCmd := fmt.Sprintf("%s vgdisplay %s | grep 'VG Name' | grep %s | grep -v grep | wc -l", NsenterCmd, vgName, vgName)
-	vgline, err := utils.Run(vgCmd)
+	vgline, err := utils.RunContext(ctx, vgCmd)
 	if err != nil {
 		return 0, err
 	}
 	if strings.TrimSpace(vgline) == "1" {
 		pvNumCmd := fmt.Sprintf("%s vgdisplay %s | grep 'Cur PV' | grep -v grep | awk '{print $3}'", NsenterCmd, vgName)
-		if pvNumStr, err := utils.Run(pvNumCmd); err != nil {
+		if pvNumStr, err := utils.RunContext(ctx, pvNumCmd); err != nil {
 			return 0, err
 		} else if pvNum, err = strconv.Atoi(strings.TrimSpace(pvNumStr)); err != nil {
 			return 0, err
@@ -162,7 +166,7 @@ func createVG(vgName string) (int, error) {
 			return 0, status.Error(codes.Internal, "PV is Not exit: "+devicePath)
 		}
 		pvCmd := fmt.Sprintf("%s pvdisplay %s | grep 'VG Name' | grep -v grep | awk '{print $3}'", NsenterCmd, devicePath)
-		existVgName, err := utils.Run(pvCmd)
+		existVgName, err := utils.RunContext(ctx, pvCmd)
 		if err != nil {
 			log.Errorf("PV (%s) is Already in VG: %s", devicePath, strings.TrimSpace(existVgName))
 			return 0, err
@@ -170,7 +174,7 @@ func createVG(vgName string) (int, error) {
 	}
 	localDeviceStr := strings.Join(localDeviceList, " ")
 	vgAddCmd := fmt.Sprintf("%s vgcreate %s %s", NsenterCmd, vgName, localDeviceStr)
-	_, err = utils.Run(vgAddCmd)
+	_, err = utils.RunContext(ctx, vgAddCmd)
 	if err != nil {
 		log.Errorf("Add PV (%s) to VG: %s error: %s", localDeviceStr, strings.TrimSpace(vgName), err.Error())
 		return 0, err
@@ -179,3 +183,145 @@ func createVG(vgName string) (int, error) {
 	log.Infof("Successful add Local Disks to VG (%s): %v", vgName, localDeviceList)
 	return localDeviceNum, nil
 }
+
+// listLVNames returns the logical volume names in vgName
+func listLVNames(vgName string) (map[string]bool, error) {
+	cmd := fmt.Sprintf("%s lvs --noheadings -o lv_name %s", NsenterCmd, vgName)
+	out, err := utils.Run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseLVNames(out), nil
+}
+
+// parseLVNames parses the output of `lvs --noheadings -o lv_name`
+func parseLVNames(out string) map[string]bool {
+	lvNames := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		name := strings.TrimSpace(line)
+		if name != "" {
+			lvNames[name] = true
+		}
+	}
+	return lvNames
+}
+
+// logicalVolume is a lvm logical volume listed by lvs
+type logicalVolume struct {
+	VGName string
+	Name   string
+	Size   int64
+	Attr   string
+	Tags   []string
+}
+
+// listLogicalVolumes lists the logical volumes matching selector,
+// which can be a vg name, a tag like @tag, or empty for all.
+func listLogicalVolumes(selector string) ([]*logicalVolume, error) {
+	cmd := fmt.Sprintf("%s lvs --noheadings --units b --nosuffix --separator '|' -o vg_name,lv_name,lv_size,lv_attr,lv_tags %s", NsenterCmd, selector)
+	out, err := utils.Run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseLogicalVolumes(out), nil
+}
+
+// parseLogicalVolumes parses the output of listLogicalVolumes
+func parseLogicalVolumes(out string) []*logicalVolume {
+	lvs := []*logicalVolume{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 5 {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		if err != nil {
+			log.Warnf("parseLogicalVolumes: invalid lv size in line: %s", line)
+			continue
+		}
+		lv := &logicalVolume{
+			VGName: strings.TrimSpace(fields[0]),
+			Name:   strings.TrimSpace(fields[1]),
+			Size:   size,
+			Attr:   strings.TrimSpace(fields[3]),
+			Tags:   []string{},
+		}
+		for _, tag := range strings.Split(fields[4], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				lv.Tags = append(lv.Tags, tag)
+			}
+		}
+		lvs = append(lvs, lv)
+	}
+	return lvs
+}
+
+// HasTag checks whether the logical volume has the tag
+func (lv *logicalVolume) HasTag(tag string) bool {
+	for _, value := range lv.Tags {
+		if value == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TagValue returns the value of the first tag starting with prefix
+func (lv *logicalVolume) TagValue(prefix string) string {
+	for _, value := range lv.Tags {
+		if strings.HasPrefix(value, prefix) {
+			return strings.TrimPrefix(value, prefix)
+		}
+	}
+	return ""
+}
+
+// IsOpen checks whether the logical volume is opened, e.g. mounted
+func (lv *logicalVolume) IsOpen() bool {
+	return len(lv.Attr) > 5 && lv.Attr[5] == 'o'
+}
+
+// IsVDOPool checks whether the logical volume is the pool of a vdo volume
+func (lv *logicalVolume) IsVDOPool() bool {
+	return len(lv.Attr) > 0 && lv.Attr[0] == 'd'
+}
+
+// IsSnapshot checks whether the logical volume is a snapshot
+func (lv *logicalVolume) IsSnapshot() bool {
+	return len(lv.Attr) > 0 && (lv.Attr[0] == 's' || lv.Attr[0] == 'S')
+}
+
+// snapshotSize returns the cow size of a short lived snapshot, little
+// changes while it is read by a migration or a backup.
+func snapshotSize(size int64) int64 {
+	size = size / 10
+	if size < minSnapshotSize {
+		size = minSnapshotSize
+	}
+	return (size + 1024*1024 - 1) / (1024 * 1024) * (1024 * 1024)
+}
+
+// createSnapshot creates a cow snapshot of the logical volume in its vg,
+// the origin of a writethrough cache is up to date.
+func createSnapshot(lv *logicalVolume, name string) error {
+	cmd := fmt.Sprintf("%s lvcreate -s -n %s -L %db %s", NsenterCmd, name, snapshotSize(lv.Size), lv.DevicePath())
+	if _, err := utils.Run(cmd); err != nil {
+		return fmt.Errorf("snapshot %s: %v", lv.DevicePath(), err)
+	}
+	return nil
+}
+
+// removeSnapshot removes the snapshot if it exists
+func removeSnapshot(vgName, name string) error {
+	snapshot := fmt.Sprintf("%s/%s", vgName, name)
+	if _, err := utils.Run(fmt.Sprintf("%s lvs %s", NsenterCmd, snapshot)); err != nil {
+		return nil
+	}
+	_, err := utils.Run(fmt.Sprintf("%s lvremove -f %s", NsenterCmd, snapshot))
+	return err
+}
+
+// DevicePath returns the device path of the logical volume
+func (lv *logicalVolume) DevicePath() string {
+	return filepath.Join("/dev", lv.VGName, lv.Name)
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package lvm
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,8 +26,42 @@ import (
 func TestCheckFSType(t *testing.T) {
 
 	testDevice := ".tmp"
-	result, err := checkFSType(testDevice)
+	result, err := checkFSType(context.Background(), testDevice)
 	assert.NotNil(t, err)
 	assert.Equal(t, "", result)
 
 }
+
+func TestParseLVNames(t *testing.T) {
+	assert := assert.New(t)
+	lvNames := parseLVNames("  lvm-9e30e658-5f85-4ec6-ada2-c4ff308b506e\n  lvm-29def33c-8dae-482f-8d64-c45e741facd9\n\n")
+	assert.Len(lvNames, 2)
+	assert.True(lvNames["lvm-9e30e658-5f85-4ec6-ada2-c4ff308b506e"])
+	assert.False(lvNames["lvm-unknown"])
+
+	assert.Len(parseLVNames(""), 0)
+}
+
+func TestParseLogicalVolumes(t *testing.T) {
+	assert := assert.New(t)
+	out := "  volumegroup1|lvm-9e30e658|2147483648|-wi-ao----|local.csi.ecloud.cmss.com,wipe_zero\n" +
+		"  volumegroup1|lvm-29def33c|1073741824|-wi-a-----|\n" +
+		"  invalid line\n"
+	lvs := parseLogicalVolumes(out)
+	assert.Len(lvs, 2)
+	assert.Equal("volumegroup1", lvs[0].VGName)
+	assert.Equal(int64(2147483648), lvs[0].Size)
+	assert.True(lvs[0].IsOpen())
+	assert.True(lvs[0].HasTag("local.csi.ecloud.cmss.com"))
+	assert.Equal("zero", lvs[0].TagValue(wipeTagPrefix))
+	assert.Equal("/dev/volumegroup1/lvm-9e30e658", lvs[0].DevicePath())
+	assert.False(lvs[1].IsOpen())
+	assert.Len(lvs[1].Tags, 0)
+}
+
+func TestSnapshotSize(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(minSnapshotSize), snapshotSize(1024*1024*1024))
+	assert.Equal(int64(301*1024*1024), snapshotSize(3001*1024*1024))
+	assert.Equal(int64(2*1024*1024*1024), snapshotSize(20*1024*1024*1024))
+}
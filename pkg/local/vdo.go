@@ -0,0 +1,227 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// VDOType vdo type, compressed and deduplicated
+	VDOType = "vdo"
+	// VDORatioTag is the storageclass parameter of the virtual to physical size ratio
+	VDORatioTag = "vdoRatio"
+	// VDOMaxRatio env, the maximum virtual to physical size ratio, also
+	// applied to the capacity reported for vdo storageclasses
+	VDOMaxRatio = "VDO_MAX_RATIO"
+
+	// defaultVDOMaxRatio is the maximum ratio when VDO_MAX_RATIO is not set
+	defaultVDOMaxRatio = 10
+	// vdoPoolSuffix is the name suffix of the vdo pool of a volume
+	vdoPoolSuffix = "_vpool"
+	// minVDOPoolSize is the minimum physical size of a vdo pool
+	minVDOPoolSize = 5 * 1024 * 1024 * 1024
+	// vdoFullPercent is the pool usage reported as abnormal, writes fail once the pool is full
+	vdoFullPercent = 90
+	// vdoConditionSource is the volume condition source of vdo usage
+	vdoConditionSource = "vdo"
+	// vdoMonitorInterval is the interval to collect vdo usage
+	vdoMonitorInterval = time.Minute
+)
+
+// vdoPool is the physical usage of the vdo pool of a volume
+type vdoPool struct {
+	VGName        string
+	VolumeID      string
+	Size          int64
+	DataPercent   float64
+	SavingPercent string
+}
+
+var (
+	// vdoMaxRatio is the VDO_MAX_RATIO loaded when the driver starts
+	vdoMaxRatio      float64 = defaultVDOMaxRatio
+	vdoMaxRatioMutex sync.RWMutex
+)
+
+// parseVDOMaxRatio parses VDO_MAX_RATIO, the default when empty
+func parseVDOMaxRatio(value string) (float64, error) {
+	if value == "" {
+		return defaultVDOMaxRatio, nil
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 1 {
+		return 0, fmt.Errorf("invalid %s %q, must be a number not less than 1", VDOMaxRatio, value)
+	}
+	return ratio, nil
+}
+
+// loadVDOMaxRatio reads VDO_MAX_RATIO for the controller, the node and the
+// extender alike, an invalid value fails the start instead of falling back
+// to a ratio the other services do not use.
+func loadVDOMaxRatio() error {
+	ratio, err := parseVDOMaxRatio(os.Getenv(VDOMaxRatio))
+	if err != nil {
+		return err
+	}
+	vdoMaxRatioMutex.Lock()
+	defer vdoMaxRatioMutex.Unlock()
+	vdoMaxRatio = ratio
+	return nil
+}
+
+// maxVDORatio returns the configured maximum virtual to physical ratio
+func maxVDORatio() float64 {
+	vdoMaxRatioMutex.RLock()
+	defer vdoMaxRatioMutex.RUnlock()
+	return vdoMaxRatio
+}
+
+// parseVDORatio parses the vdo ratio parameter, 1 by default
+func parseVDORatio(parameters map[string]string) (float64, error) {
+	value := parameters[VDORatioTag]
+	if value == "" {
+		return 1, nil
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 1 {
+		return 0, fmt.Errorf("%s %q must be a number not less than 1", VDORatioTag, value)
+	}
+	if maxRatio := maxVDORatio(); ratio > maxRatio {
+		return 0, fmt.Errorf("%s %q exceeds the maximum overcommit ratio %g", VDORatioTag, value, maxRatio)
+	}
+	return ratio, nil
+}
+
+// vdoPoolSize returns the physical size of the vdo pool backing a volume of
+// virtual bytes, rounded up to MiB.
+func vdoPoolSize(virtual int64, ratio float64) int64 {
+	size := int64(float64(virtual)/ratio + 0.5)
+	if size < minVDOPoolSize {
+		size = minVDOPoolSize
+	}
+	return (size + 1024*1024 - 1) / (1024 * 1024) * (1024 * 1024)
+}
+
+// vdoCreateCmd returns the lvcreate command of a vdo volume with its pool
+func vdoCreateCmd(vgName, volumeID string, size int64, unit, tags string, parameters map[string]string) (string, error) {
+	ratio, err := parseVDORatio(parameters)
+	if err != nil {
+		return "", err
+	}
+	poolSize := vdoPoolSize(sizeToBytes(size, unit), ratio)
+	return fmt.Sprintf("%s lvcreate --type vdo -n %s -L %db -V %d%s %s %s/%s%s", NsenterCmd, volumeID, poolSize, size, unit, tags, vgName, volumeID, vdoPoolSuffix), nil
+}
+
+// isVDOVolume checks whether the lvm volume is a vdo volume
+func isVDOVolume(ctx context.Context, devicePath string) (bool, error) {
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s lvs --noheadings -o segtype %s", NsenterCmd, devicePath))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == VDOType, nil
+}
+
+// extendVDOPool extends the vdo pool of the volume keeping its virtual to
+// physical ratio when the volume grows from oldSize to newSize bytes.
+func extendVDOPool(ctx context.Context, vgName, volumeID string, oldSize, newSize int64) error {
+	poolPath := fmt.Sprintf("%s/%s%s", vgName, volumeID, vdoPoolSuffix)
+	out, err := utils.RunContext(ctx, fmt.Sprintf("%s lvs --noheadings --units b --nosuffix -o lv_size %s", NsenterCmd, poolPath))
+	if err != nil {
+		return err
+	}
+	poolSize, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return err
+	}
+	newPoolSize := vdoPoolSize(newSize, float64(oldSize)/float64(poolSize))
+	if newPoolSize <= poolSize {
+		return nil
+	}
+	log.Infof("extendVDOPool: extend vdo pool %s from %d to %d bytes", poolPath, poolSize, newPoolSize)
+	_, err = utils.RunContext(ctx, fmt.Sprintf("%s lvextend -L %db %s", NsenterCmd, newPoolSize, poolPath))
+	return err
+}
+
+// removeVDOPool removes the vdo pool left by a removed vdo volume
+func removeVDOPool(vgName, volumeID string) error {
+	poolPath := fmt.Sprintf("%s/%s%s", vgName, volumeID, vdoPoolSuffix)
+	if _, err := utils.Run(fmt.Sprintf("%s lvs %s", NsenterCmd, poolPath)); err != nil {
+		return nil
+	}
+	_, err := utils.Run(fmt.Sprintf("%s lvremove -f %s", NsenterCmd, poolPath))
+	return err
+}
+
+// parseVDOPools parses the output of lvs -o vg_name,lv_name,lv_size,data_percent,vdo_saving_percent
+func parseVDOPools(out string) []vdoPool {
+	pools := []vdoPool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 5 || !strings.HasSuffix(strings.TrimSpace(fields[1]), vdoPoolSuffix) {
+			continue
+		}
+		size, _ := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		dataPercent, _ := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
+		pools = append(pools, vdoPool{
+			VGName:        strings.TrimSpace(fields[0]),
+			VolumeID:      strings.TrimSuffix(strings.TrimSpace(fields[1]), vdoPoolSuffix),
+			Size:          size,
+			DataPercent:   dataPercent,
+			SavingPercent: strings.TrimSpace(fields[4]),
+		})
+	}
+	return pools
+}
+
+// condition reports the physical usage of the pool, the logical usage is
+// the filesystem usage of NodeGetVolumeStats.
+func (pool vdoPool) condition() (bool, string) {
+	used := int64(float64(pool.Size) * pool.DataPercent / 100)
+	message := fmt.Sprintf("physical used %d of %d bytes (%.1f%%), saving %s%%", used, pool.Size, pool.DataPercent, pool.SavingPercent)
+	if pool.DataPercent >= vdoFullPercent {
+		return true, fmt.Sprintf("vdo pool is nearly full, writes fail when full: %s", message)
+	}
+	return false, message
+}
+
+// monitorVDOVolumes periodically reports the physical usage of the vdo
+// volumes in their volume condition.
+func (ns *nodeServer) monitorVDOVolumes() {
+	for {
+		cmd := fmt.Sprintf("%s lvs --noheadings --units b --nosuffix --separator '|' -o vg_name,lv_name,lv_size,data_percent,vdo_saving_percent -S 'segtype=vdo-pool'", NsenterCmd)
+		out, err := utils.Run(cmd)
+		if err != nil {
+			log.Errorf("monitorVDOVolumes: list vdo pools with error: %s", err.Error())
+		} else {
+			for _, pool := range parseVDOPools(out) {
+				abnormal, message := pool.condition()
+				setVolumeCondition(pool.VolumeID, vdoConditionSource, abnormal, message)
+			}
+		}
+		time.Sleep(vdoMonitorInterval)
+	}
+}
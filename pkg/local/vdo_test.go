@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseVDORatio(t *testing.T) {
+	assert := assert.New(t)
+	ratio, err := parseVDORatio(map[string]string{})
+	assert.Nil(err)
+	assert.Equal(float64(1), ratio)
+	ratio, err = parseVDORatio(map[string]string{VDORatioTag: "2.5"})
+	assert.Nil(err)
+	assert.Equal(2.5, ratio)
+	_, err = parseVDORatio(map[string]string{VDORatioTag: "0.5"})
+	assert.NotNil(err)
+	_, err = parseVDORatio(map[string]string{VDORatioTag: "20"})
+	assert.NotNil(err)
+
+	// reload the default after the env is restored
+	t.Cleanup(func() { assert.Nil(loadVDOMaxRatio()) })
+	t.Setenv(VDOMaxRatio, "30")
+	assert.Nil(loadVDOMaxRatio())
+	_, err = parseVDORatio(map[string]string{VDORatioTag: "20"})
+	assert.Nil(err)
+}
+
+func TestParseVDOMaxRatio(t *testing.T) {
+	assert := assert.New(t)
+	ratio, err := parseVDOMaxRatio("")
+	assert.Nil(err)
+	assert.Equal(float64(defaultVDOMaxRatio), ratio)
+	ratio, err = parseVDOMaxRatio("4.5")
+	assert.Nil(err)
+	assert.Equal(4.5, ratio)
+	_, err = parseVDOMaxRatio("0.5")
+	assert.NotNil(err)
+	_, err = parseVDOMaxRatio("ten")
+	assert.NotNil(err)
+
+	// an invalid value keeps the loaded ratio
+	t.Setenv(VDOMaxRatio, "ten")
+	assert.NotNil(loadVDOMaxRatio())
+	assert.Equal(float64(defaultVDOMaxRatio), maxVDORatio())
+}
+
+func TestVDOPoolSize(t *testing.T) {
+	assert := assert.New(t)
+	gi := int64(1024 * 1024 * 1024)
+	assert.Equal(10*gi, vdoPoolSize(100*gi, 10))
+	assert.Equal(int64(minVDOPoolSize), vdoPoolSize(10*gi, 10))
+	assert.Equal(int64(34*1024*1024*1024/3+1024*1024-1)/(1024*1024)*(1024*1024), vdoPoolSize(34*gi, 3))
+}
+
+func TestVDOCreateCmd(t *testing.T) {
+	assert := assert.New(t)
+	cmd, err := vdoCreateCmd("vg1", "lvm-1", 100, "g", "--addtag tag", map[string]string{VDORatioTag: "4"})
+	assert.Nil(err)
+	assert.Equal(NsenterCmd+" lvcreate --type vdo -n lvm-1 -L 26843545600b -V 100g --addtag tag vg1/lvm-1_vpool", cmd)
+	_, err = vdoCreateCmd("vg1", "lvm-1", 100, "g", "", map[string]string{VDORatioTag: "x"})
+	assert.NotNil(err)
+}
+
+func TestParseVDOPools(t *testing.T) {
+	assert := assert.New(t)
+	out := "  vg1|lvm-1_vpool|10737418240|95.00|60.00\n  vg1|lvm-2_vpool|10737418240|10.00|30.00\n  vg1|lvm-3|10737418240||\n"
+	pools := parseVDOPools(out)
+	assert.Equal(2, len(pools))
+	assert.Equal("lvm-1", pools[0].VolumeID)
+	abnormal, message := pools[0].condition()
+	assert.True(abnormal)
+	assert.Contains(message, "saving 60.00%")
+	abnormal, _ = pools[1].condition()
+	assert.False(abnormal)
+}
+
+func TestNodeCapacity(t *testing.T) {
+	assert := assert.New(t)
+	vgs := parseVolumeGroups("  vg1|107374182400|53687091200\n  vg2|10|bad\n")
+	assert.Equal([]volumeGroup{{Name: "vg1", Size: 107374182400, Free: 53687091200}}, vgs)
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		VGsAnnotation:     `[{"name":"vg1","size":107374182400,"free":53687091200}]`,
+		DevicesAnnotation: `[{"path":"/dev/sdb","size":100},{"path":"/dev/sdc","size":300}]`,
+	}}}
+	available, maximum, err := nodeCapacity(node, map[string]string{VgNameTag: "vg1"})
+	assert.Nil(err)
+	assert.Equal(int64(53687091200), available)
+	assert.Equal(int64(53687091200), maximum)
+	available, _, err = nodeCapacity(node, map[string]string{VgNameTag: "vg1", LvmTypeTag: VDOType, VDORatioTag: "3"})
+	assert.Nil(err)
+	assert.Equal(int64(3*53687091200), available)
+	_, _, err = nodeCapacity(node, map[string]string{VgNameTag: "vg1", LvmTypeTag: VDOType, VDORatioTag: "11"})
+	assert.NotNil(err)
+	available, maximum, err = nodeCapacity(node, map[string]string{PvTypeTag: DeviceType})
+	assert.Nil(err)
+	assert.Equal(int64(400), available)
+	assert.Equal(int64(300), maximum)
+	available, _, err = nodeCapacity(node, map[string]string{VgNameTag: "vg2"})
+	assert.Nil(err)
+	assert.Equal(int64(0), available)
+}
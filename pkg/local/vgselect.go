@@ -0,0 +1,257 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// VGSelectorTag is the storageclass parameter of the label selector over
+	// the vg tags, a vg tag key=value is matched as a label
+	VGSelectorTag = "vgSelector"
+	// VGPolicyTag is the storageclass parameter of the vg selection policy
+	VGPolicyTag = "vgPolicy"
+	// VGPolicyBinpack chooses the vg with the least free space that fits
+	VGPolicyBinpack = "binpack"
+	// VGPolicySpread chooses the vg with the fewest volumes
+	VGPolicySpread = "spread"
+	// VGPolicyMostFree chooses the vg with the most free space
+	VGPolicyMostFree = "most-free"
+	// VGAnnotation is the pv annotation recording the vg chosen on the node
+	VGAnnotation = "local.csi.ecloud.cmss.com/vg"
+)
+
+// parseVGNames splits the vgName parameter, a comma separated list of vgs
+func parseVGNames(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isMultiVG checks whether the node chooses the vg of the volume, among
+// several vgs or among the members of its storage pool.
+func isMultiVG(parameters map[string]string) bool {
+	return len(parseVGNames(parameters[VgNameTag])) > 1 || parameters[VGSelectorTag] != "" || parameters[PoolTag] != ""
+}
+
+// validateVGSelection checks the vgSelector and vgPolicy storageclass parameters
+func validateVGSelection(parameters map[string]string) error {
+	switch policy := parameters[VGPolicyTag]; policy {
+	case "", VGPolicyBinpack, VGPolicySpread, VGPolicyMostFree:
+	default:
+		return fmt.Errorf("unknown %s %q, supported: %s, %s, %s", VGPolicyTag, policy, VGPolicyBinpack, VGPolicySpread, VGPolicyMostFree)
+	}
+	if value := parameters[VGSelectorTag]; value != "" {
+		if _, err := labels.Parse(value); err != nil {
+			return fmt.Errorf("%s %q is invalid: %v", VGSelectorTag, value, err)
+		}
+	}
+	if parameters[PoolTag] != "" && (parameters[VgNameTag] != "" || parameters[VGSelectorTag] != "") {
+		return fmt.Errorf("%s can not be used with %s or %s", PoolTag, VgNameTag, VGSelectorTag)
+	}
+	return nil
+}
+
+// vgLabels converts the vg tags to labels, a tag without = is a label with an empty value
+func vgLabels(tags []string) labels.Set {
+	set := labels.Set{}
+	for _, tag := range tags {
+		key, value, _ := strings.Cut(tag, "=")
+		set[key] = value
+	}
+	return set
+}
+
+// matchVGs returns the members of the storage pool, or else the vgs in the
+// vgName list and matching the vgSelector.
+func matchVGs(vgs []volumeGroup, parameters map[string]string) ([]volumeGroup, error) {
+	if pool := parameters[PoolTag]; pool != "" {
+		matched := []volumeGroup{}
+		for _, vg := range vgs {
+			if containsString(vg.Pools, pool) {
+				matched = append(matched, vg)
+			}
+		}
+		return matched, nil
+	}
+
+	names := parseVGNames(parameters[VgNameTag])
+	selector := labels.Everything()
+	if value := parameters[VGSelectorTag]; value != "" {
+		var err error
+		if selector, err = labels.Parse(value); err != nil {
+			return nil, fmt.Errorf("%s %q is invalid: %v", VGSelectorTag, value, err)
+		}
+	}
+	matched := []volumeGroup{}
+	for _, vg := range vgs {
+		// thin pools only serve the volumes of their storage pool
+		if _, thinPool := splitThinPool(vg.Name); thinPool != "" {
+			continue
+		}
+		if len(names) > 0 && !containsString(names, vg.Name) {
+			continue
+		}
+		if !selector.Matches(vgLabels(vg.Tags)) {
+			continue
+		}
+		matched = append(matched, vg)
+	}
+	return matched, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// selectVG chooses the vg for a volume of sizeBytes by the policy, binpack
+// by default, volumes counts the driver volumes of every vg for spread.
+func selectVG(vgs []volumeGroup, volumes map[string]int, policy string, sizeBytes int64) (string, error) {
+	fits := []volumeGroup{}
+	for _, vg := range vgs {
+		if vg.Free >= sizeBytes {
+			fits = append(fits, vg)
+		}
+	}
+	if len(fits) == 0 {
+		return "", fmt.Errorf("no vg has %d bytes free among %d candidates", sizeBytes, len(vgs))
+	}
+	sort.SliceStable(fits, func(i, j int) bool {
+		switch policy {
+		case VGPolicySpread:
+			if volumes[fits[i].Name] != volumes[fits[j].Name] {
+				return volumes[fits[i].Name] < volumes[fits[j].Name]
+			}
+			return fits[i].Free > fits[j].Free
+		case VGPolicyMostFree:
+			return fits[i].Free > fits[j].Free
+		default:
+			return fits[i].Free < fits[j].Free
+		}
+	})
+	return fits[0].Name, nil
+}
+
+// countVGVolumes returns the number of driver volumes in every vg
+func countVGVolumes() (map[string]int, error) {
+	out, err := utils.Run(fmt.Sprintf("%s lvs --noheadings -o vg_name %s", NsenterCmd, localDriverTags()))
+	if err != nil {
+		return nil, err
+	}
+	volumes := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			volumes[name]++
+		}
+	}
+	return volumes, nil
+}
+
+// findVolumeVG returns the vg holding the lvm volume, empty if not created yet
+func findVolumeVG(volumeID string) (string, error) {
+	out, err := utils.Run(fmt.Sprintf("%s lvs --noheadings -o vg_name -S lv_name=%s", NsenterCmd, volumeID))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.Split(strings.TrimSpace(out), "\n")[0]), nil
+}
+
+// recordedVG returns the vg of the persistent volume, the recorded one when
+// the storageclass lets the node choose.
+func recordedVG(pv *v1.PersistentVolume) string {
+	if vgName := pv.Annotations[VGAnnotation]; vgName != "" {
+		return vgName
+	}
+	if pv.Spec.CSI == nil || isMultiVG(pv.Spec.CSI.VolumeAttributes) {
+		return ""
+	}
+	return pv.Spec.CSI.VolumeAttributes[VgNameTag]
+}
+
+// chooseVG returns the vg of a volume with several candidate vgs, the vg it
+// was created in, or the vg selected by the policy for a new volume, and
+// whether it is already recorded in the persistent volume.
+func (ns *nodeServer) chooseVG(volumeID string, volumeContext map[string]string) (string, bool, error) {
+	if !isEphemeral(volumeContext) {
+		pv, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), volumeID, metav1.GetOptions{})
+		if err != nil {
+			return "", false, err
+		}
+		if vgName := pv.Annotations[VGAnnotation]; vgName != "" {
+			return vgName, true, nil
+		}
+	}
+	vgName, err := findVolumeVG(volumeID)
+	if err != nil || vgName != "" {
+		return vgName, false, err
+	}
+	vgName, err = ns.selectVolumeVG(volumeID, volumeContext)
+	return vgName, false, err
+}
+
+// selectVolumeVG selects the vg of a new volume among the candidates by the policy
+func (ns *nodeServer) selectVolumeVG(volumeID string, volumeContext map[string]string) (string, error) {
+	allVGs, err := listVolumeGroups()
+	if err != nil {
+		return "", err
+	}
+	vgs, err := matchVGs(allVGs, volumeContext)
+	if err != nil {
+		return "", err
+	}
+	volumes, err := countVGVolumes()
+	if err != nil {
+		return "", err
+	}
+	size, unit, err := ns.getVolumeSize(volumeID, volumeContext)
+	if err != nil {
+		return "", err
+	}
+	vgName, err := selectVG(vgs, volumes, volumeContext[VGPolicyTag], sizeToBytes(size, unit))
+	if err != nil {
+		return "", err
+	}
+	log.Infof("selectVolumeVG: choose vg %s for volume %s with policy %q", vgName, volumeID, volumeContext[VGPolicyTag])
+	return vgName, nil
+}
+
+// recordVG records the vg of the volume in the persistent volume
+func (ns *nodeServer) recordVG(volumeID, vgName string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, VGAnnotation, vgName)
+	_, err := ns.client.CoreV1().PersistentVolumes().Patch(context.Background(), volumeID, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateVGSelection(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateVGSelection(map[string]string{}))
+	assert.Nil(validateVGSelection(map[string]string{VGSelectorTag: "tier=ssd", VGPolicyTag: VGPolicySpread}))
+	assert.NotNil(validateVGSelection(map[string]string{VGPolicyTag: "random"}))
+	assert.NotNil(validateVGSelection(map[string]string{VGSelectorTag: "tier in (ssd"}))
+	assert.False(isMultiVG(map[string]string{VgNameTag: "vg1"}))
+	assert.True(isMultiVG(map[string]string{VgNameTag: "vg1, vg2"}))
+	assert.True(isMultiVG(map[string]string{VGSelectorTag: "tier=ssd"}))
+}
+
+func TestMatchVGs(t *testing.T) {
+	assert := assert.New(t)
+	vgs := parseVolumeGroups("  vg-ssd1|100|50|tier=ssd\n  vg-ssd2|100|80|tier=ssd,fast\n  vg-hdd|100|90|\n")
+	assert.Equal([]string{"tier=ssd", "fast"}, vgs[1].Tags)
+
+	matched, err := matchVGs(vgs, map[string]string{VgNameTag: "vg-ssd1,vg-hdd"})
+	assert.Nil(err)
+	assert.Equal(2, len(matched))
+	matched, err = matchVGs(vgs, map[string]string{VGSelectorTag: "tier=ssd"})
+	assert.Nil(err)
+	assert.Equal(2, len(matched))
+	matched, err = matchVGs(vgs, map[string]string{VGSelectorTag: "fast"})
+	assert.Nil(err)
+	assert.Equal("vg-ssd2", matched[0].Name)
+	matched, err = matchVGs(vgs, map[string]string{VgNameTag: "vg-hdd", VGSelectorTag: "tier=ssd"})
+	assert.Nil(err)
+	assert.Equal(0, len(matched))
+}
+
+func TestSelectVG(t *testing.T) {
+	assert := assert.New(t)
+	vgs := []volumeGroup{{Name: "vg1", Free: 50}, {Name: "vg2", Free: 80}, {Name: "vg3", Free: 20}}
+	volumes := map[string]int{"vg1": 1, "vg2": 3}
+
+	vgName, err := selectVG(vgs, volumes, "", 30)
+	assert.Nil(err)
+	assert.Equal("vg1", vgName)
+	vgName, err = selectVG(vgs, volumes, VGPolicyMostFree, 30)
+	assert.Nil(err)
+	assert.Equal("vg2", vgName)
+	vgName, err = selectVG(vgs, volumes, VGPolicySpread, 10)
+	assert.Nil(err)
+	assert.Equal("vg3", vgName)
+	vgName, err = selectVG(vgs, volumes, VGPolicySpread, 30)
+	assert.Nil(err)
+	assert.Equal("vg1", vgName)
+	_, err = selectVG(vgs, volumes, VGPolicyBinpack, 100)
+	assert.NotNil(err)
+}
+
+func TestRecordedVG(t *testing.T) {
+	assert := assert.New(t)
+	pv := &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+		CSI: &v1.CSIPersistentVolumeSource{VolumeAttributes: map[string]string{VgNameTag: "vg1"}},
+	}}}
+	assert.Equal("vg1", recordedVG(pv))
+	pv.Spec.CSI.VolumeAttributes[VgNameTag] = "vg1,vg2"
+	assert.Equal("", recordedVG(pv))
+	pv.ObjectMeta = metav1.ObjectMeta{Annotations: map[string]string{VGAnnotation: "vg2"}}
+	assert.Equal("vg2", recordedVG(pv))
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// WipePolicyTag is the storageclass parameter of the wipe policy on delete
+	WipePolicyTag = "wipePolicy"
+	// WipePolicyNone removes the lvm volume without wiping
+	WipePolicyNone = "none"
+	// WipePolicyDiscard discards the lvm volume blocks with blkdiscard
+	WipePolicyDiscard = "discard"
+	// WipePolicyZero overwrites the lvm volume with zeros
+	WipePolicyZero = "zero"
+	// WipePolicyShred overwrites the lvm volume with random data and then zeros
+	WipePolicyShred = "shred"
+
+	// wipeTagPrefix is the lvm tag prefix recording the wipe policy
+	wipeTagPrefix = "wipe_"
+	// wipeStateKind is the node state kind of wipe progress
+	wipeStateKind = "wipe"
+	// reclaimInterval is the interval to look for deleted volumes
+	reclaimInterval = time.Minute
+	// wipeChunkSize is the size of a single write
+	wipeChunkSize = 4 * 1024 * 1024
+	// wipeCheckpointSize is the size written between two progress checkpoints
+	wipeCheckpointSize = 1024 * 1024 * 1024
+)
+
+// wipeState is the progress of a volume wipe, saved in the node state so
+// the wipe resumes after a plugin restart.
+type wipeState struct {
+	VGName string `json:"vgName"`
+	LVName string `json:"lvName"`
+	// Device is the raw disk of device volumes, empty for lvm volumes
+	Device string `json:"device,omitempty"`
+	// DeviceID is the stable identity of the raw disk, its kernel path is
+	// resolved again before the wipe resumes
+	DeviceID string `json:"deviceID,omitempty"`
+	Policy   string `json:"policy"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	// Pass is the overwrite pass of Offset, shred writes random data in
+	// pass 0 and zeros in pass 1
+	Pass      int       `json:"pass,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	// wipingVolumes the volumes being wiped
+	wipingVolumes = map[string]bool{}
+	// wipingVolumesMutex Mutex for wipingVolumes map
+	wipingVolumesMutex sync.Mutex
+)
+
+// validateWipePolicy checks the wipe policy storageclass parameter
+func validateWipePolicy(policy string) error {
+	switch policy {
+	case "", WipePolicyNone, WipePolicyDiscard, WipePolicyZero, WipePolicyShred:
+		return nil
+	}
+	return fmt.Errorf("unknown %s %q, supported: %s, %s, %s, %s", WipePolicyTag, policy, WipePolicyNone, WipePolicyDiscard, WipePolicyZero, WipePolicyShred)
+}
+
+// isVolumeWiping checks whether the lvm volume has an incomplete wipe
+func isVolumeWiping(volumeID string) bool {
+	state := &wipeState{}
+	return loadNodeState(wipeStateKind, volumeID, state) == nil
+}
+
+// reclaimVolumes periodically wipes and removes the lvm volumes whose
+// persistent volume has been deleted.
+func (ns *nodeServer) reclaimVolumes() {
+	for {
+		ns.reclaimDeletedVolumes()
+		ns.reclaimQuotaPaths()
+		ns.reclaimDevices()
+		time.Sleep(reclaimInterval)
+	}
+}
+
+func (ns *nodeServer) reclaimDeletedVolumes() {
+	lvs, err := listLogicalVolumes(localDriverTags())
+	if err != nil {
+		log.Errorf("reclaimVolumes: list lvm volumes with error: %s", err.Error())
+		return
+	}
+	lvNames := map[string]bool{}
+	for _, lv := range lvs {
+		lvNames[lv.Name] = true
+	}
+
+	// resume the wipes interrupted by a restart first
+	names, err := listNodeStates(wipeStateKind)
+	if err != nil {
+		log.Errorf("reclaimVolumes: list wipe states with error: %s", err.Error())
+	}
+	for _, name := range names {
+		state := &wipeState{}
+		if err := loadNodeState(wipeStateKind, name, state); err != nil {
+			log.Errorf("reclaimVolumes: load wipe state %s with error: %s", name, err.Error())
+			continue
+		}
+		if state.Device == "" && !lvNames[name] {
+			// the lvm volume was removed after the wipe completed
+			_ = removeNodeState(wipeStateKind, name)
+			continue
+		}
+		ns.startWipe(state)
+	}
+
+	for _, lv := range lvs {
+		// ephemeral inline volumes have no persistent volume, vdo pools go with their volume,
+		// migrating volumes are handled by the migration
+		if lv.HasTag(utils.EphemeralLVTag) || lv.IsVDOPool() || lv.IsSnapshot() || isVolumeWiping(lv.Name) || isVolumeMigrating(lv.Name) {
+			continue
+		}
+		_, err := ns.client.CoreV1().PersistentVolumes().Get(context.Background(), lv.Name, metav1.GetOptions{})
+		if err == nil || !apierrors.IsNotFound(err) {
+			continue
+		}
+		if volumeInUse(lv) {
+			log.Warnf("reclaimVolumes: persistent volume %s is deleted but lvm volume %s is still open", lv.Name, lv.DevicePath())
+			continue
+		}
+		log.Infof("reclaimVolumes: persistent volume %s is deleted, reclaim lvm volume %s", lv.Name, lv.DevicePath())
+		if err := ns.releaseVolume(lv); err != nil {
+			log.Errorf("reclaimVolumes: release lvm volume %s with error: %s", lv.DevicePath(), err.Error())
+		}
+	}
+}
+
+// releaseVolume wipes the lvm volume with its wipe policy and removes it in background
+func (ns *nodeServer) releaseVolume(lv *logicalVolume) error {
+	policy := lv.TagValue(wipeTagPrefix)
+	if policy == "" {
+		policy = WipePolicyNone
+	}
+	state := &wipeState{
+		VGName:    lv.VGName,
+		LVName:    lv.Name,
+		Policy:    policy,
+		Size:      lv.Size,
+		StartedAt: time.Now(),
+	}
+	// the lvm volume keeps its extents until the wipe completes, the state
+	// resumes the wipe if the plugin restarts meanwhile.
+	if err := saveNodeState(wipeStateKind, lv.Name, state); err != nil {
+		return err
+	}
+	log.Infof("releaseVolume: wipe lvm volume %s with wipe policy %s", lv.DevicePath(), policy)
+	ns.startWipe(state)
+	return nil
+}
+
+// startWipe wipes and removes the volume in background, unless it is already in progress
+func (ns *nodeServer) startWipe(state *wipeState) {
+	wipingVolumesMutex.Lock()
+	defer wipingVolumesMutex.Unlock()
+	if wipingVolumes[state.LVName] {
+		return
+	}
+	wipingVolumes[state.LVName] = true
+
+	go func() {
+		defer func() {
+			wipingVolumesMutex.Lock()
+			delete(wipingVolumes, state.LVName)
+			wipingVolumesMutex.Unlock()
+		}()
+		// the kernel name of the disk may have changed since the wipe started
+		if state.DeviceID != "" {
+			devicePath, err := devicePathByID(state.DeviceID)
+			if err != nil {
+				log.Errorf("wipeVolume: resolve device of %s with error: %s", state.LVName, err.Error())
+				return
+			}
+			state.Device = devicePath
+		}
+		if err := wipeVolume(state); err != nil {
+			log.Errorf("wipeVolume: wipe %s with policy %s failed: %s", state.devicePath(), state.Policy, err.Error())
+			state.Error = err.Error()
+			_ = saveNodeState(wipeStateKind, state.LVName, state)
+			return
+		}
+		// remove the lvm volume, or the signatures so the disk is advertised free again
+		removeCmd := fmt.Sprintf("%s lvremove -f %s", NsenterCmd, state.devicePath())
+		if state.Device != "" {
+			removeCmd = fmt.Sprintf("%s wipefs -a %s", NsenterCmd, state.Device)
+		}
+		if _, err := utils.Run(removeCmd); err != nil {
+			log.Errorf("wipeVolume: remove %s with error: %s", state.devicePath(), err.Error())
+			return
+		}
+		if state.Device == "" {
+			if err := removeVDOPool(state.VGName, state.LVName); err != nil {
+				log.Errorf("wipeVolume: remove vdo pool of %s with error: %s", state.devicePath(), err.Error())
+				return
+			}
+		}
+		if err := removeNodeState(wipeStateKind, state.LVName); err != nil {
+			log.Errorf("wipeVolume: remove wipe state of %s with error: %s", state.LVName, err.Error())
+		}
+		clearVolumeCondition(state.LVName)
+		clearRaidHealth(state.LVName)
+		log.Infof("wipeVolume: %s wiped with policy %s and removed, took %s", state.devicePath(), state.Policy, time.Since(state.StartedAt))
+	}()
+}
+
+// devicePath returns the path of the wiped disk or lvm volume
+func (state *wipeState) devicePath() string {
+	if state.Device != "" {
+		return state.Device
+	}
+	return fmt.Sprintf("/dev/%s/%s", state.VGName, state.LVName)
+}
+
+// wipeVolume wipes the lvm volume or disk according to its policy
+func wipeVolume(state *wipeState) error {
+	devicePath := state.devicePath()
+	// remove the cache first, the origin is wiped directly
+	if state.Device == "" {
+		if err := removeCache(state.LVName); err != nil {
+			return err
+		}
+	}
+	switch state.Policy {
+	case WipePolicyNone:
+		return nil
+	case WipePolicyDiscard:
+		cmd := fmt.Sprintf("%s blkdiscard %s", NsenterCmd, devicePath)
+		if _, err := utils.Run(cmd); err != nil {
+			// not every device supports discard, never leave the data readable
+			log.Warnf("wipeVolume: discard %s failed, fallback to zero: %s", devicePath, err.Error())
+			return zeroDevice(devicePath, state)
+		}
+		return nil
+	case WipePolicyZero:
+		return zeroDevice(devicePath, state)
+	case WipePolicyShred:
+		return shredDevice(devicePath, state)
+	}
+	return fmt.Errorf("unknown wipe policy %q", state.Policy)
+}
+
+// zeroDevice overwrites the device with zeros from state.Offset, saving
+// the progress at every checkpoint.
+func zeroDevice(devicePath string, state *wipeState) error {
+	return overwriteDevice(devicePath, state, false)
+}
+
+// shredDevice overwrites the device with random data and then with zeros,
+// both passes resume from their checkpoint like zeroDevice.
+func shredDevice(devicePath string, state *wipeState) error {
+	if state.Pass == 0 {
+		if err := overwriteDevice(devicePath, state, true); err != nil {
+			return err
+		}
+		state.Pass, state.Offset = 1, 0
+		if err := saveNodeState(wipeStateKind, state.LVName, state); err != nil {
+			log.Warnf("shredDevice: save wipe progress of %s with error: %s", state.LVName, err.Error())
+		}
+	}
+	return overwriteDevice(devicePath, state, false)
+}
+
+// overwriteDevice overwrites the device with zeros or random data from
+// state.Offset, saving the progress at every checkpoint.
+func overwriteDevice(devicePath string, state *wipeState, random bool) error {
+	f, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(state.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, wipeChunkSize)
+	lastCheckpoint := state.Offset
+	for state.Offset < state.Size {
+		chunk := buffer
+		if remaining := state.Size - state.Offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if random {
+			if _, err := rand.Read(chunk); err != nil {
+				return err
+			}
+		}
+		n, err := f.Write(chunk)
+		if err != nil {
+			return err
+		}
+		state.Offset += int64(n)
+		if state.Offset-lastCheckpoint >= wipeCheckpointSize || state.Offset >= state.Size {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			lastCheckpoint = state.Offset
+			if err := saveNodeState(wipeStateKind, state.LVName, state); err != nil {
+				log.Warnf("overwriteDevice: save wipe progress of %s with error: %s", state.LVName, err.Error())
+			}
+			log.Infof("overwriteDevice: wiping %s pass %d, progress %d%%", devicePath, state.Pass, state.Offset*100/state.Size)
+		}
+	}
+	return nil
+}
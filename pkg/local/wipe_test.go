@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateWipePolicy(t *testing.T) {
+	assert := assert.New(t)
+	for _, policy := range []string{"", WipePolicyNone, WipePolicyDiscard, WipePolicyZero, WipePolicyShred} {
+		assert.Nil(validateWipePolicy(policy))
+	}
+	assert.NotNil(validateWipePolicy("random"))
+
+	assert.Equal("--addtag local.csi.ecloud.cmss.com --addtag wipe_zero", volumeTags(DefaultDriverName, map[string]string{WipePolicyTag: WipePolicyZero}))
+	assert.Equal("--addtag local.csi.ecloud.cmss.com --addtag wipe_none", volumeTags(DefaultDriverName, map[string]string{}))
+}
+
+func TestZeroDevice(t *testing.T) {
+	assert := assert.New(t)
+	rootDir := utils.KubeletRootDir
+	utils.KubeletRootDir = t.TempDir()
+	defer func() { utils.KubeletRootDir = rootDir }()
+
+	devicePath := filepath.Join(t.TempDir(), "device")
+	assert.Nil(os.WriteFile(devicePath, []byte("tenant data"), 0644))
+
+	state := &wipeState{VGName: "vg", LVName: "lvm-wipe", Policy: WipePolicyZero, Size: 11, Offset: 2}
+	assert.Nil(zeroDevice(devicePath, state))
+	assert.Equal(int64(11), state.Offset)
+
+	data, err := os.ReadFile(devicePath)
+	assert.Nil(err)
+	assert.Equal(append([]byte("te"), make([]byte, 9)...), data)
+	assert.True(isVolumeWiping("lvm-wipe"))
+}
+
+func TestShredDevice(t *testing.T) {
+	assert := assert.New(t)
+	rootDir := utils.KubeletRootDir
+	utils.KubeletRootDir = t.TempDir()
+	defer func() { utils.KubeletRootDir = rootDir }()
+
+	devicePath := filepath.Join(t.TempDir(), "device")
+	assert.Nil(os.WriteFile(devicePath, []byte("tenant data"), 0644))
+
+	// resume the zero pass of an interrupted shred
+	state := &wipeState{VGName: "vg", LVName: "lvm-shred", Policy: WipePolicyShred, Size: 11, Offset: 4, Pass: 1}
+	assert.Nil(shredDevice(devicePath, state))
+	data, err := os.ReadFile(devicePath)
+	assert.Nil(err)
+	assert.Equal(append([]byte("tena"), make([]byte, 7)...), data)
+
+	state = &wipeState{VGName: "vg", LVName: "lvm-shred", Policy: WipePolicyShred, Size: 11}
+	assert.Nil(shredDevice(devicePath, state))
+	assert.Equal(1, state.Pass)
+	assert.Equal(int64(11), state.Offset)
+	data, err = os.ReadFile(devicePath)
+	assert.Nil(err)
+	assert.Equal(make([]byte, 11), data)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DurationBuckets are the upper bounds in seconds of the rpc and command latencies
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	// RPCDuration is the latency of the csi rpcs by driver instance and method
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "local_csi_rpc_duration_seconds", Help: "Latency of the CSI RPCs.", Buckets: DurationBuckets,
+	}, []string{"driver", "method"})
+	// RPCErrors counts the failed csi rpcs by driver instance, method and grpc code
+	RPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "local_csi_rpc_errors_total", Help: "Failed CSI RPCs.",
+	}, []string{"driver", "method", "code"})
+
+	// LVMCommandDuration is the latency of the lvm commands
+	LVMCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "local_csi_lvm_command_duration_seconds", Help: "Latency of the lvm commands.", Buckets: DurationBuckets,
+	}, []string{"command"})
+	// LVMCommandFailures counts the failed lvm commands
+	LVMCommandFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "local_csi_lvm_command_failures_total", Help: "Failed lvm commands.",
+	}, []string{"command"})
+
+	// VGSizeBytes is the size of the volume groups of the node
+	VGSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_csi_vg_size_bytes", Help: "Size of the volume group.",
+	}, []string{"vg"})
+	// VGFreeBytes is the free space of the volume groups of the node
+	VGFreeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_csi_vg_free_bytes", Help: "Free space of the volume group.",
+	}, []string{"vg"})
+	// VGVolumes is the number of volumes of the drivers in the volume groups
+	VGVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_csi_vg_volumes", Help: "Logical volumes of the drivers in the volume group.",
+	}, []string{"vg"})
+
+	// VolumeCapacityBytes is the size of the volumes of the node by the driver of their pv
+	VolumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_csi_volume_capacity_bytes", Help: "Size of the volume.",
+	}, []string{"driver", "volume", "vg"})
+	// VolumeIOLimit is the io limits of the volumes of the node, readIOPS, writeIOPS, readBPS or writeBPS
+	VolumeIOLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_csi_volume_io_limit", Help: "IO limit setting of the volume.",
+	}, []string{"driver", "volume", "limit"})
+	// VolumeCacheHitRatio is the read and write hit ratio of the cached volumes of the node
+	VolumeCacheHitRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_csi_volume_cache_hit_ratio", Help: "Cache hit ratio of the volume, 0 to 1.",
+	}, []string{"driver", "volume", "op"})
+
+	// OMFixes counts the issues fixed by the storage om
+	OMFixes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "local_csi_om_fixes_total", Help: "Issues handled by the storage om.",
+	}, []string{"issue", "result"})
+)
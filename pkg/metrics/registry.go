@@ -0,0 +1,47 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var registerOnce sync.Once
+
+// Register registers the metrics with the node label, once for all the
+// driver instances of the node
+func Register(node string) {
+	registerOnce.Do(func() {
+		registerer := prometheus.WrapRegistererWith(prometheus.Labels{"node": node}, prometheus.DefaultRegisterer)
+		registerer.MustRegister(
+			RPCDuration, RPCErrors,
+			LVMCommandDuration, LVMCommandFailures,
+			VGSizeBytes, VGFreeBytes, VGVolumes,
+			VolumeCapacityBytes, VolumeIOLimit, VolumeCacheHitRatio,
+			OMFixes,
+		)
+	})
+}
+
+// Handler serves the metrics to prometheus
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
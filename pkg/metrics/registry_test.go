@@ -0,0 +1,41 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister(t *testing.T) {
+	assert := assert.New(t)
+	Register("node1")
+	// the driver instances of the node share the metrics
+	Register("node2")
+	RPCErrors.WithLabelValues("local.csi.ecloud.cmss.com", "NodePublishVolume", "Internal").Inc()
+	VGFreeBytes.WithLabelValues("vg1").Set(1024)
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	out := recorder.Body.String()
+	assert.Contains(out, "# TYPE local_csi_rpc_errors_total counter")
+	assert.Contains(out, `local_csi_rpc_errors_total{code="Internal",driver="local.csi.ecloud.cmss.com",method="NodePublishVolume",node="node1"} 1`)
+	assert.Contains(out, `local_csi_vg_free_bytes{node="node1",vg="vg1"} 1024`)
+	assert.NotContains(out, "node2")
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package om
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// WipeNoneLVTag is the lvm tag of volumes removed without wiping, same as the lvm plugin
+	WipeNoneLVTag = "wipe_none"
+)
+
+// ephemeralVolume is an lvm volume of ephemeral inline volume
+type ephemeralVolume struct {
+	VGName   string
+	LVName   string
+	PodUID   string
+	Open     bool
+	WipeNone bool
+}
+
+// FixEphemeralVolumeIssue removes the ephemeral inline lvm volumes whose pod
+// no longer exists on the node, e.g. when NodeUnpublishVolume never came.
+func FixEphemeralVolumeIssue() {
+	// only the node plugin sees the pods of the node
+	podsPath := filepath.Join(utils.KubeletRootDir, "pods")
+	if os.Getenv(utils.ServiceType) == utils.ProvisionerService || !IsFileExisting(podsPath) {
+		return
+	}
+
+	cmd := fmt.Sprintf("%s lvs --noheadings --separator '|' -o vg_name,lv_name,lv_attr,lv_tags @%s", NsenterCmd, utils.EphemeralLVTag)
+	out, err := Run(cmd)
+	if err != nil {
+		log.Errorf("EphemeralVolume: list ephemeral lvm volumes with error: %s", err.Error())
+		return
+	}
+
+	for _, volume := range parseEphemeralVolumes(out) {
+		if volume.PodUID == "" || volume.Open || IsFileExisting(filepath.Join(podsPath, volume.PodUID)) {
+			continue
+		}
+		lvPath := volume.VGName + "/" + volume.LVName
+		if volume.WipeNone {
+			if _, err := Run(fmt.Sprintf("%s lvremove -f %s", NsenterCmd, lvPath)); err != nil {
+				log.Errorf("EphemeralVolume: remove lvm volume %s of deleted pod %s with error: %s", lvPath, volume.PodUID, err.Error())
+				recordFix(IssueEphemeralVolume, false, fmt.Sprintf("remove lvm volume %s of deleted pod %s: %s", lvPath, volume.PodUID, err.Error()))
+				continue
+			}
+			log.Infof("EphemeralVolume: Successful remove lvm volume %s of deleted pod %s", lvPath, volume.PodUID)
+			recordFix(IssueEphemeralVolume, true, fmt.Sprintf("removed lvm volume %s of deleted pod %s", lvPath, volume.PodUID))
+			continue
+		}
+
+		// hand over to the lvm plugin which wipes the volume before removing it
+		if _, err := Run(fmt.Sprintf("%s lvchange --deltag %s %s", NsenterCmd, utils.EphemeralLVTag, lvPath)); err != nil {
+			log.Errorf("EphemeralVolume: release lvm volume %s of deleted pod %s with error: %s", lvPath, volume.PodUID, err.Error())
+			recordFix(IssueEphemeralVolume, false, fmt.Sprintf("release lvm volume %s of deleted pod %s: %s", lvPath, volume.PodUID, err.Error()))
+			continue
+		}
+		log.Infof("EphemeralVolume: Successful release lvm volume %s of deleted pod %s for wiping", lvPath, volume.PodUID)
+		recordFix(IssueEphemeralVolume, true, fmt.Sprintf("released lvm volume %s of deleted pod %s for wiping", lvPath, volume.PodUID))
+	}
+}
+
+// parseEphemeralVolumes parses the output of lvs for ephemeral volumes
+func parseEphemeralVolumes(out string) []ephemeralVolume {
+	volumes := []ephemeralVolume{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 4 {
+			continue
+		}
+		attr := strings.TrimSpace(fields[2])
+		volume := ephemeralVolume{
+			VGName: strings.TrimSpace(fields[0]),
+			LVName: strings.TrimSpace(fields[1]),
+			Open:   len(attr) > 5 && attr[5] == 'o',
+		}
+		tags := strings.Split(fields[3], ",")
+		volume.PodUID = utils.EphemeralPodUID(tags)
+		for _, tag := range tags {
+			if strings.TrimSpace(tag) == WipeNoneLVTag {
+				volume.WipeNone = true
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes
+}
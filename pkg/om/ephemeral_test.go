@@ -0,0 +1,37 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package om
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEphemeralVolumes(t *testing.T) {
+	assert := assert.New(t)
+	out := "  vg1|csi-6a5b|-wi-ao----|local.csi.ecloud.cmss.com,wipe_none,ephemeral,pod_c06d5521-3d9c-4517-bdc2-e6df34b9e8f1\n" +
+		"  vg1|csi-7c8d|-wi-a-----|local.csi.ecloud.cmss.com,wipe_zero,ephemeral,pod_a60244b2-e6ee-4a63-b311-13f7b29ef49a\n"
+	volumes := parseEphemeralVolumes(out)
+	assert.Len(volumes, 2)
+	assert.Equal("csi-6a5b", volumes[0].LVName)
+	assert.Equal("c06d5521-3d9c-4517-bdc2-e6df34b9e8f1", volumes[0].PodUID)
+	assert.True(volumes[0].Open)
+	assert.True(volumes[0].WipeNone)
+	assert.False(volumes[1].Open)
+	assert.False(volumes[1].WipeNone)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package om
+
+import (
+	"os"
+	"sync"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/utils"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// NodeNameEnv is the env of the node name the om events are recorded on
+	NodeNameEnv = "KUBE_NODE_NAME"
+
+	// StorageRepairedReason event reason, the om fixed an issue of the node
+	StorageRepairedReason = "StorageRepaired"
+	// StorageRepairFailedReason event reason, the om failed to fix an issue of the node
+	StorageRepairFailedReason = "StorageRepairFailed"
+)
+
+var (
+	recorder     record.EventRecorder
+	recorderOnce sync.Once
+)
+
+// fixReason returns the event type and reason of an om fix
+func fixReason(fixed bool) (string, string) {
+	if fixed {
+		return v1.EventTypeNormal, StorageRepairedReason
+	}
+	return v1.EventTypeWarning, StorageRepairFailedReason
+}
+
+// recordFix counts the om fix and records it as an event on the node
+func recordFix(issue string, fixed bool, message string) {
+	result := FixSucceeded
+	if !fixed {
+		result = FixFailed
+	}
+	metrics.OMFixes.WithLabelValues(issue, result).Inc()
+
+	nodeName := os.Getenv(NodeNameEnv)
+	if nodeName == "" {
+		return
+	}
+	recorderOnce.Do(func() { recorder = utils.NewEventRecorder() })
+	eventType, reason := fixReason(fixed)
+	objectRef := &v1.ObjectReference{Kind: "Node", Name: nodeName, APIVersion: "v1"}
+	utils.CreateEvent(recorder, objectRef, eventType, reason, issue+": "+message)
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package om
+
+import (
+	"testing"
+
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+)
+
+func TestRecordFix(t *testing.T) {
+	assert := assert.New(t)
+	eventType, reason := fixReason(true)
+	assert.Equal(v1.EventTypeNormal, eventType)
+	assert.Equal(StorageRepairedReason, reason)
+	eventType, reason = fixReason(false)
+	assert.Equal(v1.EventTypeWarning, eventType)
+	assert.Equal(StorageRepairFailedReason, reason)
+
+	// without the node name only the metrics are recorded
+	t.Setenv(NodeNameEnv, "")
+	recordFix(IssueOrphanedPod, false, "orphaned pod")
+	assert.Equal(1.0, testutil.ToFloat64(metrics.OMFixes.WithLabelValues(IssueOrphanedPod, FixFailed)))
+}
@@ -17,9 +17,8 @@ limitations under the License.
 package om
 
 import (
-	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -38,11 +37,19 @@ const (
 	IssueOrphanedPod = "ISSUE_ORPHANED_POD"
 	// MessageFileLines tag
 	MessageFileLines = "MESSAGE_FILE_LINES"
+	// IssueEphemeralVolume tag
+	IssueEphemeralVolume = "ISSUE_EPHEMERAL_VOLUME"
+	// FixSucceeded is the om metrics result of a fixed issue
+	FixSucceeded = "succeeded"
+	// FixFailed is the om metrics result of an issue failed to fix
+	FixFailed = "failed"
 )
 
 var (
 	// GlobalConfigVar var
 	GlobalConfigVar GlobalConfig
+	// globalConfigMutex guards GlobalConfigVar against the config reloads
+	globalConfigMutex sync.RWMutex
 )
 
 // GlobalConfig save global values for om
@@ -51,21 +58,33 @@ type GlobalConfig struct {
 	MessageFileTailLines int
 	IssueBlockReference  bool
 	IssueOrphanedPod     bool
+	IssueEphemeralVolume bool
 }
 
-// StorageOM storage Operation and Maintenance
-func StorageOM() {
-	GlobalConfigSet()
-
+// StorageOM storage Operation and Maintenance, returns once stop is closed
+func StorageOM(stop <-chan struct{}) {
 	for {
+		// the settings are not changed during a check
+		globalConfigMutex.RLock()
 		// fix block volume reference not removed issue;
 		// error message: The device %q is still referenced from other Pods;
 		if GlobalConfigVar.IssueBlockReference {
 			CheckMessageFileIssue()
 		}
 
+		// remove ephemeral inline volumes of deleted pods
+		if GlobalConfigVar.IssueEphemeralVolume {
+			FixEphemeralVolumeIssue()
+		}
+		globalConfigMutex.RUnlock()
+
 		// loop interval time
-		time.Sleep(time.Duration(time.Second * 10))
+		select {
+		case <-stop:
+			log.Info("StorageOM: stopped")
+			return
+		case <-time.After(time.Second * 10):
+		}
 	}
 }
 
@@ -79,48 +98,24 @@ func CheckMessageFileIssue() {
 		// Fix Block Volume Reference Issue;
 		if GlobalConfigVar.IssueBlockReference && strings.Contains(line, "is still referenced from other Pods") {
 			if FixReferenceMountIssue(line) {
+				recordFix(IssueBlockReference, true, line)
 				return
 			}
+			recordFix(IssueBlockReference, false, line)
 			// Fix Orphaned Pod Issue
 		} else if GlobalConfigVar.IssueOrphanedPod && strings.Contains(line, "rphaned pod") && strings.Contains(line, "found, but volume paths are still present on disk") {
 			if FixOrphanedPodIssue(line) {
+				recordFix(IssueOrphanedPod, true, line)
 				return
 			}
+			recordFix(IssueOrphanedPod, false, line)
 		}
 	}
 }
 
-// GlobalConfigSet set Global Config
-func GlobalConfigSet() {
-	GlobalConfigVar.IssueMessageFile = false
-	messageFile := os.Getenv(IssueMessageFile)
-	if messageFile == "true" {
-		GlobalConfigVar.IssueMessageFile = true
-	}
-
-	GlobalConfigVar.MessageFileTailLines = 20
-	messageFileLine := os.Getenv(MessageFileLines)
-	if messageFileLine != "" {
-		lineNum, err := strconv.Atoi(messageFileLine)
-		if err != nil {
-			log.Errorf("OM GlobalConfigSet: MessageFileLines error format: %s", messageFileLine)
-		} else {
-			GlobalConfigVar.MessageFileTailLines = lineNum
-			if GlobalConfigVar.MessageFileTailLines > 500 {
-				log.Warnf("OM GlobalConfigSet: MessageFileLines too large: %s", messageFileLine)
-			}
-		}
-	}
-
-	GlobalConfigVar.IssueBlockReference = false
-	blockRef := os.Getenv(IssueBlockReference)
-	if blockRef == "true" {
-		GlobalConfigVar.IssueBlockReference = true
-	}
-
-	GlobalConfigVar.IssueOrphanedPod = false
-	orphanedPod := os.Getenv(IssueOrphanedPod)
-	if orphanedPod == "true" {
-		GlobalConfigVar.IssueOrphanedPod = true
-	}
+// SetGlobalConfig sets the om settings, they apply from the next check
+func SetGlobalConfig(config GlobalConfig) {
+	globalConfigMutex.Lock()
+	defer globalConfigMutex.Unlock()
+	GlobalConfigVar = config
 }
@@ -0,0 +1,219 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat is appended to the base name of rotated log files.
+const rotatedTimeFormat = "-2006-01-02-15:04:05.000"
+
+// RotatingFile is an io.Writer appending to a log file that is rotated
+// when it grows past MaxSize bytes or gets older than MaxAge.
+type RotatingFile struct {
+	Path string
+	// MaxSize rotates the file once it would exceed this many bytes, 0 disables.
+	MaxSize int64
+	// MaxAge rotates the file once it was opened this long ago, 0 disables.
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files kept, 0 keeps all of them.
+	MaxFiles int
+	// Compress gzips rotated files.
+	Compress bool
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	now      func() time.Time
+}
+
+// Open opens the log file, rotating it first if it is already too large.
+func (r *RotatingFile) Open() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.now == nil {
+		r.now = time.Now
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.MaxSize > 0 && r.size > r.MaxSize {
+		return r.rotate()
+	}
+	return nil
+}
+
+// Write writes p to the log file, rotating it beforehand if needed.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		if r.now == nil {
+			r.now = time.Now
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.needRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// SetLimits changes the rotation and retention limits, they apply from the next write.
+func (r *RotatingFile) SetLimits(maxSize int64, maxAge time.Duration, maxFiles int, compress bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.MaxSize, r.MaxAge, r.MaxFiles, r.Compress = maxSize, maxAge, maxFiles, compress
+}
+
+// Close closes the current log file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) needRotate(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.MaxSize > 0 && r.size+n > r.MaxSize {
+		return true
+	}
+	return r.MaxAge > 0 && r.now().Sub(r.openedAt) >= r.MaxAge
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = fi.Size()
+	r.openedAt = r.now()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	ext := filepath.Ext(r.Path)
+	rotated := strings.TrimSuffix(r.Path, ext) + r.now().Format(rotatedTimeFormat) + ext
+	if err := os.Rename(r.Path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "compress log file %s failed: %v\n", rotated, err)
+		}
+	}
+	r.prune()
+	return nil
+}
+
+// RotatedFiles returns the rotated files of the log, oldest first.
+func (r *RotatingFile) RotatedFiles() []string {
+	ext := filepath.Ext(r.Path)
+	base := strings.TrimSuffix(r.Path, ext)
+	matches, _ := filepath.Glob(base + "-*" + ext + "*")
+	files := []string{}
+	for _, m := range matches {
+		name := strings.TrimSuffix(m, ".gz")
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, base), ext)
+		if _, err := time.Parse(rotatedTimeFormat, stamp); err != nil {
+			// also keep pruning files rotated at startup by older versions
+			if _, err := time.Parse("-2006-01-02-15:04:05", stamp); err != nil {
+				continue
+			}
+		}
+		files = append(files, m)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (r *RotatingFile) prune() {
+	if r.MaxFiles <= 0 {
+		return
+	}
+	files := r.RotatedFiles()
+	for len(files) > r.MaxFiles {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "remove log file %s failed: %v\n", files[0], err)
+		}
+		files = files[1:]
+	}
+}
+
+// gzipFile replaces file by its gzip compressed copy file.gz.
+func gzipFile(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(file+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file + ".gz")
+		return err
+	}
+	return os.Remove(file)
+}
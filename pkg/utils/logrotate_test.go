@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFileSize(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	clock := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &RotatingFile{Path: filepath.Join(dir, "plugin.log"), MaxSize: 10, MaxFiles: 2, now: func() time.Time { return clock }}
+	assert.Nil(r.Open())
+	defer r.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := r.Write([]byte("12345678\n"))
+		assert.Nil(err)
+		clock = clock.Add(time.Second)
+	}
+	content, err := ioutil.ReadFile(r.Path)
+	assert.Nil(err)
+	assert.Equal("12345678\n", string(content))
+
+	files := r.RotatedFiles()
+	assert.Equal([]string{
+		filepath.Join(dir, "plugin-2022-01-02-03:04:07.000.log"),
+		filepath.Join(dir, "plugin-2022-01-02-03:04:08.000.log"),
+	}, files)
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	clock := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &RotatingFile{Path: filepath.Join(dir, "plugin.log"), MaxAge: time.Hour, Compress: true, now: func() time.Time { return clock }}
+	assert.Nil(r.Open())
+	defer r.Close()
+
+	_, err := r.Write([]byte("first\n"))
+	assert.Nil(err)
+	clock = clock.Add(30 * time.Minute)
+	_, err = r.Write([]byte("second\n"))
+	assert.Nil(err)
+	assert.Empty(r.RotatedFiles())
+
+	clock = clock.Add(30 * time.Minute)
+	_, err = r.Write([]byte("third\n"))
+	assert.Nil(err)
+	files := r.RotatedFiles()
+	assert.Equal([]string{filepath.Join(dir, "plugin-2022-01-02-04:04:05.000.log.gz")}, files)
+
+	f, err := os.Open(files[0])
+	assert.Nil(err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	assert.Nil(err)
+	content, err := ioutil.ReadAll(zr)
+	assert.Nil(err)
+	assert.Equal("first\nsecond\n", string(content))
+}
+
+func TestRotatingFileOpen(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plugin.log")
+	assert.Nil(ioutil.WriteFile(path, []byte(strings.Repeat("x", 20)), 0644))
+	// left over by the startup rotation of older versions
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "plugin-2021-01-02-03:04:05.log"), nil, 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "plugin-other.log"), nil, 0644))
+
+	r := &RotatingFile{Path: path, MaxSize: 10, MaxFiles: 1}
+	assert.Nil(r.Open())
+	defer r.Close()
+	files := r.RotatedFiles()
+	assert.Len(files, 1)
+	assert.NotEqual(filepath.Join(dir, "plugin-2021-01-02-03:04:05.log"), files[0])
+	assert.FileExists(filepath.Join(dir, "plugin-other.log"))
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"strings"
+)
+
+const (
+	// EphemeralLVTag tags the lvm volumes of ephemeral inline volumes
+	EphemeralLVTag = "ephemeral"
+	// PodLVTagPrefix is the lvm tag prefix recording the pod uid of ephemeral inline volumes
+	PodLVTagPrefix = "pod_"
+)
+
+// EphemeralLVTags returns the lvm tags of an ephemeral inline volume of the pod
+func EphemeralLVTags(podUID string) []string {
+	return []string{EphemeralLVTag, PodLVTagPrefix + podUID}
+}
+
+// EphemeralPodUID returns the pod uid recorded in the lvm tags of an
+// ephemeral inline volume, empty if there is none
+func EphemeralPodUID(tags []string) string {
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); strings.HasPrefix(tag, PodLVTagPrefix) {
+			return strings.TrimPrefix(tag, PodLVTagPrefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEphemeralLVTags(t *testing.T) {
+	assert := assert.New(t)
+	tags := EphemeralLVTags("uid-1")
+	assert.Equal([]string{"ephemeral", "pod_uid-1"}, tags)
+	assert.Equal("uid-1", EphemeralPodUID(append([]string{"wipe_zero"}, tags...)))
+	assert.Equal("uid-2", EphemeralPodUID([]string{" pod_uid-2 "}))
+	assert.Equal("", EphemeralPodUID([]string{"ephemeral"}))
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package utils
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -38,6 +39,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/go-ping/ping"
+	"github.com/kubeservice-stack/local-cloud-csi-driver/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -186,13 +188,79 @@ type CommandRunFunc func(cmd string) (string, error)
 
 // Run run shell command
 func Run(cmd string) (string, error) {
+	start := time.Now()
 	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	return commandResult(cmd, start, out, err)
+}
+
+// RunContext runs the shell command like Run, the shell and the commands
+// it started are killed when the context is done.
+func RunContext(ctx context.Context, cmd string) (string, error) {
+	start := time.Now()
+	var out bytes.Buffer
+	command := exec.Command("sh", "-c", cmd)
+	command.Stdout = &out
+	command.Stderr = &out
+	// the children of the shell hold the output open, kill them with it
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := command.Start(); err != nil {
+		return commandResult(cmd, start, nil, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- command.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = ctx.Err()
+	}
+	return commandResult(cmd, start, out.Bytes(), err)
+}
+
+// commandResult records the metrics of the lvm command and returns its output
+func commandResult(cmd string, start time.Time, out []byte, err error) (string, error) {
+	if command := lvmCommand(cmd); command != "" {
+		metrics.LVMCommandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.LVMCommandFailures.WithLabelValues(command).Inc()
+		}
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to run cmd: " + cmd + ", with out: " + string(out) + ", with error: " + err.Error())
 	}
 	return string(out), nil
 }
 
+// lvmCommands are the lvm commands whose latency is measured
+var lvmCommands = map[string]bool{
+	"lvcreate": true, "lvremove": true, "lvextend": true, "lvconvert": true, "lvchange": true, "lvs": true, "lvdisplay": true,
+	"vgcreate": true, "vgextend": true, "vgs": true, "vgdisplay": true, "pvcreate": true, "pvs": true,
+}
+
+// ShellQuote quotes the argument for the sh -c command line of Run
+func ShellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// lvmCommand returns the lvm command run by the shell command line, empty
+// if it is not an lvm command.
+func lvmCommand(cmd string) string {
+	fields := strings.Fields(cmd)
+	// skip the nsenter prefix and its options
+	if len(fields) > 0 && filepath.Base(fields[0]) == "nsenter" {
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 || !lvmCommands[filepath.Base(fields[0])] {
+		return ""
+	}
+	return filepath.Base(fields[0])
+}
+
 // RunTimeout tag
 func RunTimeout(cmd string, timeout int) error {
 	ctx := context.Background()
@@ -674,7 +742,7 @@ func CheckParameterValidate(inputs []string) bool {
 }
 
 // CheckQuotaPathValidate is check quota path validating in csi-plugin
-func CheckQuotaPathValidate(kubeClient *kubernetes.Clientset, path string) error {
+func CheckQuotaPathValidate(kubeClient kubernetes.Interface, path string) error {
 	pvName := filepath.Base(path)
 	_, err := kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), pvName, metav1.GetOptions{})
 	if err != nil {
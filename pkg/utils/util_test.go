@@ -17,11 +17,13 @@ limitations under the License.
 package utils
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -151,3 +153,33 @@ func TestPodRunTime(t *testing.T) {
 	assert.NotNil(t, err)
 }
 */
+
+func TestLvmCommand(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("lvcreate", lvmCommand("/nsenter --mount=/proc/1/ns/mnt lvcreate -n lvm-1 -L 1g vg1"))
+	assert.Equal("lvs", lvmCommand("/nsenter --mount=/proc/1/ns/mnt --ipc=/proc/1/ns/ipc lvs --noheadings @driver"))
+	assert.Equal("vgs", lvmCommand("/usr/sbin/vgs"))
+	assert.Equal("", lvmCommand("/nsenter --mount=/proc/1/ns/mnt mkfs.ext4 /dev/vg1/lvm-1"))
+	assert.Equal("", lvmCommand(""))
+}
+
+func TestShellQuote(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("'/data/pv-1'", ShellQuote("/data/pv-1"))
+	assert.Equal(`'/data/it'\''s; reboot'`, ShellQuote("/data/it's; reboot"))
+}
+
+func TestRunContext(t *testing.T) {
+	assert := assert.New(t)
+	out, err := RunContext(context.Background(), "echo ok")
+	assert.Nil(err)
+	assert.Equal("ok\n", out)
+
+	// the children of the shell are killed with it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = RunContext(ctx, "sleep 10 | cat")
+	assert.NotNil(err)
+	assert.Less(time.Since(start), 5*time.Second)
+}